@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/smithy-go"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// accountPausePollInterval is the time between checks whether SES sending
+// has been re-enabled for a paused account.
+const accountPausePollInterval = time.Minute
+
+// defaultAccountPausedReply answers messages while SES account sending is
+// paused. Lifting a pause takes an AWS review, so the text asks for a long
+// retry.
+var defaultAccountPausedReply = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "SES account sending is paused. Please try again in a few hours",
+}
+
+var (
+	sesAccountPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "ses_account_paused",
+		Help:      "1 while SES sending is paused for the default AWS account",
+	})
+	sesAccountPausedRefused = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "ses_account_paused_total",
+		Help:      "Total number of messages refused because SES account sending is paused, by source: ses (SES refused the send) or relay (refused without calling SES)",
+	}, []string{"source"})
+)
+
+// isAccountPaused reports whether err is SES refusing a send because
+// sending is paused for the whole account: AccountSendingPausedException
+// from SES, SendingPausedException from the SES v2 API used for templates.
+// Paused configuration sets are not covered.
+func isAccountPaused(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "AccountSendingPausedException", "SendingPausedException":
+		return true
+	}
+	return false
+}
+
+// accountPause tracks whether SES has paused sending for the default
+// account. Once a send is refused for it, further messages get reply
+// without calling SES and the relay reports not ready, until
+// GetAccountSendingEnabled shows sending enabled again.
+type accountPause struct {
+	client *ses.Client
+	reply  *smtp.SMTPError
+	paused atomic.Bool
+}
+
+func (p *accountPause) isPaused() bool {
+	return p != nil && p.paused.Load()
+}
+
+// trip marks the account paused and starts watching for it to be lifted.
+func (p *accountPause) trip(ctx context.Context) {
+	if p.paused.Swap(true) {
+		return
+	}
+	sesAccountPaused.Set(1)
+	log.Printf("ALERT: SES has paused sending for the AWS account; replying %s and reporting not ready until sending is re-enabled", formatReply(p.reply))
+	go p.watch(ctx)
+}
+
+// watch polls SES until account sending is enabled again or ctx is done.
+// Failed checks keep the account paused.
+func (p *accountPause) watch(ctx context.Context) {
+	ticker := time.NewTicker(accountPausePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		out, err := p.client.GetAccountSendingEnabled(reqCtx, &ses.GetAccountSendingEnabledInput{})
+		cancel()
+		if err != nil {
+			log.Printf("account pause: checking SES account sending failed, still paused: %v", err)
+			continue
+		}
+		if out.Enabled {
+			p.paused.Store(false)
+			sesAccountPaused.Set(0)
+			log.Printf("SES account sending is enabled again, resuming")
+			return
+		}
+	}
+}
+
+// formatReply returns reply as written to the client, for logs.
+func formatReply(reply *smtp.SMTPError) string {
+	e := reply.EnhancedCode
+	return fmt.Sprintf("%d %d.%d.%d %s", reply.Code, e[0], e[1], e[2], reply.Message)
+}
+
+// sendsFromDefaultAccount reports whether the session's sender is the
+// default SES account rather than one of -sender-routes-file.
+func (s *Session) sendsFromDefaultAccount() bool {
+	sender, _ := s.backend.senderFor(s.from)
+	return sender == s.backend.sender
+}
+
+// checkAccountPaused fails the transaction without calling SES while the
+// default account's sending is paused.
+func (s *Session) checkAccountPaused() error {
+	p := s.backend.accountPause
+	if !p.isPaused() || !s.sendsFromDefaultAccount() {
+		return nil
+	}
+	sesAccountPausedRefused.With(prometheus.Labels{"source": "relay"}).Inc()
+	emailError.With(prometheus.Labels{"type": "account paused", "tenant": s.tenant}).Inc()
+	s.logf("rejecting message from %s, SES account sending is paused", s.from)
+	return p.reply
+}
+
+// accountPausedReply handles SES refusing a send because account sending
+// is paused. A pause of the default account is tripped; one of a routed
+// account only gets the reply.
+func (s *Session) accountPausedReply() *smtp.SMTPError {
+	sesAccountPausedRefused.With(prometheus.Labels{"source": "ses"}).Inc()
+	p := s.backend.accountPause
+	if p == nil {
+		return defaultAccountPausedReply
+	}
+	if s.sendsFromDefaultAccount() {
+		p.trip(s.backend.context())
+	} else {
+		s.logf("ALERT: SES has paused sending for the account of sender %s", s.from)
+	}
+	return p.reply
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+// effectiveConfig is the resolved configuration served on /admin/config.
+// It is built from the Backend once startup is complete and holds no
+// credentials: tokens and secrets are left out and URLs are redacted.
+type effectiveConfig struct {
+	Version               string            `json:"version"`
+	Region                string            `json:"region"`
+	ConfigurationSet      string            `json:"configuration_set,omitempty"`
+	UserConfigurationSets map[string]string `json:"user_configuration_sets,omitempty"`
+	Listeners             []configListener  `json:"listeners"`
+	AWS                   configAWS         `json:"aws"`
+	Limits                configLimits      `json:"limits"`
+	Features              configFeatures    `json:"features"`
+}
+
+type configListener struct {
+	Addr          string `json:"addr"`
+	Tenant        string `json:"tenant"`
+	StartTLS      bool   `json:"starttls"`
+	RequireTLS    bool   `json:"require_tls"`
+	ProxyProtocol bool   `json:"proxy_protocol"`
+	// ProxyTrusted lists the networks whose PROXY headers are honored,
+	// empty when all connections must send one.
+	ProxyTrusted []string `json:"proxy_protocol_trusted_cidrs,omitempty"`
+}
+
+type configAWS struct {
+	Proxy            string `json:"proxy,omitempty"`
+	EgressIP         string `json:"egress_ip,omitempty"`
+	MaxAttempts      int    `json:"max_attempts,omitempty"`
+	AttemptTimeout   string `json:"attempt_timeout,omitempty"`
+	OperationTimeout string `json:"operation_timeout,omitempty"`
+	RequireIdentity  bool   `json:"require_identity"`
+}
+
+type configLimits struct {
+	MaxMessagesPerConnection int                `json:"max_messages_per_connection"`
+	MaxRcptAttempts          int                `json:"max_rcpt_attempts"`
+	MaxConnectionsPerIP      int                `json:"max_connections_per_ip"`
+	MaxConcurrentSends       int                `json:"max_concurrent_sends"`
+	SendFairnessKey          string             `json:"send_fairness_key,omitempty"`
+	SendPriorityHeader       string             `json:"send_priority_header,omitempty"`
+	SendPriorities           []string           `json:"send_priorities,omitempty"`
+	MaxHeaderCount           int                `json:"max_header_count"`
+	MaxHeaderBytes           int                `json:"max_header_bytes"`
+	MinMessageSize           int                `json:"min_message_size"`
+	IdleTimeout              string             `json:"idle_timeout"`
+	TransactionTimeout       string             `json:"transaction_timeout"`
+	DomainRateLimits         map[string]float64 `json:"domain_rate_limits,omitempty"`
+	ClassRateLimits          map[string]float64 `json:"class_rate_limits,omitempty"`
+	ByteBudget               int64              `json:"byte_budget,omitempty"`
+	ByteBudgetWindow         string             `json:"byte_budget_window,omitempty"`
+	MaxTotalBufferBytes      int64              `json:"max_total_buffer_bytes,omitempty"`
+	SESCostPer1000           float64            `json:"ses_cost_per_1000"`
+	SESCostPerGB             float64            `json:"ses_cost_per_gb"`
+}
+
+type configFeatures struct {
+	Extensions          []string `json:"extensions"`
+	RequireAuth         bool     `json:"require_auth"`
+	RejectAuth          bool     `json:"reject_auth"`
+	AuthMechanisms      []string `json:"auth_mechanisms,omitempty"`
+	XOAuth2             string   `json:"xoauth2,omitempty"`
+	XOAuth2StaticTokens int      `json:"xoauth2_static_tokens,omitempty"`
+	SenderRoutes        []string `json:"sender_routes,omitempty"`
+	RejectUnrouted      bool     `json:"reject_unrouted,omitempty"`
+	TemplateTrigger     string   `json:"template_trigger_address,omitempty"`
+	ReturnPath          string   `json:"return_path,omitempty"`
+	SESSourceMode       string   `json:"ses_source_mode"`
+	BounceSource        string   `json:"bounce_source,omitempty"`
+	RedirectAllTo       string   `json:"redirect_all_to,omitempty"`
+	FromAlignment       string   `json:"from_alignment"`
+	DateCheck           string   `json:"date_check"`
+	EightBitPolicy      string   `json:"eightbit_policy"`
+	MissingToPolicy     string   `json:"missing_to_policy"`
+	NormalizeRecipients string   `json:"normalize_recipients"`
+	DedupeRecipients    bool     `json:"dedupe_recipients"`
+	DMARCCheck          bool     `json:"dmarc_report"`
+	LogPolicyDecisions  bool     `json:"log_policy_decisions"`
+	BlockedExtensions   []string `json:"blocked_attachment_extensions,omitempty"`
+	BlockedTypes        []string `json:"blocked_attachment_types,omitempty"`
+	CustomHeaders       []string `json:"custom_headers,omitempty"`
+	TrackingHeader      string   `json:"tracking_header,omitempty"`
+	StripBcc            bool     `json:"strip_bcc"`
+	AcceptGzip          bool     `json:"accept_gzip"`
+	SandboxCheck        bool     `json:"sandbox_check"`
+	CircuitBreaker      bool     `json:"circuit_breaker"`
+	Greylist            bool     `json:"greylist"`
+	Outbox              bool     `json:"outbox"`
+	ShadowRecipient     string   `json:"shadow_recipient,omitempty"`
+	FallbackRelay       string   `json:"fallback_relay,omitempty"`
+	CaptureDir          string   `json:"capture_dir,omitempty"`
+	CaptureSampleRate   float64  `json:"capture_sample_rate,omitempty"`
+	EventQueueURL       string   `json:"event_queue_url,omitempty"`
+	ReputationAlarm     string   `json:"reputation_alarm,omitempty"`
+	Maintenance         []string `json:"maintenance_windows,omitempty"`
+}
+
+// effectiveConfig resolves the configuration the relay runs with, given
+// the AWS region and client options and the started listeners.
+func (b *Backend) effectiveConfig(region string, opts sesClientOptions, listeners []configListener) *effectiveConfig {
+	c := &effectiveConfig{
+		Version:               version,
+		Region:                region,
+		UserConfigurationSets: b.userConfigSets,
+		Listeners:             listeners,
+		AWS: configAWS{
+			Proxy:           redactURL(opts.proxyURL),
+			EgressIP:        opts.egressIP,
+			MaxAttempts:     opts.maxAttempts,
+			RequireIdentity: opts.requireIdentity,
+		},
+		Limits: configLimits{
+			MaxMessagesPerConnection: b.maxMessagesPerConn,
+			MaxRcptAttempts:          b.maxRcptAttempts,
+			MaxHeaderCount:           b.maxHeaderCount,
+			MaxHeaderBytes:           b.maxHeaderBytes,
+			MinMessageSize:           b.minMessageSize,
+			IdleTimeout:              b.idleTimeout.String(),
+			TransactionTimeout:       b.transactionTimeout.String(),
+			SESCostPer1000:           b.costRates.per1000,
+			SESCostPerGB:             b.costRates.perGB,
+		},
+		Features: configFeatures{
+			RequireAuth:         b.requireAuth,
+			RejectAuth:          b.rejectAuth,
+			RejectUnrouted:      b.rejectUnrouted,
+			ReturnPath:          b.returnPath,
+			SESSourceMode:       b.sourceMode,
+			BounceSource:        b.bounceSource,
+			RedirectAllTo:       b.redirectAllTo,
+			FromAlignment:       b.fromAlignment,
+			DateCheck:           b.dateCheck.mode,
+			EightBitPolicy:      b.eightBitPolicy,
+			MissingToPolicy:     b.missingToPolicy,
+			NormalizeRecipients: b.normalizeRecipients,
+			DedupeRecipients:    b.dedupeRecipients,
+			DMARCCheck:          b.dmarc != nil,
+			LogPolicyDecisions:  b.logPolicyDecisions,
+			TrackingHeader:      b.trackingHeader,
+			StripBcc:            b.stripBcc,
+			AcceptGzip:          b.acceptGzip,
+			SandboxCheck:        b.sandbox != nil,
+			CircuitBreaker:      b.breaker != nil,
+			Greylist:            b.greylist != nil,
+			Outbox:              b.outbox != nil,
+		},
+	}
+	if name := b.configSetName.Load(); name != nil {
+		c.ConfigurationSet = *name
+	}
+	if opts.attemptTimeout > 0 {
+		c.AWS.AttemptTimeout = opts.attemptTimeout.String()
+	}
+	if opts.operationTimeout > 0 {
+		c.AWS.OperationTimeout = opts.operationTimeout.String()
+	}
+	if b.ipLimiter != nil {
+		c.Limits.MaxConnectionsPerIP = b.ipLimiter.max
+	}
+	if f := b.sendScheduler; f != nil {
+		c.Limits.MaxConcurrentSends, c.Limits.SendFairnessKey = f.max, f.key
+	}
+	if p := b.sendPriorities; p != nil {
+		c.Limits.SendPriorityHeader, c.Limits.SendPriorities = p.header, p.names
+	}
+	if b.domainLimiter != nil {
+		c.Limits.DomainRateLimits = b.domainLimiter.rates
+	}
+	if b.classLimiter != nil {
+		c.Limits.ClassRateLimits = b.classLimiter.rates
+	}
+	if b.byteBudget != nil {
+		c.Limits.ByteBudget = b.byteBudget.limit
+		c.Limits.ByteBudgetWindow = b.byteBudget.window.String()
+	}
+	if b.bufferBudget != nil {
+		c.Limits.MaxTotalBufferBytes = b.bufferBudget.max
+	}
+
+	f := &c.Features
+	f.Extensions = sortedKeys(b.extensions)
+	for _, mech := range b.authConfigured() {
+		if tlsOnly, ok := b.authMechanisms[mech]; b.authMechanisms == nil || ok {
+			if tlsOnly {
+				mech += ":tls"
+			}
+			f.AuthMechanisms = append(f.AuthMechanisms, mech)
+		}
+	}
+	if x := b.xoauth2; x != nil {
+		f.XOAuth2 = "static"
+		f.XOAuth2StaticTokens = len(x.static)
+		if x.introspectionURL != "" {
+			f.XOAuth2 = redactURL(x.introspectionURL)
+		}
+	}
+	for domain := range b.routes {
+		f.SenderRoutes = append(f.SenderRoutes, domain)
+	}
+	sort.Strings(f.SenderRoutes)
+	if b.templates != nil {
+		f.TemplateTrigger = b.templates.triggerAddress
+	}
+	if b.attachments != nil {
+		f.BlockedExtensions = sortedKeys(b.attachments.extensions)
+		f.BlockedTypes = sortedKeys(b.attachments.types)
+	}
+	// Header values may carry anything; only the names are shown.
+	for _, h := range b.customHeaders {
+		f.CustomHeaders = append(f.CustomHeaders, h.name)
+	}
+	if b.shadow != nil {
+		f.ShadowRecipient = b.shadow.recipient
+	}
+	if b.fallback != nil {
+		f.FallbackRelay = b.fallback.addr
+	}
+	if b.capture != nil {
+		f.CaptureDir, f.CaptureSampleRate = b.capture.dir, b.capture.rate
+	}
+	if b.events != nil {
+		f.EventQueueURL = b.events.queueURL
+	}
+	if b.reputation != nil {
+		f.ReputationAlarm = b.reputation.alarm
+	}
+	for _, w := range b.maintenance {
+		f.Maintenance = append(f.Maintenance, w.start.Format(time.RFC3339)+"/"+w.end.Format(time.RFC3339))
+	}
+	return c
+}
+
+// sortedKeys returns the keys of m set to true, sorted.
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k, ok := range m {
+		if ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// redactURL removes the password from a URL, or the whole value if it
+// does not parse.
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Redacted()
+}
+
+// serveConfig handles GET /admin/config.
+func (b *Backend) serveConfig(w http.ResponseWriter, r *http.Request) {
+	c := b.config.Load()
+	if c == nil {
+		writeHealth(w, http.StatusServiceUnavailable, "starting")
+		return
+	}
+	// The configuration set may have changed since startup.
+	current := *c
+	current.ConfigurationSet = aws.ToString(b.configSetName.Load())
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(current)
+}
+
+// configSetRequest is the body of POST /admin/config-set and the response
+// of both methods. An empty name sends without a configuration set.
+type configSetRequest struct {
+	ConfigurationSet string `json:"configuration_set"`
+}
+
+// serveConfigSet handles GET /admin/config-set.
+func (b *Backend) serveConfigSet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configSetRequest{ConfigurationSet: aws.ToString(b.configSetName.Load())})
+}
+
+// setConfigSet handles POST /admin/config-set, switching the configuration
+// set of messages without a user set once SES confirms that it exists in
+// every account messages are sent through, routed ones included. Messages
+// already being sent keep the previous one.
+func (b *Backend) setConfigSet(w http.ResponseWriter, r *http.Request) {
+	if b.config.Load() == nil {
+		writeHealth(w, http.StatusServiceUnavailable, "starting")
+		return
+	}
+	var req configSetRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.ConfigurationSet)
+	var next *string
+	if name != "" {
+		var out *ses.DescribeConfigurationSetOutput
+		var err error
+		for _, client := range b.sesClients {
+			if out, err = validateConfigurationSet(r.Context(), client, name); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("admin: configuration set '%s' requested by %s not usable: %v", name, r.RemoteAddr, err)
+			code := http.StatusBadGateway
+			var notFound *types.ConfigurationSetDoesNotExistException
+			if errors.As(err, &notFound) {
+				code = http.StatusBadRequest
+			}
+			http.Error(w, fmt.Sprintf("configuration set %q not usable: %v", name, err), code)
+			return
+		}
+		logConfigurationSet(name, out)
+		next = &name
+	}
+	prev := b.configSetName.Swap(next)
+	log.Printf("admin: configuration set changed from %q to %q by %s", aws.ToString(prev), name, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configSetRequest{ConfigurationSet: name})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request headers carrying the -admin-secret signature.
+const (
+	adminTimestampHeader = "X-Admin-Timestamp"
+	adminNonceHeader     = "X-Admin-Nonce"
+	adminSignatureHeader = "X-Admin-Signature"
+)
+
+// adminSignatureWindow is how far a signed request's timestamp may be from
+// the server clock, either way.
+const adminSignatureWindow = 30 * time.Second
+
+// adminMaxBody bounds the request body read to check its signature.
+const adminMaxBody = 1 << 20
+
+// adminAuth authorizes admin requests: a bearer token and, when secret is
+// set, a signature over the request that can only be used once.
+type adminAuth struct {
+	token  string
+	secret []byte
+
+	mu sync.Mutex
+	// nonces holds the nonces of accepted signed requests until their
+	// timestamps leave the window.
+	nonces map[string]time.Time
+}
+
+func newAdminAuth(token, secret string) *adminAuth {
+	a := &adminAuth{token: token}
+	if secret != "" {
+		a.secret = []byte(secret)
+		a.nonces = make(map[string]time.Time)
+	}
+	return a
+}
+
+// adminSignature returns the hex HMAC-SHA256, under secret, of the method,
+// the request URI, the timestamp, the nonce and the SHA-256 of the body,
+// joined by newlines.
+func adminSignature(secret []byte, method, uri, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{method, uri, timestamp, nonce, hex.EncodeToString(sum[:])}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature of r when a secret is configured. The body
+// is read and replaced for the handler.
+func (a *adminAuth) verify(r *http.Request) error {
+	if a.secret == nil {
+		return nil
+	}
+	timestamp, nonce := r.Header.Get(adminTimestampHeader), r.Header.Get(adminNonceHeader)
+	signature := r.Header.Get(adminSignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return fmt.Errorf("missing %s, %s or %s", adminTimestampHeader, adminNonceHeader, adminSignatureHeader)
+	}
+	if len(nonce) > 128 {
+		return errors.New("nonce too long")
+	}
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	signed := time.Unix(secs, 0)
+	if skew := time.Since(signed); skew > adminSignatureWindow || skew < -adminSignatureWindow {
+		return fmt.Errorf("timestamp %s outside the %s window", signed.UTC().Format(time.RFC3339), adminSignatureWindow)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, adminMaxBody+1))
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	if len(body) > adminMaxBody {
+		return errors.New("body too large")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	want := adminSignature(a.secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(want)) {
+		return errors.New("signature mismatch")
+	}
+	return a.useNonce(nonce, signed)
+}
+
+// useNonce records nonce, refusing one seen before. Entries are dropped
+// once their timestamp is out of the window, when they could not be
+// replayed anyway.
+func (a *adminAuth) useNonce(nonce string, signed time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for n, t := range a.nonces {
+		if now.Sub(t) > adminSignatureWindow {
+			delete(a.nonces, n)
+		}
+	}
+	if _, seen := a.nonces[nonce]; seen {
+		return errors.New("nonce already used")
+	}
+	a.nonces[nonce] = signed
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminSecret = "s3cret"
+
+// signedAdminRequest returns a request signed with testAdminSecret at
+// signedAt, then has tamper change it before it is checked.
+func signedAdminRequest(method, uri, nonce, body string, signedAt time.Time, tamper func(r *http.Request)) *http.Request {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	r.Header.Set(adminTimestampHeader, timestamp)
+	r.Header.Set(adminNonceHeader, nonce)
+	r.Header.Set(adminSignatureHeader, adminSignature([]byte(testAdminSecret), method, uri, timestamp, nonce, []byte(body)))
+	if tamper != nil {
+		tamper(r)
+	}
+	return r
+}
+
+func TestAdminAuthVerify(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		nonce    string
+		body     string
+		signedAt time.Time
+		tamper   func(r *http.Request)
+		wantErr  string // "" for a valid request
+	}{
+		{name: "valid", signedAt: now},
+		{name: "valid with body", body: `{"configuration_set":"cs"}`, signedAt: now},
+		{name: "upper case signature", signedAt: now, tamper: func(r *http.Request) {
+			r.Header.Set(adminSignatureHeader, strings.ToUpper(r.Header.Get(adminSignatureHeader)))
+		}},
+		{name: "tampered method", signedAt: now, tamper: func(r *http.Request) { r.Method = http.MethodDelete }, wantErr: "signature mismatch"},
+		{name: "tampered uri", signedAt: now, tamper: func(r *http.Request) {
+			r.URL.RawQuery = "drain=false"
+		}, wantErr: "signature mismatch"},
+		{name: "tampered body", body: `{"a":1}`, signedAt: now, tamper: func(r *http.Request) {
+			r.Body = io.NopCloser(strings.NewReader(`{"a":2}`))
+		}, wantErr: "signature mismatch"},
+		{name: "wrong secret", signedAt: now, tamper: func(r *http.Request) {
+			ts := r.Header.Get(adminTimestampHeader)
+			r.Header.Set(adminSignatureHeader, adminSignature([]byte("other"), r.Method, r.URL.RequestURI(), ts, r.Header.Get(adminNonceHeader), nil))
+		}, wantErr: "signature mismatch"},
+		{name: "just inside the window, past", signedAt: now.Add(-adminSignatureWindow + 2*time.Second)},
+		{name: "just inside the window, future", signedAt: now.Add(adminSignatureWindow - time.Second)},
+		{name: "just outside the window, past", signedAt: now.Add(-adminSignatureWindow - time.Second), wantErr: "outside the"},
+		{name: "just outside the window, future", signedAt: now.Add(adminSignatureWindow + 2*time.Second), wantErr: "outside the"},
+		{name: "invalid timestamp", signedAt: now, tamper: func(r *http.Request) { r.Header.Set(adminTimestampHeader, "yesterday") }, wantErr: "invalid timestamp"},
+		{name: "missing signature", signedAt: now, tamper: func(r *http.Request) { r.Header.Del(adminSignatureHeader) }, wantErr: "missing"},
+		{name: "oversized nonce", nonce: strings.Repeat("n", 129), signedAt: now, wantErr: "nonce too long"},
+		{name: "largest nonce", nonce: strings.Repeat("n", 128), signedAt: now},
+		{name: "oversized body", body: strings.Repeat("x", adminMaxBody+1), signedAt: now, wantErr: "body too large"},
+		{name: "largest body", body: strings.Repeat("x", adminMaxBody), signedAt: now},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdminAuth("token", testAdminSecret)
+			nonce := tt.nonce
+			if nonce == "" {
+				nonce = "nonce-" + strconv.Itoa(i)
+			}
+			r := signedAdminRequest(http.MethodPost, "/admin/drain?drain=true", nonce, tt.body, tt.signedAt, tt.tamper)
+			err := a.verify(r)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				// The handler still gets the body.
+				if body, _ := io.ReadAll(r.Body); string(body) != tt.body {
+					t.Errorf("body after verify = %d bytes, want %d", len(body), len(tt.body))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verify = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdminAuthNonceReplay(t *testing.T) {
+	a := newAdminAuth("token", testAdminSecret)
+	now := time.Now()
+	if err := a.verify(signedAdminRequest(http.MethodPost, "/admin/drain", "once", "", now, nil)); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := a.verify(signedAdminRequest(http.MethodPost, "/admin/drain", "once", "", now, nil)); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("replayed request: %v, want the nonce refused", err)
+	}
+	// A mismatching signature does not use up the nonce.
+	bad := signedAdminRequest(http.MethodPost, "/admin/drain", "unused", "", now, func(r *http.Request) { r.Method = http.MethodPut })
+	if err := a.verify(bad); err == nil {
+		t.Fatal("tampered request accepted")
+	}
+	if err := a.verify(signedAdminRequest(http.MethodPost, "/admin/drain", "unused", "", now, nil)); err != nil {
+		t.Errorf("request after a failed one with its nonce: %v", err)
+	}
+
+	// Nonces are forgotten once their timestamp has left the window.
+	if err := a.useNonce("old", now.Add(-adminSignatureWindow-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	a.useNonce("new", now)
+	if _, ok := a.nonces["old"]; ok {
+		t.Error("nonce outside the window kept")
+	}
+	if _, ok := a.nonces["once"]; !ok {
+		t.Error("nonce inside the window dropped")
+	}
+
+	if err := newAdminAuth("token", "").verify(httptest.NewRequest(http.MethodPost, "/admin/drain", nil)); err != nil {
+		t.Errorf("verify without a secret: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Modes for -require-from-alignment.
+const (
+	AlignmentOff     = "off"
+	AlignmentAddress = "address" // From address equals MAIL FROM
+	AlignmentDomain  = "domain"  // same domain
+	AlignmentRelaxed = "relaxed" // same domain or a subdomain of either
+)
+
+// validateAlignmentMode rejects unknown -require-from-alignment modes.
+func validateAlignmentMode(mode string) error {
+	switch mode {
+	case AlignmentOff, AlignmentAddress, AlignmentDomain, AlignmentRelaxed:
+		return nil
+	}
+	return fmt.Errorf("unknown -require-from-alignment mode %q (want %s, %s, %s or %s)", mode, AlignmentOff, AlignmentAddress, AlignmentDomain, AlignmentRelaxed)
+}
+
+// fromAligned reports whether addr, a From header address, is aligned with
+// the envelope sender under mode. Domains compare case-insensitively, local
+// parts exactly.
+func fromAligned(mode, envelope, addr string) bool {
+	envLocal, envDomain := splitAddress(envelope)
+	local, domain := splitAddress(addr)
+	switch mode {
+	case AlignmentAddress:
+		return local == envLocal && domain == envDomain
+	case AlignmentDomain:
+		return domain == envDomain
+	case AlignmentRelaxed:
+		return domain == envDomain || strings.HasSuffix(domain, "."+envDomain) || strings.HasSuffix(envDomain, "."+domain)
+	}
+	return true
+}
+
+// splitAddress returns the local part and the lowercased domain of addr.
+func splitAddress(addr string) (string, string) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return addr, ""
+	}
+	return addr[:i], strings.ToLower(strings.TrimSuffix(addr[i+1:], "."))
+}
+
+// checkFromAlignment rejects messages whose From header addresses are not
+// all aligned with MAIL FROM. Display names are ignored. Bounces, with an
+// empty envelope sender, are not checked.
+func (s *Session) checkFromAlignment(data []byte) error {
+	mode := s.backend.fromAlignment
+	if mode == "" || mode == AlignmentOff || s.from == "" {
+		return nil
+	}
+
+	fields, _ := splitHeader(data)
+	value, ok := getHeader(fields, "From")
+	var addrs []*mail.Address
+	var err error
+	if ok {
+		parser := mail.AddressParser{WordDecoder: new(mime.WordDecoder)}
+		addrs, err = parser.ParseList(value)
+	}
+	if !ok || err != nil || len(addrs) == 0 {
+		emailError.With(prometheus.Labels{"type": "from misaligned", "tenant": s.tenant}).Inc()
+		s.logf("rejecting message from %s: missing or unparseable From header %q", s.from, value)
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Error: missing or invalid From header",
+		}
+	}
+
+	for _, a := range addrs {
+		if !fromAligned(mode, s.from, a.Address) {
+			emailError.With(prometheus.Labels{"type": "from misaligned", "tenant": s.tenant}).Inc()
+			s.logf("rejecting message from %s: From header address %s is not aligned (%s)", s.from, a.Address, mode)
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Error: From header does not match the envelope sender",
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Bounds on the MIME structure walked by the attachment scan.
+const (
+	maxMIMEDepth = 10
+	maxMIMEParts = 500
+)
+
+var errMIMETooComplex = errors.New("MIME structure too complex")
+
+// attachmentPolicy blocks messages carrying attachments with the listed
+// file extensions (".exe") or MIME types ("application/x-msdownload").
+type attachmentPolicy struct {
+	extensions map[string]bool
+	types      map[string]bool
+}
+
+// newAttachmentPolicy builds a policy from comma separated lists. It returns
+// nil when both lists are empty.
+func newAttachmentPolicy(extensions, types string) *attachmentPolicy {
+	p := &attachmentPolicy{extensions: make(map[string]bool), types: make(map[string]bool)}
+	for _, ext := range strings.Split(extensions, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		p.extensions[ext] = true
+	}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			p.types[t] = true
+		}
+	}
+	if len(p.extensions) == 0 && len(p.types) == 0 {
+		return nil
+	}
+	return p
+}
+
+// scan returns a description of the first blocked part in the message, or
+// "" if there is none.
+func (p *attachmentPolicy) scan(data []byte) (string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	parts := 0
+	return p.walk(textproto.MIMEHeader(msg.Header), msg.Body, 0, &parts)
+}
+
+// walk checks one MIME entity and recurses into multipart and message/rfc822
+// bodies.
+func (p *attachmentPolicy) walk(h textproto.MIMEHeader, body io.Reader, depth int, parts *int) (string, error) {
+	*parts++
+	if depth > maxMIMEDepth || *parts > maxMIMEParts {
+		return "", errMIMETooComplex
+	}
+
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if blocked := p.check(h, mediaType, params); blocked != "" {
+		return blocked, nil
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if params["boundary"] == "" {
+			return "", fmt.Errorf("multipart entity without boundary")
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			if blocked, err := p.walk(part.Header, part, depth+1, parts); blocked != "" || err != nil {
+				return blocked, err
+			}
+		}
+	case mediaType == "message/rfc822":
+		inner, err := mail.ReadMessage(body)
+		if err != nil {
+			return "", err
+		}
+		return p.walk(textproto.MIMEHeader(inner.Header), inner.Body, depth+1, parts)
+	}
+	return "", nil
+}
+
+// check matches a single entity against the policy.
+func (p *attachmentPolicy) check(h textproto.MIMEHeader, mediaType string, params map[string]string) string {
+	if p.types[mediaType] {
+		return "type " + mediaType
+	}
+	name := params["name"]
+	if _, dparams, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && dparams["filename"] != "" {
+		name = dparams["filename"]
+	}
+	if name == "" {
+		return ""
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	if ext := strings.ToLower(path.Ext(strings.TrimRight(name, ". "))); p.extensions[ext] {
+		return fmt.Sprintf("file %q", name)
+	}
+	return ""
+}
+
+// checkAttachments rejects messages with blocked attachments. Messages whose
+// structure cannot be scanned are rejected as well, so that malformed MIME
+// cannot be used to bypass the policy.
+func (s *Session) checkAttachments(data []byte) error {
+	p := s.backend.attachments
+	if p == nil {
+		return nil
+	}
+	blocked, err := p.scan(data)
+	if err != nil {
+		emailError.With(prometheus.Labels{"type": "unscannable mime", "tenant": s.tenant}).Inc()
+		s.logf("cannot scan message from %s for attachments: %v", s.from, err)
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Error: message structure could not be checked for attachments",
+		}
+	}
+	if blocked != "" {
+		emailError.With(prometheus.Labels{"type": "blocked attachment", "tenant": s.tenant}).Inc()
+		s.logf("message from %s carries blocked attachment: %s", s.from, blocked)
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Error: message contains a blocked attachment type",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// multipartMessage returns a multipart/mixed message with a text part and
+// the given attachment part headers.
+func multipartMessage(attachment string) string {
+	return strings.Join([]string{
+		"From: a@example.com",
+		"To: b@example.org",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="b1"`,
+		"",
+		"--b1",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"See attached.",
+		"--b1",
+		attachment,
+		"Content-Transfer-Encoding: base64",
+		"",
+		"TVqQAAMAAAAEAAAA",
+		"--b1--",
+		"",
+	}, "\r\n")
+}
+
+func TestAttachmentPolicyScan(t *testing.T) {
+	p := newAttachmentPolicy(".exe,scr", "application/x-msdownload")
+	tests := []struct {
+		name    string
+		data    string
+		blocked bool
+	}{
+		{"blocked extension", multipartMessage("Content-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"setup.EXE\""), true},
+		{"blocked extension in name", multipartMessage("Content-Type: application/octet-stream; name=\"screen.scr\""), true},
+		{"blocked type", multipartMessage("Content-Type: application/x-msdownload"), true},
+		{"encoded filename", multipartMessage("Content-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"=?utf-8?q?invoice.exe?=\""), true},
+		{"allowed", multipartMessage("Content-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"invoice.pdf\""), false},
+		{"allowed double extension", multipartMessage("Content-Type: application/zip\r\nContent-Disposition: attachment; filename=\"setup.exe.zip\""), false},
+		{"nested", strings.Join([]string{
+			"From: a@example.com",
+			`Content-Type: multipart/mixed; boundary="outer"`,
+			"",
+			"--outer",
+			`Content-Type: multipart/alternative; boundary="inner"`,
+			"",
+			"--inner",
+			"Content-Type: text/plain",
+			"",
+			"text",
+			"--inner",
+			"Content-Type: application/octet-stream; name=\"run.exe\"",
+			"",
+			"data",
+			"--inner--",
+			"--outer--",
+			"",
+		}, "\r\n"), true},
+		{"plain", "From: a@example.com\r\nSubject: setup.exe\r\n\r\nno attachments\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocked, err := p.scan([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			if (blocked != "") != tt.blocked {
+				t.Errorf("scan = %q, want blocked %t", blocked, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestCheckAttachments(t *testing.T) {
+	b := &Backend{attachments: newAttachmentPolicy(".exe", "")}
+	tests := []struct {
+		name     string
+		data     string
+		wantCode int // 0 to accept
+	}{
+		{"blocked", multipartMessage("Content-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"setup.exe\""), 554},
+		{"allowed", multipartMessage("Content-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"invoice.pdf\""), 0},
+		{"missing boundary", "From: a@example.com\r\nContent-Type: multipart/mixed\r\n\r\nbody\r\n", 554},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession(t, b, tt.data)
+			err := s.checkAttachments(s.data)
+			var smtpErr *smtp.SMTPError
+			switch {
+			case tt.wantCode == 0 && err != nil:
+				t.Errorf("checkAttachments = %v, want accepted", err)
+			case tt.wantCode != 0 && (!errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode):
+				t.Errorf("checkAttachments = %v, want %d", err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const XOAuth2 = "XOAUTH2"
+
+// Results of an authentication attempt for smtpd_auth_total.
+const (
+	AuthSuccess = "success"
+	AuthFailure = "failure" // credentials rejected or malformed
+	AuthError   = "error"   // credentials could not be checked
+)
+
+// maxAuthFailureUsers caps the user label values of
+// smtpd_auth_user_failures_total; later users are counted as "other".
+const maxAuthFailureUsers = 100
+
+var authAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "auth_total",
+	Help:      "Total number of AUTH attempts by SASL mechanism and result",
+}, []string{"mechanism", "result"})
+
+var authUserFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "auth_user_failures_total",
+	Help:      "Total number of failed AUTH attempts by user, with -auth-metrics-per-user",
+}, []string{"user"})
+
+// authFailureUsers tracks the users labelled in smtpd_auth_user_failures_total.
+// User names come from clients, so their number is capped.
+type authFailureUsers struct {
+	mu    sync.Mutex
+	users map[string]bool
+}
+
+// label returns the label value for user.
+func (u *authFailureUsers) label(user string) string {
+	user = strings.ToLower(user)
+	if user == "" {
+		return "none"
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.users[user] {
+		if len(u.users) >= maxAuthFailureUsers {
+			return "other"
+		}
+		u.users[user] = true
+	}
+	return user
+}
+
+// observeAuth counts an authentication attempt, and with
+// -auth-metrics-per-user the failures of user.
+func (s *Session) observeAuth(mech, result, user string) {
+	authAttempts.With(prometheus.Labels{"mechanism": strings.ToLower(mech), "result": result}).Inc()
+	if u := s.backend.authFailureUsers; u != nil && result == AuthFailure {
+		authUserFailures.With(prometheus.Labels{"user": u.label(user)}).Inc()
+	}
+}
+
+var (
+	errInvalidToken = errors.New("invalid token")
+
+	errAuthInvalid = &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Authentication credentials invalid",
+	}
+	errAuthTemporary = &smtp.SMTPError{
+		Code:         454,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Temporary authentication failure",
+	}
+	errAuthPlainRejected = &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Authentication rejected, this relay accepts no PLAIN credentials",
+	}
+	errAuthMalformed = &smtp.SMTPError{
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+		Message:      "Malformed XOAUTH2 response",
+	}
+)
+
+// xoauth2Authenticator validates OAuth2 bearer tokens presented with the
+// XOAUTH2 SASL mechanism, either against a static token set or an RFC 7662
+// introspection endpoint. Tokens are never logged.
+type xoauth2Authenticator struct {
+	// static maps the SHA-256 of an allowed token to its user.
+	static map[[32]byte]string
+
+	introspectionURL string
+	clientID         string
+	clientSecret     string
+	httpClient       *http.Client
+}
+
+// loadTokenFile reads "username token" pairs, one per line. Blank lines and
+// lines starting with # are ignored.
+func loadTokenFile(path string) (map[[32]byte]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[[32]byte]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"username token\"", path, n)
+		}
+		tokens[sha256.Sum256([]byte(fields[1]))] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// validate returns the user identity for token. It returns errInvalidToken
+// when the token is not accepted and another error when validation could
+// not be performed.
+func (a *xoauth2Authenticator) validate(ctx context.Context, token string) (string, error) {
+	if user, ok := a.static[sha256.Sum256([]byte(token))]; ok {
+		return user, nil
+	}
+	if a.introspectionURL == "" {
+		return "", errInvalidToken
+	}
+	return a.introspect(ctx, token)
+}
+
+// introspect asks the introspection endpoint whether token is active.
+func (a *xoauth2Authenticator) introspect(ctx context.Context, token string) (string, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.introspectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.clientID != "" {
+		req.SetBasicAuth(a.clientID, a.clientSecret)
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("introspection endpoint returned %s", resp.Status)
+	}
+
+	var result struct {
+		Active   bool   `json:"active"`
+		Username string `json:"username"`
+		Subject  string `json:"sub"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding introspection response: %w", err)
+	}
+	if !result.Active {
+		return "", errInvalidToken
+	}
+	if result.Username != "" {
+		return result.Username, nil
+	}
+	if result.Subject != "" {
+		return result.Subject, nil
+	}
+	return "", errInvalidToken
+}
+
+// parseXOAuth2 parses the client response
+// "user=" user "\x01auth=Bearer " token "\x01\x01".
+func parseXOAuth2(response []byte) (user, token string, ok bool) {
+	for _, field := range bytes.Split(response, []byte{1}) {
+		key, value, found := strings.Cut(string(field), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "user":
+			user = value
+		case "auth":
+			scheme, t, found := strings.Cut(value, " ")
+			if !found || !strings.EqualFold(scheme, "Bearer") {
+				return "", "", false
+			}
+			token = strings.TrimSpace(t)
+		}
+	}
+	return user, token, token != ""
+}
+
+// xoauth2Server implements sasl.Server for XOAUTH2.
+type xoauth2Server struct {
+	session *Session
+	failed  bool
+}
+
+// Next implements sasl.Server
+func (x *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	defer func() {
+		if done {
+			x.session.observeReply("AUTH", err)
+		}
+	}()
+	if x.failed {
+		// The client acknowledged the error challenge; finish with 535.
+		return nil, true, errAuthInvalid
+	}
+	if response == nil {
+		// No initial response, ask for one.
+		return []byte{}, false, nil
+	}
+
+	user, token, ok := parseXOAuth2(response)
+	if !ok {
+		x.session.observeAuth(XOAuth2, AuthFailure, user)
+		return nil, true, errAuthMalformed
+	}
+
+	ctx, cancel := context.WithTimeout(x.session.backend.context(), 10*time.Second)
+	defer cancel()
+
+	a := x.session.backend.xoauth2
+	identity, err := a.validate(ctx, token)
+	if err == nil && user != "" && !strings.EqualFold(user, identity) {
+		err = errInvalidToken
+	}
+	if err != nil {
+		if !errors.Is(err, errInvalidToken) {
+			x.session.logf("ERROR: xoauth2: token validation failed: %v", err)
+			x.session.observeAuth(XOAuth2, AuthError, user)
+			return nil, true, errAuthTemporary
+		}
+		x.session.logf("xoauth2: authentication failed for user %q", user)
+		x.session.observeAuth(XOAuth2, AuthFailure, user)
+		// RFC-style XOAUTH2 failure: send a JSON error challenge, the client
+		// replies with an empty response and we then fail with 535.
+		x.failed = true
+		challenge, _ := json.Marshal(map[string]string{
+			"status":  "401",
+			"schemes": "bearer",
+		})
+		return challenge, false, nil
+	}
+
+	x.session.user = identity
+	x.session.logf("xoauth2: authenticated user %s", identity)
+	x.session.observeAuth(XOAuth2, AuthSuccess, identity)
+	return nil, true, nil
+}
+
+// authPolicy is the -auth-mechanisms setting: the allowed SASL mechanisms,
+// each mapped to whether it is only offered over TLS.
+type authPolicy map[string]bool
+
+// parseAuthPolicy parses a comma separated list of mechanisms, each
+// optionally suffixed with ":tls", e.g. "XOAUTH2,PLAIN:tls".
+func parseAuthPolicy(list string) (authPolicy, error) {
+	p := make(authPolicy)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, opt, hasOpt := strings.Cut(entry, ":")
+		name = strings.ToUpper(name)
+		if name != XOAuth2 && name != sasl.Plain {
+			return nil, fmt.Errorf("unknown mechanism %q (want %s or %s)", name, XOAuth2, sasl.Plain)
+		}
+		if hasOpt && !strings.EqualFold(opt, "tls") {
+			return nil, fmt.Errorf("invalid option %q for %s (want tls)", opt, name)
+		}
+		p[name] = hasOpt
+	}
+	if len(p) == 0 {
+		return nil, errors.New("no mechanism given")
+	}
+	return p, nil
+}
+
+// usable reports whether some listener can offer one of the mechanisms.
+// go-smtp only offers AUTH over plaintext on listeners not requiring TLS,
+// and TLS-only mechanisms need STARTTLS.
+func (p authPolicy) usable(tlsConfigs []*tls.Config, requireTLS []bool) bool {
+	for i, cfg := range tlsConfigs {
+		for _, tlsOnly := range p {
+			if cfg != nil || (!tlsOnly && !requireTLS[i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authConfigured returns the mechanisms the relay can serve: XOAUTH2 with a
+// token source, PLAIN with -reject-auth.
+func (b *Backend) authConfigured() []string {
+	var mechs []string
+	if b.xoauth2 != nil {
+		mechs = append(mechs, XOAuth2)
+	}
+	if b.rejectAuth {
+		mechs = append(mechs, sasl.Plain)
+	}
+	return mechs
+}
+
+// mechanismAllowed reports whether -auth-mechanisms allows mech on this
+// connection. Without the flag every configured mechanism is.
+func (s *Session) mechanismAllowed(mech string) bool {
+	p := s.backend.authMechanisms
+	if p == nil {
+		return true
+	}
+	tlsOnly, ok := p[mech]
+	if !ok {
+		return false
+	}
+	if tlsOnly {
+		_, isTLS := s.conn.TLSConnectionState()
+		return isTLS
+	}
+	return true
+}
+
+// AuthMechanisms implements smtp.AuthSession
+func (s *Session) AuthMechanisms() []string {
+	var mechs []string
+	for _, mech := range s.backend.authConfigured() {
+		if s.mechanismAllowed(mech) {
+			mechs = append(mechs, mech)
+		}
+	}
+	return mechs
+}
+
+// Auth implements smtp.AuthSession
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if !s.mechanismAllowed(mech) {
+		s.logf("refusing AUTH %s, not allowed by -auth-mechanisms on this connection", mech)
+		s.observeReply("AUTH", smtp.ErrAuthUnknownMechanism)
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+	if mech == XOAuth2 && s.backend.xoauth2 != nil {
+		return &xoauth2Server{session: s}, nil
+	}
+	if mech == sasl.Plain && s.backend.rejectAuth {
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return s.AuthPlain(username, password)
+		}), nil
+	}
+	s.observeReply("AUTH", smtp.ErrAuthUnknownMechanism)
+	return nil, smtp.ErrAuthUnknownMechanism
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// sesClientOptions holds the settings used when building AWS clients.
+type sesClientOptions struct {
+	// proxyURL overrides HTTPS_PROXY/NO_PROXY when set.
+	proxyURL string
+
+	// egressIP is the local address AWS API connections are made from, the
+	// system's choice when empty.
+	egressIP string
+
+	// region and roleARN override the region from the environment and
+	// AWS_ROLE_ARN when set.
+	region  string
+	roleARN string
+
+	// maxAttempts overrides the SDK's attempts per call (AWS_MAX_ATTEMPTS
+	// or 3) when positive. attemptTimeout bounds each HTTP attempt and
+	// operationTimeout a whole call including the SDK's retries; 0 leaves
+	// them unbounded.
+	maxAttempts      int
+	attemptTimeout   time.Duration
+	operationTimeout time.Duration
+
+	// requireIdentity fails client creation when GetCallerIdentity does,
+	// instead of only logging a warning.
+	requireIdentity bool
+}
+
+// newAwsHTTPClient returns the HTTP client used for all AWS API calls. Proxy
+// settings are applied explicitly so that they take effect regardless of the
+// SDK defaults: -ses-proxy-url if set, otherwise HTTPS_PROXY/NO_PROXY from
+// the environment.
+func newAwsHTTPClient(opts sesClientOptions) (*awshttp.BuildableClient, error) {
+	proxy := http.ProxyFromEnvironment
+	if opts.proxyURL != "" {
+		u, err := url.Parse(opts.proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q (want http, https or socks5)", u.Scheme)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q: missing host", u.Redacted())
+		}
+		proxy = http.ProxyURL(u)
+		log.Printf("AWS API calls use proxy %s", u.Redacted())
+	} else if p := httpsProxyFromEnv(); p != "" {
+		if u, err := url.Parse(p); err == nil {
+			p = u.Redacted()
+		}
+		log.Printf("AWS API calls use proxy %s from environment (NO_PROXY: %q)", p, noProxyFromEnv())
+	}
+
+	client := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.Proxy = proxy
+	})
+	if opts.egressIP != "" {
+		local, err := egressAddr(opts.egressIP)
+		if err != nil {
+			return nil, err
+		}
+		client = client.WithDialerOptions(func(d *net.Dialer) {
+			d.LocalAddr = local
+		})
+		log.Printf("AWS API calls use source address %s", local.IP)
+	}
+	if opts.attemptTimeout > 0 {
+		client = client.WithTimeout(opts.attemptTimeout)
+	}
+	return client, nil
+}
+
+// egressAddr parses the -egress-ip address and checks that it is assigned
+// to this host by binding a socket to it.
+func egressAddr(addr string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid egress IP %q", addr)
+	}
+	local := &net.TCPAddr{IP: ip}
+	l, err := net.ListenTCP("tcp", local)
+	if err != nil {
+		return nil, fmt.Errorf("egress IP %s is not usable on this host: %w", ip, err)
+	}
+	l.Close()
+	return local, nil
+}
+
+// withOperationTimeout returns an API option bounding every AWS call,
+// retries included, to timeout. It runs before the SDK's retry loop, so the
+// deadline covers all attempts.
+func withOperationTimeout(timeout time.Duration) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("OperationTimeout",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				ctx, cancel := context.WithTimeout(ctx, timeout)
+				defer cancel()
+				return next.HandleInitialize(ctx, in)
+			}), middleware.Before)
+	}
+}
+
+func httpsProxyFromEnv() string {
+	if p := os.Getenv("HTTPS_PROXY"); p != "" {
+		return p
+	}
+	return os.Getenv("https_proxy")
+}
+
+func noProxyFromEnv() string {
+	if p := os.Getenv("NO_PROXY"); p != "" {
+		return p
+	}
+	return os.Getenv("no_proxy")
+}
+
+// startupJitter waits for a random time up to max before the first AWS
+// calls, so that a fleet restarted at once spreads its GetCallerIdentity and
+// configuration calls instead of hitting API throttling together. It returns
+// false if ctx is done first.
+func startupJitter(ctx context.Context, max time.Duration) bool {
+	if max <= 0 {
+		return true
+	}
+	delay := rand.N(max + 1)
+	log.Printf("Startup jitter: waiting %s before AWS calls (max %s)", delay.Round(time.Millisecond), max)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
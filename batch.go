@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SesMaxRecipients is the SendRawEmail limit on destinations per call.
+const SesMaxRecipients = 50
+
+// Policies for -batch-failure-policy, applied when some batches of a
+// message fail while others were sent.
+const (
+	BatchFailureFail   = "fail"   // fail the message, a retry re-sends the sent batches
+	BatchFailureAccept = "accept" // send the other batches, accept and log the failed ones
+	BatchFailureSpool  = "spool"  // as accept, and retry the failed batches from memory
+)
+
+var (
+	batchSendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "smtpd",
+		Name:      "batch_send_duration_seconds",
+		Help:      "Total time taken by messages sent in more than one SES batch",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12), // 50ms to ~100s
+	})
+	batchResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "batches_total",
+		Help:      "Total number of SES batches of messages sent in more than one batch, by result: sent or failed",
+	}, []string{"result"})
+	partialSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "batch_partial_failure_total",
+		Help:      "Total number of failed batches of otherwise sent messages, by -batch-failure-policy action: failed (message failed), undelivered (accepted without them) or spooled",
+	}, []string{"action"})
+)
+
+// validateBatchFailurePolicy rejects unknown -batch-failure-policy values.
+func validateBatchFailurePolicy(policy string) error {
+	switch policy {
+	case BatchFailureFail, BatchFailureAccept, BatchFailureSpool:
+		return nil
+	}
+	return fmt.Errorf("unknown -batch-failure-policy %q (want %s, %s or %s)", policy, BatchFailureFail, BatchFailureAccept, BatchFailureSpool)
+}
+
+// batchingSender splits recipient lists larger than size into several
+// sends, pausing delay between them. All batches must finish within timeout.
+// Unless policy is fail, a failed batch does not stop the others.
+type batchingSender struct {
+	next    Sender
+	size    int
+	delay   time.Duration
+	timeout time.Duration
+	policy  string
+}
+
+// batchResult is the outcome of one batch.
+type batchResult struct {
+	recipients []string
+	messageID  string
+	err        error
+}
+
+// partialSendError is returned by batchingSender, unless its policy is
+// fail, when some batches of a message failed and others were sent.
+type partialSendError struct {
+	batches []batchResult
+}
+
+func (e *partialSendError) Error() string {
+	failed := 0
+	for _, b := range e.batches {
+		if b.err != nil {
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d batches failed: %v", failed, len(e.batches), e.Unwrap())
+}
+
+// Unwrap returns the error of the first failed batch.
+func (e *partialSendError) Unwrap() error {
+	for _, b := range e.batches {
+		if b.err != nil {
+			return b.err
+		}
+	}
+	return nil
+}
+
+// SendRaw implements Sender. The message IDs of all batches are returned
+// separated by spaces. Under the fail policy the first failed batch ends the
+// send, and the error names the recipients already sent to, since the
+// client will retry the whole message. Otherwise every batch is tried and,
+// if only some failed, a *partialSendError is returned.
+func (s *batchingSender) SendRaw(ctx context.Context, from string, to []string, data []byte, configSet string) (string, error) {
+	if len(to) <= s.size {
+		return s.next.SendRaw(ctx, from, to, data, configSet)
+	}
+
+	start := time.Now()
+	defer func() { batchSendDuration.Observe(time.Since(start).Seconds()) }()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	if s.policy != "" && s.policy != BatchFailureFail {
+		return s.sendAll(ctx, from, to, data, configSet)
+	}
+	var ids []string
+	for i := 0; i < len(to); i += s.size {
+		if i > 0 && s.delay > 0 {
+			select {
+			case <-time.After(s.delay):
+			case <-ctx.Done():
+				return "", batchError(ctx.Err(), to[:i])
+			}
+		}
+		batch := to[i:min(i+s.size, len(to))]
+		id, err := s.next.SendRaw(ctx, from, batch, data, configSet)
+		if err != nil {
+			batchResults.With(prometheus.Labels{"result": "failed"}).Inc()
+			if i > 0 {
+				partialSends.With(prometheus.Labels{"action": "failed"}).Inc()
+			}
+			return "", batchError(err, to[:i])
+		}
+		batchResults.With(prometheus.Labels{"result": "sent"}).Inc()
+		ids = append(ids, id)
+	}
+	return strings.Join(ids, " "), nil
+}
+
+// sendAll tries every batch, failing those left when ctx is done.
+func (s *batchingSender) sendAll(ctx context.Context, from string, to []string, data []byte, configSet string) (string, error) {
+	var results []batchResult
+	var ids []string
+	for i := 0; i < len(to); i += s.size {
+		if i > 0 && s.delay > 0 {
+			select {
+			case <-time.After(s.delay):
+			case <-ctx.Done():
+			}
+		}
+		r := batchResult{recipients: to[i:min(i+s.size, len(to))]}
+		if r.err = ctx.Err(); r.err == nil {
+			r.messageID, r.err = s.next.SendRaw(ctx, from, r.recipients, data, configSet)
+		}
+		if r.err != nil {
+			batchResults.With(prometheus.Labels{"result": "failed"}).Inc()
+		} else {
+			batchResults.With(prometheus.Labels{"result": "sent"}).Inc()
+			ids = append(ids, r.messageID)
+		}
+		results = append(results, r)
+	}
+	switch {
+	case len(ids) == len(results):
+		return strings.Join(ids, " "), nil
+	case len(ids) == 0:
+		// Nothing was sent: the client can retry the whole message.
+		return "", results[0].err
+	}
+	return strings.Join(ids, " "), &partialSendError{batches: results}
+}
+
+// batchError describes a failed batched send.
+func batchError(err error, sent []string) error {
+	if len(sent) == 0 {
+		return err
+	}
+	return fmt.Errorf("batch failed after sending to %d recipients %v: %w", len(sent), sent, err)
+}
+
+// acceptPartial accepts a partially sent message under the accept and
+// spool policies. Each failed batch is logged and, with spool and a
+// temporary error, queued for retry; the other recipients are undelivered.
+// It returns the message IDs and recipients of the sent batches.
+func (s *Session) acceptPartial(sender Sender, p *partialSendError) (string, []string) {
+	var ids, sent []string
+	for n, b := range p.batches {
+		if b.err == nil {
+			s.logf("batch %d/%d sent to %d recipients (message ID %s)", n+1, len(p.batches), len(b.recipients), b.messageID)
+			ids = append(ids, b.messageID)
+			sent = append(sent, b.recipients...)
+			continue
+		}
+		if sp := s.backend.batchSpool; sp != nil && sesSendError(b.err).Code < 500 {
+			if sp.add(s, sender, b.recipients) {
+				partialSends.With(prometheus.Labels{"action": "spooled"}).Inc()
+				s.logf("batch %d/%d failed, recipients %v spooled for retry: %v", n+1, len(p.batches), b.recipients, b.err)
+				continue
+			}
+			s.logf("batch spool full, not retrying batch %d/%d", n+1, len(p.batches))
+		}
+		partialSends.With(prometheus.Labels{"action": "undelivered"}).Inc()
+		s.logf("ERROR: batch %d/%d failed, recipients %v undelivered: %v", n+1, len(p.batches), b.recipients, b.err)
+	}
+	return strings.Join(ids, " "), sent
+}
+
+// asPartialSend returns err as a *partialSendError, or nil.
+func asPartialSend(err error) *partialSendError {
+	var p *partialSendError
+	if errors.As(err, &p) {
+		return p
+	}
+	return nil
+}
+
+// Retries of batches spooled by -batch-failure-policy spool.
+const (
+	batchSpoolAttempts = 5
+	batchSpoolBackoff  = time.Minute // doubled after each attempt
+	batchSpoolTimeout  = time.Minute // per attempt
+)
+
+var (
+	batchSpoolEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "batch_spool_entries",
+		Help:      "Number of failed batches held in memory for retry by -batch-failure-policy spool",
+	})
+	batchSpoolResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "batch_spool_total",
+		Help:      "Total number of spooled batches by outcome: sent, dropped (retries exhausted or permanent error) or shutdown",
+	}, []string{"result"})
+)
+
+// batchSpool retries failed batches in the background. Spooled batches are
+// held in memory only and are lost when the relay stops.
+type batchSpool struct {
+	slots chan struct{} // bounds the spooled batches
+	wg    sync.WaitGroup
+}
+
+func newBatchSpool(size int) *batchSpool {
+	return &batchSpool{slots: make(chan struct{}, size)}
+}
+
+// add spools the current message of s for recipients, to be retried
+// through sender. It reports false if the spool is full.
+func (sp *batchSpool) add(s *Session, sender Sender, recipients []string) bool {
+	select {
+	case sp.slots <- struct{}{}:
+	default:
+		return false
+	}
+	batchSpoolEntries.Inc()
+	sp.wg.Add(1)
+	from, data, configSet := s.envelopeFrom(), s.data, aws.ToString(s.configSet())
+	// The session moves on to the next message; log with this one's IDs.
+	base := s.backend.context()
+	ls := &Session{backend: s.backend, connID: s.connID, trackingID: s.trackingID, from: s.from, tenant: s.tenant}
+	go func() {
+		defer func() {
+			batchSpoolEntries.Dec()
+			<-sp.slots
+			sp.wg.Done()
+		}()
+		batchSpoolResults.With(prometheus.Labels{"result": sp.retry(base, ls, sender, from, recipients, data, configSet)}).Inc()
+	}()
+	return true
+}
+
+// wait waits, at shutdown, for the spooled batches to log that they are
+// undelivered.
+func (sp *batchSpool) wait() {
+	sp.wg.Wait()
+}
+
+// retry sends a spooled batch until it succeeds, fails permanently or runs
+// out of attempts, and returns the outcome.
+func (sp *batchSpool) retry(base context.Context, ls *Session, sender Sender, from string, to []string, data []byte, configSet string) string {
+	delay := batchSpoolBackoff
+	var err error
+	for attempt := 1; attempt <= batchSpoolAttempts; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-base.Done():
+			ls.logf("ERROR: shutting down, spooled batch to %v undelivered", to)
+			return "shutdown"
+		}
+		delay *= 2
+		ctx, cancel := context.WithTimeout(base, batchSpoolTimeout)
+		var messageID string
+		messageID, err = sender.SendRaw(ctx, from, to, data, configSet)
+		cancel()
+		if err == nil {
+			ls.logf("spooled batch sent to %d recipients on attempt %d (message ID %s)", len(to), attempt, messageID)
+			ls.logRecipients(to, messageID)
+			return "sent"
+		}
+		if sesSendError(err).Code >= 500 {
+			break
+		}
+		ls.logf("spooled batch to %d recipients failed on attempt %d of %d: %v", len(to), attempt, batchSpoolAttempts, err)
+	}
+	ls.logf("ERROR: giving up on spooled batch, recipients %v undelivered: %v", to, err)
+	return "dropped"
+}
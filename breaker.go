@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+var breakerStateGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "smtpd",
+	Name:      "ses_circuit_breaker_state",
+	Help:      "State of the SES circuit breaker (0 closed, 1 half-open, 2 open)",
+})
+
+// circuitBreaker fails SES sends fast after threshold consecutive failures
+// within window. After cooldown a single probe is let through (half-open);
+// its result closes or re-opens the breaker. A nil breaker always allows.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time // time.Now, replaced in tests
+
+	mu           sync.Mutex
+	state        breakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, window: window, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a send may be attempted now.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a send.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.probing = false
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	now := b.now()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		b.open(now)
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.open(now)
+	}
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.openedAt = now
+	b.failures = 0
+	b.setState(breakerOpen)
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	log.Printf("ses circuit breaker %s -> %s", b.state, s)
+	b.state = s
+	breakerStateGauge.Set(float64(s))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	errSES := errors.New("SES down")
+	type step struct {
+		advance time.Duration
+		// allow calls allow and expects want; otherwise the outcome err is
+		// recorded.
+		allow bool
+		want  bool
+		err   error
+		state breakerState // after the step
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"closed allows", []step{
+			{allow: true, want: true, state: breakerClosed},
+			{err: errSES, state: breakerClosed},
+			{allow: true, want: true, state: breakerClosed},
+		}},
+		{"opens at the threshold", []step{
+			{err: errSES, state: breakerClosed},
+			{advance: time.Second, err: errSES, state: breakerClosed},
+			{advance: time.Second, err: errSES, state: breakerOpen},
+			{allow: true, want: false, state: breakerOpen},
+		}},
+		{"success resets the count", []step{
+			{err: errSES, state: breakerClosed},
+			{err: errSES, state: breakerClosed},
+			{state: breakerClosed},
+			{err: errSES, state: breakerClosed},
+			{err: errSES, state: breakerClosed},
+			{allow: true, want: true, state: breakerClosed},
+		}},
+		{"window restarts the count", []step{
+			{err: errSES, state: breakerClosed},
+			{advance: 30 * time.Second, err: errSES, state: breakerClosed},
+			// The first failure is more than a window ago: this one starts
+			// a new count.
+			{advance: 31 * time.Second, err: errSES, state: breakerClosed},
+			{advance: 10 * time.Second, err: errSES, state: breakerClosed},
+			{advance: 10 * time.Second, err: errSES, state: breakerOpen},
+		}},
+		{"probe succeeds", []step{
+			{err: errSES}, {err: errSES}, {err: errSES, state: breakerOpen},
+			{advance: 59 * time.Second, allow: true, want: false, state: breakerOpen},
+			{advance: time.Second, allow: true, want: true, state: breakerHalfOpen},
+			// Only one probe at a time.
+			{allow: true, want: false, state: breakerHalfOpen},
+			{state: breakerClosed},
+			{allow: true, want: true, state: breakerClosed},
+		}},
+		{"probe fails", []step{
+			{err: errSES}, {err: errSES}, {err: errSES, state: breakerOpen},
+			{advance: time.Minute, allow: true, want: true, state: breakerHalfOpen},
+			{err: errSES, state: breakerOpen},
+			// The cooldown starts over.
+			{advance: 59 * time.Second, allow: true, want: false, state: breakerOpen},
+			{advance: time.Second, allow: true, want: true, state: breakerHalfOpen},
+		}},
+		{"reopened breaker needs a full count to open again", []step{
+			{err: errSES}, {err: errSES}, {err: errSES, state: breakerOpen},
+			{advance: time.Minute, allow: true, want: true, state: breakerHalfOpen},
+			{state: breakerClosed},
+			{err: errSES, state: breakerClosed},
+			{err: errSES, state: breakerClosed},
+			{err: errSES, state: breakerOpen},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+			b := newCircuitBreaker(3, time.Minute, time.Minute)
+			b.now = func() time.Time { return now }
+			for i, st := range tt.steps {
+				now = now.Add(st.advance)
+				if st.allow {
+					if got := b.allow(); got != st.want {
+						t.Fatalf("step %d: allow() = %t, want %t", i, got, st.want)
+					}
+				} else {
+					b.record(st.err)
+				}
+				if b.state != st.state {
+					t.Fatalf("step %d: state %s, want %s", i, b.state, st.state)
+				}
+			}
+		})
+	}
+
+	var none *circuitBreaker
+	if !none.allow() {
+		t.Error("nil breaker refused a send")
+	}
+	none.record(errSES)
+}
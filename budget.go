@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// byteBudget limits the message bytes sent per fixed window. A send is
+// allowed while some budget remains, so the last message of a window may
+// overshoot it; no message is refused only for being large. A nil budget
+// always allows.
+type byteBudget struct {
+	limit  int64
+	window time.Duration
+
+	mu    sync.Mutex
+	start time.Time
+	used  int64
+}
+
+func newByteBudget(limit int64, window time.Duration) *byteBudget {
+	b := &byteBudget{limit: limit, window: window, start: time.Now()}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "byte_budget_remaining_bytes",
+		Help:      "Message bytes that may still be sent in the current -byte-budget window",
+	}, func() float64 { return float64(b.remaining()) })
+	return b
+}
+
+// roll starts a new window once the current one has elapsed. b.mu must be
+// held.
+func (b *byteBudget) roll(now time.Time) {
+	if now.Sub(b.start) >= b.window {
+		b.start = now
+		b.used = 0
+	}
+}
+
+// take charges n bytes to the budget, returning false without charging if
+// the budget is exhausted.
+func (b *byteBudget) take(n int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+	if b.used >= b.limit {
+		return false
+	}
+	b.used += int64(n)
+	return true
+}
+
+// refund returns n bytes taken for a send that failed. If the window has
+// rolled since, the new window is credited, which errs on the side of
+// sending.
+func (b *byteBudget) refund(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used = max(b.used-int64(n), 0)
+}
+
+func (b *byteBudget) remaining() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+	return max(b.limit-b.used, 0)
+}
+
+// resetIn returns the time until the current window ends.
+func (b *byteBudget) resetIn() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Until(b.start.Add(b.window)).Round(time.Second)
+}
+
+// checkByteBudget charges the message to the byte budget, failing the
+// transaction when the budget is exhausted.
+func (s *Session) checkByteBudget() error {
+	if s.backend.byteBudget.take(len(s.data)) {
+		return nil
+	}
+	emailError.With(prometheus.Labels{"type": "byte budget exhausted", "tenant": s.tenant}).Inc()
+	s.logf("rejecting message from %s, byte budget exhausted for another %s", s.from, s.backend.byteBudget.resetIn())
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Sending volume limit reached. Please try again later",
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteBudget(t *testing.T) {
+	b := &byteBudget{limit: 100, window: time.Hour, start: time.Now()}
+	if !b.take(60) || !b.take(60) {
+		t.Fatal("sends under the budget refused")
+	}
+	// The last send of a window may overshoot it; nothing is left after.
+	if b.remaining() != 0 {
+		t.Errorf("remaining = %d after overshooting, want 0", b.remaining())
+	}
+	if b.take(1) {
+		t.Error("send allowed with the budget exhausted")
+	}
+	b.refund(60)
+	if got := b.remaining(); got != 40 {
+		t.Errorf("remaining = %d after a refund, want 40", got)
+	}
+	b.refund(1000)
+	if got := b.remaining(); got != 100 {
+		t.Errorf("remaining = %d after refunding more than used, want 100", got)
+	}
+
+	b.take(100)
+	b.start = time.Now().Add(-time.Hour) // the window is over
+	if !b.take(10) {
+		t.Error("send refused in a new window")
+	}
+	if got := b.remaining(); got != 90 {
+		t.Errorf("remaining = %d in the new window, want 90", got)
+	}
+
+	var none *byteBudget
+	if !none.take(1 << 30) {
+		t.Error("nil budget refused a send")
+	}
+	none.refund(1)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var messageCaptures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "capture_total",
+	Help:      "Total number of sampled messages for -capture-dir by result: written, dropped (queue full) or error",
+}, []string{"result"})
+
+// captureQueueSize bounds the captures waiting to be written. Further
+// samples are dropped rather than slowing down sends.
+const captureQueueSize = 64
+
+// captureMeta is written next to each captured message.
+type captureMeta struct {
+	Time       time.Time `json:"time"`
+	RelayID    string    `json:"relay_id"`
+	Conn       string    `json:"conn"`
+	Tenant     string    `json:"tenant"`
+	User       string    `json:"user,omitempty"`
+	From       string    `json:"from"`
+	Recipients []string  `json:"recipients"`
+	ConfigSet  string    `json:"configuration_set,omitempty"`
+	MessageID  string    `json:"message_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Size       int       `json:"size"`
+	Truncated  bool      `json:"truncated,omitempty"`
+}
+
+type capture struct {
+	meta captureMeta
+	data []byte
+}
+
+// messageCapture writes a random sample of the relayed messages to a
+// directory, as NAME.eml with the raw message and NAME.json with its
+// metadata. Files are written by a single goroutine, and the directory is
+// pruned to maxFiles messages not older than maxAge.
+type messageCapture struct {
+	dir      string
+	rate     float64
+	maxBytes int
+	maxFiles int
+	maxAge   time.Duration
+
+	queue chan capture
+}
+
+func newMessageCapture(dir string, rate float64, maxBytes, maxFiles int, maxAge time.Duration) (*messageCapture, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &messageCapture{dir: dir, rate: rate, maxBytes: maxBytes, maxFiles: maxFiles, maxAge: maxAge, queue: make(chan capture, captureQueueSize)}
+	c.prune()
+	go c.run()
+	return c, nil
+}
+
+func (c *messageCapture) run() {
+	for m := range c.queue {
+		if err := c.write(m); err != nil {
+			messageCaptures.With(prometheus.Labels{"result": "error"}).Inc()
+			log.Printf("capture: writing %s failed: %v", m.meta.RelayID, err)
+			continue
+		}
+		messageCaptures.With(prometheus.Labels{"result": "written"}).Inc()
+		c.prune()
+	}
+}
+
+func (c *messageCapture) write(m capture) error {
+	// The relay ID may come from the client, so it is not part of the name.
+	name := filepath.Join(c.dir, m.meta.Time.Format("20060102T150405.000Z")+"-"+newUUID())
+	meta, err := json.MarshalIndent(m.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(name+".eml", m.data, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(name+".json", meta, 0o600)
+}
+
+// prune removes the captures older than maxAge and the oldest beyond
+// maxFiles. Names start with the capture time, so they sort by age.
+func (c *messageCapture) prune() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Printf("capture: reading %s failed: %v", c.dir, err)
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".eml"); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	cutoff := time.Now().Add(-c.maxAge)
+	for i, name := range names {
+		info, err := os.Stat(filepath.Join(c.dir, name+".eml"))
+		if err == nil && len(names)-i <= c.maxFiles && info.ModTime().After(cutoff) {
+			continue
+		}
+		os.Remove(filepath.Join(c.dir, name+".eml"))
+		os.Remove(filepath.Join(c.dir, name+".json"))
+	}
+}
+
+// captureMessage samples the message just relayed, with the result of the
+// send. It never blocks.
+func (s *Session) captureMessage(recipients []string, messageID string, sendErr error) {
+	c := s.backend.capture
+	if c == nil || rand.Float64() >= c.rate {
+		return
+	}
+	m := capture{
+		meta: captureMeta{
+			Time:       time.Now().UTC(),
+			RelayID:    s.trackingID,
+			Conn:       s.connID,
+			Tenant:     s.tenant,
+			User:       s.user,
+			From:       s.from,
+			Recipients: append([]string(nil), recipients...),
+			ConfigSet:  aws.ToString(s.configSet()),
+			MessageID:  messageID,
+			Size:       len(s.data),
+		},
+		data: s.data,
+	}
+	if sendErr != nil {
+		m.meta.Error = sendErr.Error()
+	}
+	if len(m.data) > c.maxBytes {
+		m.data, m.meta.Truncated = m.data[:c.maxBytes], true
+	}
+	select {
+	case c.queue <- m:
+	default:
+		messageCaptures.With(prometheus.Labels{"result": "dropped"}).Inc()
+	}
+}
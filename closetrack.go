@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var connectionClose = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "connection_close_total",
+	Help:      "Total number of closed SMTP sessions by how they ended",
+}, []string{"reason"})
+
+var connectionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "smtpd",
+	Name:      "connection_duration_seconds",
+	Help:      "Time from the first session of a connection to its logout",
+	Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16), // 100ms to ~55m
+})
+
+// closeTrackListener wraps accepted connections so that the session can
+// tell a clean QUIT from a client dropping the socket.
+type closeTrackListener struct {
+	net.Listener
+}
+
+// Accept implements net.Listener
+func (l *closeTrackListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &closeTrackConn{Conn: c, id: newConnID()}, nil
+}
+
+// closeTrackConn remembers the first read error of the connection. It also
+// carries the connection ID, which thereby survives the session restart
+// caused by STARTTLS.
+type closeTrackConn struct {
+	net.Conn
+	id       string
+	sessions int // only used from the connection's goroutine
+	// opened is when the first session started, across STARTTLS.
+	opened time.Time
+
+	// readTimeout, when set, pushes the read deadline back before every
+	// read (a time.Duration).
+	readTimeout atomic.Int64
+
+	mu      sync.Mutex
+	readErr error
+	dropped bool
+	closed  bool
+	closeFn []func()
+}
+
+// errDropped ends the reads of a connection the relay decided to drop.
+var errDropped = errors.New("connection dropped by relay")
+
+// drop makes further reads fail, so that go-smtp closes the connection
+// once the pending reply has been written.
+func (c *closeTrackConn) drop() {
+	c.mu.Lock()
+	c.dropped = true
+	c.mu.Unlock()
+}
+
+// onClose registers fn to run once when the connection is closed.
+func (c *closeTrackConn) onClose(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		fn()
+		return
+	}
+	c.closeFn = append(c.closeFn, fn)
+}
+
+// Close implements net.Conn
+func (c *closeTrackConn) Close() error {
+	c.mu.Lock()
+	fns := c.closeFn
+	c.closeFn, c.closed = nil, true
+	c.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+	return c.Conn.Close()
+}
+
+// extendReads makes every read move the read deadline timeout into the
+// future, so that the connection only times out after that long without
+// data. 0 stops it.
+func (c *closeTrackConn) extendReads(timeout time.Duration) {
+	c.readTimeout.Store(int64(timeout))
+}
+
+// trackedConn returns the closeTrackConn underlying conn, or nil.
+func trackedConn(conn net.Conn) *closeTrackConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	ct, _ := conn.(*closeTrackConn)
+	return ct
+}
+
+// Read implements net.Conn
+func (c *closeTrackConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.dropped {
+		if c.readErr == nil {
+			c.readErr = errDropped
+		}
+		c.mu.Unlock()
+		return 0, io.EOF
+	}
+	c.mu.Unlock()
+
+	if d := time.Duration(c.readTimeout.Load()); d > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(d)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.mu.Lock()
+		if c.readErr == nil {
+			c.readErr = err
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// closeReason classifies how the session on conn ended. go-smtp logs the
+// session out on QUIT before any read has failed, while a dropped socket,
+// an idle timeout or a server shutdown end the session with a read error.
+func closeReason(conn net.Conn) string {
+	ct := trackedConn(conn)
+	if ct == nil {
+		return "unknown"
+	}
+	ct.mu.Lock()
+	err := ct.readErr
+	ct.mu.Unlock()
+
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return "quit"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, net.ErrClosed), err == errDropped:
+		return "server"
+	}
+	return "abrupt"
+}
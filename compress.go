@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// maybeDecompress returns a reader yielding the decompressed message if the
+// DATA stream starts with the gzip magic bytes. An RFC 5322 message cannot
+// start with those bytes, so plain messages pass through untouched. The
+// caller must still bound the returned reader.
+func maybeDecompress(r io.Reader) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br, false, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, true, err
+	}
+	gz.Multistream(false)
+	return gz, true, nil
+}
+
+// isCorruptCompression reports whether err stems from invalid gzip data
+// rather than from the underlying connection.
+func isCorruptCompression(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, &corrupt)
+}
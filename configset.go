@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+// configurationSetAttributes are fetched when validating the configuration
+// set so that the tracking applied to every message can be logged.
+var configurationSetAttributes = []types.ConfigurationSetAttribute{
+	types.ConfigurationSetAttributeEventDestinations,
+	types.ConfigurationSetAttributeTrackingOptions,
+	types.ConfigurationSetAttributeDeliveryOptions,
+	types.ConfigurationSetAttributeReputationOptions,
+}
+
+// logConfigurationSet logs the settings of the configuration set that every
+// message is sent with.
+func logConfigurationSet(name string, out *ses.DescribeConfigurationSetOutput) {
+	if len(out.EventDestinations) == 0 {
+		log.Printf("Configuration set '%s': no event destinations, bounces and complaints use identity notifications", name)
+	}
+	for _, d := range out.EventDestinations {
+		state := "enabled"
+		if !d.Enabled {
+			state = "disabled"
+		}
+		events := make([]string, 0, len(d.MatchingEventTypes))
+		for _, e := range d.MatchingEventTypes {
+			events = append(events, string(e))
+		}
+		log.Printf("Configuration set '%s': event destination %s (%s) -> %s for [%s]",
+			name, aws.ToString(d.Name), state, eventDestinationTarget(d), strings.Join(events, ", "))
+	}
+
+	if t := out.TrackingOptions; t != nil && t.CustomRedirectDomain != nil {
+		log.Printf("Configuration set '%s': open/click tracking domain %s", name, *t.CustomRedirectDomain)
+	}
+	if d := out.DeliveryOptions; d != nil && d.TlsPolicy != "" {
+		log.Printf("Configuration set '%s': TLS policy %s", name, d.TlsPolicy)
+	}
+	if r := out.ReputationOptions; r != nil {
+		log.Printf("Configuration set '%s': sending enabled: %t, reputation metrics: %t", name, r.SendingEnabled, r.ReputationMetricsEnabled)
+	}
+}
+
+// eventDestinationTarget describes where an event destination publishes to.
+func eventDestinationTarget(d types.EventDestination) string {
+	switch {
+	case d.SNSDestination != nil:
+		return "SNS " + aws.ToString(d.SNSDestination.TopicARN)
+	case d.KinesisFirehoseDestination != nil:
+		return "Firehose " + aws.ToString(d.KinesisFirehoseDestination.DeliveryStreamARN)
+	case d.CloudWatchDestination != nil:
+		return fmt.Sprintf("CloudWatch (%d dimensions)", len(d.CloudWatchDestination.DimensionConfigurations))
+	}
+	return "unknown destination"
+}
+
+// loadUserConfigSets reads "username configuration-set" pairs, one per line.
+// Blank lines and lines starting with # are ignored.
+func loadUserConfigSets(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sets := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"username configuration-set\"", path, n)
+		}
+		sets[strings.ToLower(fields[0])] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sets, nil
+}
+
+// configSet returns the configuration set for the session's messages: the
+// authenticated user's own set if one is mapped, otherwise the global one.
+func (s *Session) configSet() *string {
+	if s.user != "" {
+		if name, ok := s.backend.userConfigSets[strings.ToLower(s.user)]; ok {
+			return &name
+		}
+	}
+	return s.backend.configSetName.Load()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var connectionsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "connection_rejected_total",
+	Help:      "Total number of connections refused a session, by reason",
+}, []string{"reason"})
+
+// ipConnLimiter caps the concurrent connections of each client IP.
+type ipConnLimiter struct {
+	max int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newIPConnLimiter(max int) *ipConnLimiter {
+	return &ipConnLimiter{max: max, active: make(map[string]int)}
+}
+
+// acquire takes a slot for ip, returning false if it has max already.
+func (l *ipConnLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] >= l.max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+// release frees a slot taken by acquire.
+func (l *ipConnLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] <= 1 {
+		delete(l.active, ip)
+		return
+	}
+	l.active[ip]--
+}
+
+// limitConnection enforces -max-connections-per-ip when the first session
+// of ct starts. The slot is held until the connection closes, across the
+// session restart of STARTTLS. An excess connection gets 421 and is closed
+// after the reply.
+func (s *Session) limitConnection(ct *closeTrackConn) error {
+	l := s.backend.ipLimiter
+	if l == nil {
+		return nil
+	}
+	addr := ct.RemoteAddr().String()
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+	if !l.acquire(ip) {
+		connectionsRejected.With(prometheus.Labels{"reason": "per_ip_limit"}).Inc()
+		s.logf("refusing connection from %s: %d connections from this address already open", addr, l.max)
+		ct.drop()
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many connections from your address, please try again later",
+		}
+	}
+	ct.onClose(func() { l.release(ip) })
+	return nil
+}
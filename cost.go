@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SES list prices in US dollars, the -ses-cost-per-1000 and
+// -ses-cost-per-gb defaults.
+const (
+	DefaultSESCostPer1000 = 0.10
+	DefaultSESCostPerGB   = 0.12
+)
+
+var sesEstimatedCost = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "ses_estimated_cost_total",
+	Help:      "Estimated SES charges of sent messages, in the currency of -ses-cost-per-1000 and -ses-cost-per-gb, by tenant and configuration set",
+}, []string{"tenant", "configuration_set"})
+
+// sesCostRates estimates what SES charges for a message.
+type sesCostRates struct {
+	per1000 float64 // per 1000 recipients
+	perGB   float64 // per GB of data, counted for each recipient
+}
+
+// estimate returns the cost of sending size bytes to recipients. SES bills
+// every recipient as a message and charges for attachment data; the whole
+// size is counted, so messages with small attachments are overestimated.
+func (r sesCostRates) estimate(recipients, size int) float64 {
+	n := float64(recipients)
+	return n*r.per1000/1000 + n*float64(size)*r.perGB/1e9
+}
+
+// recordCost adds the estimated cost of the message just sent to
+// recipients. Both labels come from the relay's configuration, never from
+// clients, so their number stays bounded.
+func (s *Session) recordCost(recipients []string) {
+	r := s.backend.costRates
+	if r.per1000 == 0 && r.perGB == 0 {
+		return
+	}
+	sesEstimatedCost.With(prometheus.Labels{
+		"tenant":            s.tenant,
+		"configuration_set": aws.ToString(s.configSet()),
+	}).Add(r.estimate(len(recipients), len(s.data)))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Modes for -date-check.
+const (
+	DateCheckOff    = "off"
+	DateCheckMetric = "metric"
+	DateCheckReject = "reject"
+)
+
+// Policies for -date-invalid-policy.
+const (
+	DatePolicyAccept = "accept"
+	DatePolicyReject = "reject"
+)
+
+var (
+	dateSkew = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "smtpd",
+		Name:      "message_date_skew_seconds",
+		Help:      "Difference between the message Date header and the server clock",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 12),
+	}, []string{"direction"})
+	dateInvalid = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "message_date_invalid_total",
+		Help:      "Total number of messages with a missing or unparseable Date header",
+	}, []string{"reason"})
+)
+
+// dateCheck compares the Date header of each message with the server clock.
+type dateCheck struct {
+	mode          string
+	maxPast       time.Duration
+	maxFuture     time.Duration
+	invalidPolicy string
+}
+
+// validate rejects unknown modes and policies.
+func (c dateCheck) validate() error {
+	switch c.mode {
+	case DateCheckOff, DateCheckMetric, DateCheckReject:
+	default:
+		return fmt.Errorf("unknown -date-check mode %q (want %s, %s or %s)", c.mode, DateCheckOff, DateCheckMetric, DateCheckReject)
+	}
+	switch c.invalidPolicy {
+	case DatePolicyAccept, DatePolicyReject:
+	default:
+		return fmt.Errorf("unknown -date-invalid-policy %q (want %s or %s)", c.invalidPolicy, DatePolicyAccept, DatePolicyReject)
+	}
+	if c.maxPast < 0 || c.maxFuture < 0 {
+		return fmt.Errorf("-date-max-past and -date-max-future must not be negative")
+	}
+	return nil
+}
+
+// checkDate records the skew of the message Date header and, in reject
+// mode, refuses messages outside the configured bounds.
+func (s *Session) checkDate(data []byte) error {
+	c := s.backend.dateCheck
+	if c.mode == "" || c.mode == DateCheckOff {
+		return nil
+	}
+
+	fields, _ := splitHeader(data)
+	value, ok := getHeader(fields, "Date")
+	if !ok {
+		return s.invalidDate("missing", "missing Date header")
+	}
+	date, err := mail.ParseDate(value)
+	if err != nil {
+		return s.invalidDate("unparseable", fmt.Sprintf("unparseable Date header %q", value))
+	}
+
+	skew := time.Since(date)
+	direction := "past"
+	if skew < 0 {
+		direction = "future"
+	}
+	dateSkew.With(prometheus.Labels{"direction": direction}).Observe(skew.Abs().Seconds())
+
+	if c.mode != DateCheckReject {
+		return nil
+	}
+	if (c.maxPast > 0 && skew > c.maxPast) || (c.maxFuture > 0 && -skew > c.maxFuture) {
+		emailError.With(prometheus.Labels{"type": "date skew", "tenant": s.tenant}).Inc()
+		s.logf("message from %s has Date %s, %s in the %s", s.from, value, skew.Abs().Round(time.Second), direction)
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      fmt.Sprintf("Error: message Date is too far in the %s", direction),
+		}
+	}
+	return nil
+}
+
+// invalidDate applies -date-invalid-policy to a message whose Date header
+// is missing or cannot be parsed.
+func (s *Session) invalidDate(reason, detail string) error {
+	dateInvalid.With(prometheus.Labels{"reason": reason}).Inc()
+	if s.backend.dateCheck.invalidPolicy != DatePolicyReject {
+		return nil
+	}
+	emailError.With(prometheus.Labels{"type": "invalid date", "tenant": s.tenant}).Inc()
+	s.logf("rejecting message from %s: %s", s.from, detail)
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Error: " + reason + " Date header",
+	}
+}
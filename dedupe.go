@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var duplicateRecipients = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "duplicate_recipients_total",
+	Help:      "Total number of duplicate recipients dropped by -dedupe-recipients",
+})
+
+// dedupeRecipients drops the repeated recipients of a message when
+// -dedupe-recipients is set, keeping the first occurrence of each. Domains
+// compare case-insensitively, local parts exactly.
+func (s *Session) dedupeRecipients(recipients []string) []string {
+	if !s.backend.dedupeRecipients {
+		return recipients
+	}
+	var unique []string
+	seen := make(map[string]bool, len(recipients))
+	for _, rcpt := range recipients {
+		local, domain := splitAddress(rcpt)
+		if key := local + "@" + domain; !seen[key] {
+			seen[key] = true
+			unique = append(unique, rcpt)
+		}
+	}
+	if dropped := len(recipients) - len(unique); dropped > 0 {
+		duplicateRecipients.Add(float64(dropped))
+		s.logf("dropped %d duplicate recipients from message from %s", dropped, s.from)
+	}
+	return unique
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDedupeRecipients(t *testing.T) {
+	tests := []struct {
+		in, want    string
+		wantDropped float64
+	}{
+		{"a@x.com,b@x.com", "a@x.com,b@x.com", 0},
+		{"a@x.com,a@X.COM,b@x.com,a@x.com", "a@x.com,b@x.com", 2},
+		{"A@x.com,a@x.com", "A@x.com,a@x.com", 0},
+	}
+	for _, tt := range tests {
+		s := &Session{backend: &Backend{dedupeRecipients: true}}
+		before := testutil.ToFloat64(duplicateRecipients)
+		got := strings.Join(s.dedupeRecipients(strings.Split(tt.in, ",")), ",")
+		if got != tt.want {
+			t.Errorf("dedupeRecipients(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+		if d := testutil.ToFloat64(duplicateRecipients) - before; d != tt.wantDropped {
+			t.Errorf("dedupeRecipients(%s) counted %v duplicates, want %v", tt.in, d, tt.wantDropped)
+		}
+	}
+
+	s := &Session{backend: &Backend{}}
+	if got := strings.Join(s.dedupeRecipients([]string{"a@x.com", "a@x.com"}), ","); got != "a@x.com,a@x.com" {
+		t.Errorf("without -dedupe-recipients got %s, want both kept", got)
+	}
+}
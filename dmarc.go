@@ -0,0 +1,307 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Modes for -dmarc-check.
+const (
+	DMARCCheckOff    = "off"
+	DMARCCheckReport = "report" // log and count, never reject
+)
+
+// Results of the -dmarc-check evaluation.
+const (
+	alignPass       = "pass"
+	alignFail       = "fail"
+	alignUnknown    = "unknown"    // SES lookup failed
+	alignUnverified = "unverified" // only an unverified DKIM-Signature aligns
+)
+
+// dmarcIdentityTTL is how long the SES DKIM and MAIL FROM settings of a
+// domain are cached.
+const dmarcIdentityTTL = 10 * time.Minute
+
+// dmarcFailureTTL is how long a failed lookup is cached, so that a domain SES
+// cannot answer for is not looked up again for every message.
+const dmarcFailureTTL = time.Minute
+
+// dmarcCacheSize bounds the domains cached; the least recently used one is
+// evicted first. The From domain is chosen by the client.
+const dmarcCacheSize = 10000
+
+// dmarcQueueSize bounds the messages waiting to be evaluated; further ones
+// are skipped rather than holding up DATA.
+const dmarcQueueSize = 1000
+
+var dmarcResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "dmarc_alignment_total",
+	Help:      "Total number of messages evaluated by -dmarc-check, by dkim, spf and dmarc result: pass, fail, unknown or unverified",
+}, []string{"dkim", "spf", "dmarc"})
+
+var dmarcSkipped = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "dmarc_skipped_total",
+	Help:      "Total number of messages not evaluated by -dmarc-check because its queue was full",
+})
+
+// validateDMARCMode rejects unknown -dmarc-check modes.
+func validateDMARCMode(mode string) error {
+	switch mode {
+	case DMARCCheckOff, DMARCCheckReport:
+		return nil
+	}
+	return fmt.Errorf("unknown -dmarc-check mode %q (want %s or %s)", mode, DMARCCheckOff, DMARCCheckReport)
+}
+
+// dmarcClient is the part of the SES client used by dmarcChecker.
+type dmarcClient interface {
+	GetIdentityDkimAttributes(context.Context, *ses.GetIdentityDkimAttributesInput, ...func(*ses.Options)) (*ses.GetIdentityDkimAttributesOutput, error)
+	GetIdentityMailFromDomainAttributes(context.Context, *ses.GetIdentityMailFromDomainAttributesInput, ...func(*ses.Options)) (*ses.GetIdentityMailFromDomainAttributesOutput, error)
+}
+
+// dmarcChecker looks up how SES would authenticate mail from a domain:
+// whether Easy DKIM signs it and which custom MAIL FROM domain, if any,
+// becomes the SPF-checked envelope sender. Messages are evaluated in the
+// background by run, one at a time, so the cache is only used from there.
+type dmarcChecker struct {
+	client dmarcClient
+	jobs   chan dmarcJob
+
+	cache map[string]*list.Element // of *dmarcEntry, by domain
+	lru   *list.List               // most recently used first
+}
+
+type dmarcIdentity struct {
+	dkim     bool   // Easy DKIM enabled and verified
+	mailFrom string // custom MAIL FROM domain in use, "" for amazonses.com
+}
+
+// dmarcEntry is the cached result of looking up domain, successful or not.
+type dmarcEntry struct {
+	domain  string
+	id      dmarcIdentity
+	err     error
+	expires time.Time
+}
+
+// dmarcJob is a message waiting to be evaluated, reduced to what the
+// evaluation needs.
+type dmarcJob struct {
+	conn, relayID string   // for the log prefix
+	fromDomain    string   // domain of the From header address
+	envDomain     string   // domain of the envelope sender given to SES
+	sigDomains    []string // d= domains of the DKIM-Signature fields
+}
+
+func newDMARCChecker(client dmarcClient) *dmarcChecker {
+	return &dmarcChecker{
+		client: client,
+		jobs:   make(chan dmarcJob, dmarcQueueSize),
+		cache:  make(map[string]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// run evaluates the queued messages until ctx is done.
+func (c *dmarcChecker) run(ctx context.Context) {
+	for {
+		select {
+		case j := <-c.jobs:
+			c.evaluate(ctx, j)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// identity returns the SES settings of domain, or the error looking them up.
+func (c *dmarcChecker) identity(ctx context.Context, domain string) (dmarcIdentity, error) {
+	now := time.Now()
+	if el, ok := c.cache[domain]; ok {
+		e := el.Value.(*dmarcEntry)
+		if now.Before(e.expires) {
+			c.lru.MoveToFront(el)
+			return e.id, e.err
+		}
+		c.lru.Remove(el)
+		delete(c.cache, domain)
+	}
+
+	e := &dmarcEntry{domain: domain}
+	e.id, e.err = c.lookup(ctx, domain)
+	if e.err != nil {
+		e.expires = now.Add(dmarcFailureTTL)
+	} else {
+		e.expires = now.Add(dmarcIdentityTTL)
+	}
+	c.cache[domain] = c.lru.PushFront(e)
+	if c.lru.Len() > dmarcCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.cache, oldest.Value.(*dmarcEntry).domain)
+	}
+	return e.id, e.err
+}
+
+// lookup asks SES for the settings of domain.
+func (c *dmarcChecker) lookup(ctx context.Context, domain string) (dmarcIdentity, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	dkim, err := c.client.GetIdentityDkimAttributes(ctx, &ses.GetIdentityDkimAttributesInput{Identities: []string{domain}})
+	if err != nil {
+		return dmarcIdentity{}, err
+	}
+	mailFrom, err := c.client.GetIdentityMailFromDomainAttributes(ctx, &ses.GetIdentityMailFromDomainAttributesInput{Identities: []string{domain}})
+	if err != nil {
+		return dmarcIdentity{}, err
+	}
+	var id dmarcIdentity
+	if a, ok := dkim.DkimAttributes[domain]; ok {
+		id.dkim = a.DkimEnabled && a.DkimVerificationStatus == types.VerificationStatusSuccess
+	}
+	if a, ok := mailFrom.MailFromDomainAttributes[domain]; ok && a.MailFromDomainStatus == types.CustomMailFromStatusSuccess {
+		id.mailFrom = strings.ToLower(aws.ToString(a.MailFromDomain))
+	}
+	return id, nil
+}
+
+// signatureDomains returns the d= domains of the message's DKIM-Signature
+// fields. Signatures are not verified, that takes the signer's DNS record,
+// so an aligned one only makes DKIM unverified.
+func signatureDomains(fields []headerField) []string {
+	var domains []string
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+		for _, tag := range strings.Split(f.value(), ";") {
+			name, value, _ := strings.Cut(tag, "=")
+			if strings.TrimSpace(name) == "d" {
+				domains = append(domains, strings.ToLower(strings.Join(strings.Fields(value), "")))
+			}
+		}
+	}
+	return domains
+}
+
+// organizationalDomain returns the DMARC organizational domain of name: the
+// public suffix plus one label. A public suffix itself, or a name that
+// cannot be split, is returned unchanged.
+func organizationalDomain(name string) string {
+	if d, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		return d
+	}
+	return name
+}
+
+// domainsAligned reports relaxed DMARC alignment: a and b share their
+// organizational domain.
+func domainsAligned(a, b string) bool {
+	return a == b || organizationalDomain(a) == organizationalDomain(b)
+}
+
+// reportDMARC queues the message for the -dmarc-check evaluation of
+// whether it would pass DKIM and SPF aligned with its From domain once sent
+// by SES. The SES lookups run in the background; the message is never
+// rejected.
+func (s *Session) reportDMARC() {
+	c := s.backend.dmarc
+	if c == nil {
+		return
+	}
+	fromAddr := headerFromAddress(s.data)
+	if fromAddr == "" {
+		s.logf("DMARC report: no single From address, cannot evaluate")
+		return
+	}
+	_, fromDomain := splitAddress(fromAddr)
+	_, envDomain := splitAddress(s.envelopeFrom())
+	if envDomain == "" {
+		envDomain = fromDomain
+	}
+	fields, _ := splitHeader(s.data)
+	j := dmarcJob{
+		conn:       s.connID,
+		relayID:    s.trackingID,
+		fromDomain: fromDomain,
+		envDomain:  envDomain,
+		sigDomains: signatureDomains(fields),
+	}
+	select {
+	case c.jobs <- j:
+	default:
+		dmarcSkipped.Inc()
+		s.logf("DMARC report: queue full, not evaluated")
+	}
+}
+
+// evaluate logs and counts the DMARC result of j.
+func (c *dmarcChecker) evaluate(ctx context.Context, j dmarcJob) {
+	dkim, spf := alignFail, alignFail
+	for _, d := range j.sigDomains {
+		if domainsAligned(d, j.fromDomain) {
+			dkim = alignUnverified
+		}
+	}
+	var notes []string
+	fromID, fromErr := c.identity(ctx, j.fromDomain)
+	if fromErr != nil {
+		notes = append(notes, fmt.Sprintf("SES lookup of %s failed: %v", j.fromDomain, fromErr))
+		if dkim != alignUnverified {
+			dkim = alignUnknown
+		}
+	} else if fromID.dkim {
+		dkim = alignPass
+	}
+
+	// SES sends from the custom MAIL FROM domain of the Source identity, or
+	// from amazonses.com, which never aligns.
+	envID, envErr := fromID, fromErr
+	if j.envDomain != j.fromDomain {
+		if envID, envErr = c.identity(ctx, j.envDomain); envErr != nil {
+			notes = append(notes, fmt.Sprintf("SES lookup of %s failed: %v", j.envDomain, envErr))
+		}
+	}
+	if envErr != nil {
+		spf = alignUnknown
+	} else if envID.mailFrom != "" && domainsAligned(envID.mailFrom, j.fromDomain) {
+		spf = alignPass
+	}
+
+	dmarc := alignFail
+	switch {
+	case dkim == alignPass || spf == alignPass:
+		dmarc = alignPass
+	case dkim == alignUnknown || spf == alignUnknown:
+		dmarc = alignUnknown
+	case dkim == alignUnverified:
+		dmarc = alignUnverified
+	}
+	dmarcResults.With(prometheus.Labels{"dkim": dkim, "spf": spf, "dmarc": dmarc}).Inc()
+	note := ""
+	if len(notes) > 0 {
+		note = " (" + strings.Join(notes, "; ") + ")"
+	}
+	prefix := ""
+	if j.conn != "" {
+		prefix += "conn=" + j.conn + " "
+	}
+	if j.relayID != "" {
+		prefix += "relay_id=" + j.relayID + " "
+	}
+	log.Printf("%sDMARC report: from_domain=%s envelope_domain=%s dkim=%s spf=%s dmarc=%s%s", prefix, j.fromDomain, j.envDomain, dkim, spf, dmarc, note)
+}
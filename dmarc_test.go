@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeDMARCClient answers the SES identity lookups from dkim and mailFrom,
+// or with err, and counts the lookups by domain.
+type fakeDMARCClient struct {
+	dkim     map[string]bool
+	mailFrom map[string]string
+	err      error
+
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func (f *fakeDMARCClient) GetIdentityDkimAttributes(ctx context.Context, in *ses.GetIdentityDkimAttributesInput, _ ...func(*ses.Options)) (*ses.GetIdentityDkimAttributesOutput, error) {
+	domain := in.Identities[0]
+	f.mu.Lock()
+	if f.lookups == nil {
+		f.lookups = make(map[string]int)
+	}
+	f.lookups[domain]++
+	f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	out := &ses.GetIdentityDkimAttributesOutput{DkimAttributes: map[string]types.IdentityDkimAttributes{}}
+	if f.dkim[domain] {
+		out.DkimAttributes[domain] = types.IdentityDkimAttributes{DkimEnabled: true, DkimVerificationStatus: types.VerificationStatusSuccess}
+	}
+	return out, nil
+}
+
+func (f *fakeDMARCClient) GetIdentityMailFromDomainAttributes(ctx context.Context, in *ses.GetIdentityMailFromDomainAttributesInput, _ ...func(*ses.Options)) (*ses.GetIdentityMailFromDomainAttributesOutput, error) {
+	domain := in.Identities[0]
+	out := &ses.GetIdentityMailFromDomainAttributesOutput{MailFromDomainAttributes: map[string]types.IdentityMailFromDomainAttributes{}}
+	if m, ok := f.mailFrom[domain]; ok {
+		out.MailFromDomainAttributes[domain] = types.IdentityMailFromDomainAttributes{MailFromDomain: aws.String(m), MailFromDomainStatus: types.CustomMailFromStatusSuccess}
+	}
+	return out, nil
+}
+
+func (f *fakeDMARCClient) count(domain string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookups[domain]
+}
+
+func TestDMARCIdentityCache(t *testing.T) {
+	f := &fakeDMARCClient{dkim: map[string]bool{"example.com": true}}
+	c := newDMARCChecker(f)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		id, err := c.identity(ctx, "example.com")
+		if err != nil || !id.dkim {
+			t.Fatalf("identity(example.com) = %+v, %v, want DKIM enabled", id, err)
+		}
+	}
+	if n := f.count("example.com"); n != 1 {
+		t.Errorf("example.com looked up %d times, want 1", n)
+	}
+
+	// Failures are cached too.
+	f.err = errors.New("throttled")
+	for i := 0; i < 3; i++ {
+		if _, err := c.identity(ctx, "fail.example"); err == nil {
+			t.Fatal("identity(fail.example) succeeded, want the lookup error")
+		}
+	}
+	if n := f.count("fail.example"); n != 1 {
+		t.Errorf("fail.example looked up %d times, want 1", n)
+	}
+	f.err = nil
+
+	// Filling the cache evicts the least recently used domain.
+	c.identity(ctx, "example.com")
+	for i := 0; c.lru.Len() < dmarcCacheSize; i++ {
+		c.identity(ctx, fmt.Sprintf("d%d.example", i))
+	}
+	c.identity(ctx, "example.com")
+	c.identity(ctx, "one-more.example")
+	if c.lru.Len() != dmarcCacheSize || len(c.cache) != dmarcCacheSize {
+		t.Errorf("cache holds %d domains (%d in map), want %d", c.lru.Len(), len(c.cache), dmarcCacheSize)
+	}
+	if _, ok := c.cache["fail.example"]; ok {
+		t.Error("least recently used fail.example still cached")
+	}
+	if _, ok := c.cache["example.com"]; !ok {
+		t.Error("recently used example.com evicted")
+	}
+}
+
+func TestReportDMARC(t *testing.T) {
+	f := &fakeDMARCClient{mailFrom: map[string]string{"example.com": "bounce.example.com"}}
+	b := newTestBackend(t, &fakeSender{})
+	b.dmarc = newDMARCChecker(f)
+	s := newTestSession(t, b, testMessage)
+
+	s.reportDMARC()
+	if f.count("example.com") != 0 {
+		t.Fatal("SES looked up during DATA")
+	}
+	if len(b.dmarc.jobs) != 1 {
+		t.Fatalf("%d messages queued, want 1", len(b.dmarc.jobs))
+	}
+	result := dmarcResults.With(prometheus.Labels{"dkim": alignFail, "spf": alignPass, "dmarc": alignPass})
+	before := testutil.ToFloat64(result)
+	b.dmarc.evaluate(context.Background(), <-b.dmarc.jobs)
+	if d := testutil.ToFloat64(result) - before; d != 1 {
+		t.Errorf("dkim=fail spf=pass dmarc=pass counted %v times, want 1", d)
+	}
+
+	for len(b.dmarc.jobs) < dmarcQueueSize {
+		b.dmarc.jobs <- dmarcJob{}
+	}
+	skipped := testutil.ToFloat64(dmarcSkipped)
+	s.reportDMARC()
+	if d := testutil.ToFloat64(dmarcSkipped) - skipped; d != 1 {
+		t.Errorf("dmarc_skipped_total increased by %v with the queue full, want 1", d)
+	}
+}
+
+func TestDomainsAligned(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"example.com", "example.com", true},
+		{"mail.example.com", "example.com", true},
+		{"example.com", "mail.example.com", true},
+		{"a.example.com", "b.example.com", true},
+		{"com", "example.com", false},
+		{"example.com", "com", false},
+		{"co.uk", "example.co.uk", false},
+		{"example.co.uk", "other.co.uk", false},
+		{"mail.example.co.uk", "example.co.uk", true},
+		{"example.com", "example.net", false},
+		{"example.com", "notexample.com", false},
+	}
+	for _, tt := range tests {
+		if got := domainsAligned(tt.a, tt.b); got != tt.want {
+			t.Errorf("domainsAligned(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDMARCEvaluate(t *testing.T) {
+	f := &fakeDMARCClient{
+		dkim:     map[string]bool{"dkim.example": true},
+		mailFrom: map[string]string{"spf.example": "bounce.spf.example"},
+	}
+	c := newDMARCChecker(f)
+	tests := []struct {
+		name            string
+		job             dmarcJob
+		dkim, spf, want string
+	}{
+		{"easy dkim", dmarcJob{fromDomain: "dkim.example", envDomain: "dkim.example"}, alignPass, alignFail, alignPass},
+		{"custom mail from", dmarcJob{fromDomain: "spf.example", envDomain: "spf.example"}, alignFail, alignPass, alignPass},
+		{"nothing aligned", dmarcJob{fromDomain: "other.example", envDomain: "other.example"}, alignFail, alignFail, alignFail},
+		{
+			"unverified signature",
+			dmarcJob{fromDomain: "other.example", envDomain: "other.example", sigDomains: []string{"mail.other.example"}},
+			alignUnverified, alignFail, alignUnverified,
+		},
+		{
+			"unverified signature with spf",
+			dmarcJob{fromDomain: "spf.example", envDomain: "spf.example", sigDomains: []string{"spf.example"}},
+			alignUnverified, alignPass, alignPass,
+		},
+		{
+			"unaligned signature",
+			dmarcJob{fromDomain: "other.example", envDomain: "other.example", sigDomains: []string{"esp.example"}},
+			alignFail, alignFail, alignFail,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := dmarcResults.With(prometheus.Labels{"dkim": tt.dkim, "spf": tt.spf, "dmarc": tt.want})
+			before := testutil.ToFloat64(result)
+			c.evaluate(context.Background(), tt.job)
+			if d := testutil.ToFloat64(result) - before; d != 1 {
+				t.Errorf("dkim=%s spf=%s dmarc=%s counted %v times, want 1", tt.dkim, tt.spf, tt.want, d)
+			}
+		})
+	}
+}
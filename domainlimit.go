@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var domainRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "domain_rate_limited_total",
+	Help:      "Total number of messages deferred by -domain-rate-limit, by configured domain",
+}, []string{"domain"})
+
+// recipientDomains returns the distinct, lowercased domains of recipients.
+func recipientDomains(recipients []string) []string {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, rcpt := range recipients {
+		_, domain := splitAddress(rcpt)
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// checkDomainRateLimit defers the message if any of its recipient domains
+// is over its -domain-rate-limit. A message counts once per domain however
+// many of its recipients are there.
+func (s *Session) checkDomainRateLimit(recipients []string) error {
+	l := s.backend.domainLimiter
+	if l == nil {
+		return nil
+	}
+	ok, name := l.allow(recipientDomains(recipients), time.Now())
+	if ok {
+		return nil
+	}
+	domainRateLimited.With(prometheus.Labels{"domain": name}).Inc()
+	emailError.With(prometheus.Labels{"type": "domain rate limited", "tenant": s.tenant}).Inc()
+	s.logf("deferring message from %s, recipient domain rate limit %s exceeded", s.from, name)
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Sending rate limit for a recipient domain exceeded. Please try again later",
+	}
+}
+
+// refundDomainRateLimit gives back the tokens checkDomainRateLimit took, for
+// a message a later check refused.
+func (s *Session) refundDomainRateLimit(recipients []string) {
+	if l := s.backend.domainLimiter; l != nil {
+		l.refund(recipientDomains(recipients), time.Now())
+	}
+}
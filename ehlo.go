@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ESMTP extensions whose advertisement can be controlled with -ehlo-extensions.
+const (
+	ExtSize       = "SIZE"
+	Ext8BitMIME   = "8BITMIME"
+	ExtSMTPUTF8   = "SMTPUTF8"
+	ExtPipelining = "PIPELINING"
+	ExtStartTLS   = "STARTTLS"
+)
+
+// DefaultEHLOExtensions matches what the relay advertised before the
+// extensions became configurable.
+const DefaultEHLOExtensions = "SIZE,8BITMIME,PIPELINING,STARTTLS"
+
+var configurableExtensions = []string{ExtSize, Ext8BitMIME, ExtSMTPUTF8, ExtPipelining, ExtStartTLS}
+
+// ehloExtensions is the set of enabled configurable extensions.
+type ehloExtensions map[string]bool
+
+// parseEHLOExtensions parses a comma separated list of extension names.
+func parseEHLOExtensions(list string) (ehloExtensions, error) {
+	exts := make(ehloExtensions)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, k := range configurableExtensions {
+			if name == k {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown extension %q (want %s)", name, strings.Join(configurableExtensions, ", "))
+		}
+		exts[name] = true
+	}
+	return exts, nil
+}
+
+// errParamNotSupported rejects a MAIL FROM parameter belonging to a disabled
+// extension.
+func errParamNotSupported(param string) error {
+	return &smtp.SMTPError{
+		Code:         555,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+		Message:      param + " parameter not supported",
+	}
+}
+
+// hidden returns the extensions go-smtp always advertises but that are
+// disabled, and so must be removed from the EHLO response.
+func (e ehloExtensions) hidden() map[string]bool {
+	hidden := make(map[string]bool)
+	for _, name := range []string{ExtSize, Ext8BitMIME, ExtPipelining} {
+		if !e[name] {
+			hidden[name] = true
+		}
+	}
+	return hidden
+}
+
+// ehloStart is how go-smtp begins a multiline EHLO response.
+var ehloStart = []byte("250-Hello ")
+
+// startTLSReady is go-smtp's reply to STARTTLS, after which the client starts
+// the TLS handshake.
+var startTLSReady = []byte("220 2.0.0 Ready to start TLS\r\n")
+
+// ehloFilterListener removes disabled extensions from EHLO responses. With
+// tlsConfig set, the connections also take over STARTTLS, so that the EHLO
+// response sent over TLS is filtered too; go-smtp's own TLSConfig must then
+// be bridge.server.
+type ehloFilterListener struct {
+	net.Listener
+	hidden    map[string]bool
+	tlsConfig *tls.Config // the listener's, nil without STARTTLS
+	bridge    *tlsBridge
+}
+
+// Accept implements net.Listener
+func (l *ehloFilterListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	fc := &ehloFilterConn{Conn: c, tlsConfig: l.tlsConfig, bridge: l.bridge}
+	fc.filter = ehloFilter{w: c, hidden: l.hidden}
+	if l.tlsConfig != nil {
+		fc.filter.ready = fc.startTLS
+	}
+	return fc, nil
+}
+
+// ehloFilter passes writes on to w, except for the multiline EHLO response,
+// which go-smtp writes one line at a time: that is buffered and rewritten
+// without the hidden extensions.
+type ehloFilter struct {
+	w       io.Writer
+	hidden  map[string]bool
+	pending []byte // incomplete line
+	lines   [][]byte
+	// ready, if set, is called once the reply to STARTTLS has been written.
+	ready func()
+}
+
+// Write implements io.Writer
+func (f *ehloFilter) Write(b []byte) (int, error) {
+	data := append(f.pending, b...)
+	f.pending = nil
+	var out []byte
+	starttls := false
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			// Hold back a partial line only if it may belong to the EHLO
+			// response.
+			if f.lines != nil || bytes.HasPrefix(ehloStart, data) || bytes.HasPrefix(data, ehloStart) {
+				f.pending = data
+			} else {
+				out = append(out, data...)
+			}
+			break
+		}
+		line := data[:i+1]
+		data = data[i+1:]
+
+		switch {
+		case f.lines != nil:
+			f.lines = append(f.lines, line)
+			if !bytes.HasPrefix(line, []byte("250-")) {
+				out = append(out, f.rewrite()...)
+			}
+		case bytes.HasPrefix(line, ehloStart):
+			f.lines = [][]byte{line}
+		default:
+			out = append(out, line...)
+			// go-smtp flushes the reply on its own, nothing follows it.
+			starttls = f.ready != nil && bytes.Equal(line, startTLSReady)
+		}
+	}
+	if len(out) > 0 {
+		if _, err := f.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	if starttls {
+		f.ready()
+	}
+	return len(b), nil
+}
+
+// rewrite returns the buffered EHLO response without hidden extensions,
+// fixing up the continuation markers.
+func (f *ehloFilter) rewrite() []byte {
+	kept := f.lines[:1]
+	for _, line := range f.lines[1:] {
+		if len(line) < 4 {
+			continue
+		}
+		keyword, _, _ := strings.Cut(string(bytes.TrimRight(line[4:], "\r\n")), " ")
+		if !f.hidden[strings.ToUpper(keyword)] {
+			kept = append(kept, line)
+		}
+	}
+	f.lines = nil
+
+	var out []byte
+	for i, line := range kept {
+		sep := byte('-')
+		if i == len(kept)-1 {
+			sep = ' '
+		}
+		out = append(out, line[:3]...)
+		out = append(out, sep)
+		out = append(out, line[4:]...)
+	}
+	return out
+}
+
+// ehloFilterConn filters the EHLO responses go-smtp writes to the
+// connection. After STARTTLS the connection only carries TLS records, which
+// cannot be filtered, so with a tlsConfig it terminates the client's TLS
+// itself: the decrypted session is relayed to go-smtp through an in-process
+// TLS link, and the responses are filtered on their way back.
+type ehloFilterConn struct {
+	net.Conn
+	filter    ehloFilter
+	tlsConfig *tls.Config
+	bridge    *tlsBridge
+
+	mu       sync.Mutex
+	starttls *bridgedTLS // set by STARTTLS
+}
+
+// bridgedTLS is a connection after STARTTLS.
+type bridgedTLS struct {
+	client *tls.Conn // with the SMTP client, over the connection
+	pipe   net.Conn  // go-smtp's end of the link, carrying its TLS records
+}
+
+func (c *ehloFilterConn) bridged() *bridgedTLS {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.starttls
+}
+
+// startTLS switches the connection to the TLS bridge once go-smtp has
+// accepted STARTTLS. go-smtp then performs its TLS handshake with the bridge.
+func (c *ehloFilterConn) startTLS() {
+	smtpEnd, bridgeEnd := net.Pipe()
+	t := &bridgedTLS{client: tls.Server(c.Conn, c.tlsConfig), pipe: smtpEnd}
+	c.mu.Lock()
+	c.starttls = t
+	c.mu.Unlock()
+	go c.runBridge(t, tls.Client(bridgeEnd, c.bridge.client))
+}
+
+// runBridge completes the handshake with the client, under the read deadline
+// go-smtp set for the STARTTLS command, and then copies the session between
+// the client and go-smtp until either side is done. From then on go-smtp's
+// deadlines apply to its end of the pipe.
+func (c *ehloFilterConn) runBridge(t *bridgedTLS, smtpTLS *tls.Conn) {
+	defer smtpTLS.Close()
+	if err := t.client.Handshake(); err != nil {
+		return
+	}
+	c.Conn.SetDeadline(time.Time{})
+	if err := smtpTLS.Handshake(); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(&ehloFilter{w: t.client, hidden: c.filter.hidden}, smtpTLS)
+		t.client.Close()
+	}()
+	io.Copy(smtpTLS, t.client)
+}
+
+// pipeErr reports the pipe closed by Close as the closed connection go-smtp
+// expects.
+func pipeErr(err error) error {
+	if errors.Is(err, io.ErrClosedPipe) {
+		return net.ErrClosed
+	}
+	return err
+}
+
+// Read implements net.Conn
+func (c *ehloFilterConn) Read(b []byte) (int, error) {
+	if t := c.bridged(); t != nil {
+		n, err := t.pipe.Read(b)
+		return n, pipeErr(err)
+	}
+	return c.Conn.Read(b)
+}
+
+// Write implements net.Conn
+func (c *ehloFilterConn) Write(b []byte) (int, error) {
+	if t := c.bridged(); t != nil {
+		n, err := t.pipe.Write(b)
+		return n, pipeErr(err)
+	}
+	return c.filter.Write(b)
+}
+
+// Close implements net.Conn
+func (c *ehloFilterConn) Close() error {
+	if t := c.bridged(); t != nil {
+		t.pipe.Close()
+		return t.client.Close()
+	}
+	return c.Conn.Close()
+}
+
+// SetDeadline implements net.Conn
+func (c *ehloFilterConn) SetDeadline(d time.Time) error {
+	if t := c.bridged(); t != nil {
+		return t.pipe.SetDeadline(d)
+	}
+	return c.Conn.SetDeadline(d)
+}
+
+// SetReadDeadline implements net.Conn
+func (c *ehloFilterConn) SetReadDeadline(d time.Time) error {
+	if t := c.bridged(); t != nil {
+		return t.pipe.SetReadDeadline(d)
+	}
+	return c.Conn.SetReadDeadline(d)
+}
+
+// SetWriteDeadline implements net.Conn
+func (c *ehloFilterConn) SetWriteDeadline(d time.Time) error {
+	if t := c.bridged(); t != nil {
+		return t.pipe.SetWriteDeadline(d)
+	}
+	return c.Conn.SetWriteDeadline(d)
+}
+
+// connTLSState returns the TLS state of the client connection of c: go-smtp's
+// own, or that of the client's side of the bridge after STARTTLS.
+func connTLSState(c *smtp.Conn) (tls.ConnectionState, bool) {
+	state, ok := c.TLSConnectionState()
+	if ct := trackedConn(c.Conn()); ok && ct != nil {
+		if fc, isFilter := ct.Conn.(*ehloFilterConn); isFilter {
+			if t := fc.bridged(); t != nil {
+				return t.client.ConnectionState(), true
+			}
+		}
+	}
+	return state, ok
+}
+
+// tlsBridge holds the TLS configurations of the in-process link between
+// ehloFilterConn and go-smtp, with a throwaway self-signed certificate.
+type tlsBridge struct {
+	server, client *tls.Config
+}
+
+// tlsBridgeName is the name in the bridge's certificate.
+const tlsBridgeName = "starttls-bridge.invalid"
+
+func newTLSBridge() (*tlsBridge, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: tlsBridgeName},
+		DNSNames:     []string{tlsBridgeName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(100, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tlsBridge{
+		server: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+			MinVersion:   tls.VersionTLS13,
+		},
+		client: &tls.Config{RootCAs: roots, ServerName: tlsBridgeName, MinVersion: tls.VersionTLS13},
+	}, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	netsmtp "net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestEHLOFilter(t *testing.T) {
+	var out bytes.Buffer
+	f := &ehloFilter{w: &out, hidden: map[string]bool{ExtPipelining: true, ExtSize: true}}
+	// go-smtp writes the response one line at a time.
+	for _, line := range []string{
+		"250-Hello client\r\n",
+		"250-PIPELINING\r\n",
+		"250-8BITMIME\r\n",
+		"250-ENHANCEDSTATUSCODES\r\n",
+		"250-CHUNKING\r\n",
+		"250 SIZE 10485760\r\n",
+		"250 2.0.0 Roger, accepting mail from <a@example.com>\r\n",
+	} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "250-Hello client\r\n250-8BITMIME\r\n250-ENHANCEDSTATUSCODES\r\n250 CHUNKING\r\n" +
+		"250 2.0.0 Roger, accepting mail from <a@example.com>\r\n"
+	if out.String() != want {
+		t.Errorf("filtered output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+// TestEHLOFilterSTARTTLS checks that the EHLO response repeated over TLS is
+// filtered as well, and that the session works through the bridge.
+func TestEHLOFilterSTARTTLS(t *testing.T) {
+	bridge, err := newTLSBridge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second self-signed certificate stands in for the listener's.
+	listenerTLS, err := newTLSBridge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exts, err := parseEHLOExtensions("STARTTLS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &fakeSender{messageID: "0100-test"}
+	b := &Backend{sender: sender, extensions: exts}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(b)
+	s.Domain = "localhost"
+	s.TLSConfig = bridge.server
+	go s.Serve(&closeTrackListener{Listener: &ehloFilterListener{
+		Listener:  l,
+		hidden:    exts.hidden(),
+		tlsConfig: listenerTLS.server,
+		bridge:    bridge,
+	}})
+	t.Cleanup(func() { s.Close() })
+
+	c, err := netsmtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	checkHidden := func(phase string) {
+		t.Helper()
+		for _, ext := range []string{ExtSize, Ext8BitMIME, ExtPipelining} {
+			if ok, _ := c.Extension(ext); ok {
+				t.Errorf("%s advertised %s", phase, ext)
+			}
+		}
+	}
+	checkHidden("EHLO")
+	if ok, _ := c.Extension(ExtStartTLS); !ok {
+		t.Fatal("STARTTLS not advertised")
+	}
+
+	if err := c.StartTLS(listenerTLS.client); err != nil {
+		t.Fatalf("STARTTLS: %v", err)
+	}
+	checkHidden("EHLO over TLS")
+	if ok, _ := c.Extension(ExtStartTLS); ok {
+		t.Error("STARTTLS advertised again over TLS")
+	}
+	state, _ := c.TLSConnectionState()
+	if len(state.PeerCertificates) == 0 || !bytes.Equal(state.PeerCertificates[0].Raw, listenerTLS.server.Certificates[0].Certificate[0]) {
+		t.Error("client was not presented the listener's certificate")
+	}
+
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	if err := c.Rcpt("rcpt@example.net"); err != nil {
+		t.Fatalf("RCPT: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	w.Write([]byte(testMessage))
+	if err := w.Close(); err != nil {
+		t.Fatalf("DATA reply: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT: %v", err)
+	}
+
+	calls := sender.sent()
+	if len(calls) != 1 || strings.Join(calls[0].to, ",") != "rcpt@example.net" {
+		t.Fatalf("SendRaw calls = %+v, want one to rcpt@example.net", calls)
+	}
+	if string(calls[0].data) != testMessage {
+		t.Errorf("SendRaw data = %q, want %q", calls[0].data, testMessage)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Values of -eightbit-policy for messages with 8-bit bodies sent without
+// BODY=8BITMIME.
+const (
+	EightBitPass   = "pass"   // relay unchanged
+	EightBitReject = "reject" // refuse with 554
+	EightBitEncode = "encode" // re-encode 8-bit parts to quoted-printable or base64
+)
+
+var eightBitMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "eightbit_undeclared_total",
+	Help:      "Total number of messages with 8-bit content sent without BODY=8BITMIME, by action: rejected or encoded",
+}, []string{"action"})
+
+var errEightBitHeader = errors.New("8-bit bytes in a MIME part header")
+
+// has8bit reports whether b contains a byte outside US-ASCII.
+func has8bit(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEightBit applies -eightbit-policy to a message whose body has 8-bit
+// bytes although MAIL FROM did not declare BODY=8BITMIME, returning the
+// message to relay. Template requests are left alone: they are not relayed
+// as they are.
+func (s *Session) checkEightBit(data []byte) ([]byte, error) {
+	policy := s.backend.eightBitPolicy
+	if policy == "" || policy == EightBitPass || s.body8bit {
+		return data, nil
+	}
+	if t := s.backend.templates; t != nil {
+		if triggered, _ := t.splitRecipients(s.recipients); triggered {
+			return data, nil
+		}
+	}
+	if _, body := splitHeader(data); !has8bit(body) {
+		return data, nil
+	}
+
+	if policy == EightBitEncode {
+		parts := 0
+		encoded, err := encode8bitEntity(data, 0, &parts)
+		if err == nil {
+			encoded = ensureMIMEVersion(encoded)
+			if _, body := splitHeader(encoded); has8bit(body) {
+				err = errEightBitHeader
+			}
+		}
+		if err == nil && len(encoded) > SesSizeLimit {
+			err = errMessageTooLarge
+		}
+		if err == nil {
+			eightBitMessages.With(prometheus.Labels{"action": "encoded"}).Inc()
+			s.logf("re-encoded 8-bit message from %s sent without BODY=8BITMIME (%d to %d bytes)", s.from, len(data), len(encoded))
+			return encoded, nil
+		}
+		s.logf("cannot re-encode 8-bit message from %s: %v", s.from, err)
+	}
+
+	eightBitMessages.With(prometheus.Labels{"action": "rejected"}).Inc()
+	emailError.With(prometheus.Labels{"type": "undeclared 8bit", "tenant": s.tenant}).Inc()
+	s.logf("rejecting 8-bit message from %s sent without BODY=8BITMIME", s.from)
+	return nil, &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 3},
+		Message:      "Error: 8-bit content requires BODY=8BITMIME",
+	}
+}
+
+// encode8bitEntity rewrites a MIME entity (header and body) so that no
+// leaf body contains 8-bit bytes: text parts become quoted-printable, others
+// base64. Multipart and message/rfc822 bodies are processed part by part,
+// keeping everything else byte for byte.
+func encode8bitEntity(entity []byte, depth int, parts *int) ([]byte, error) {
+	*parts++
+	if depth > maxMIMEDepth || *parts > maxMIMEParts {
+		return nil, errMIMETooComplex
+	}
+	fields, rest := splitHeader(entity)
+	if !has8bit(rest) {
+		return entity, nil
+	}
+	contentType, _ := getHeader(fields, "Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	cte, _ := getHeader(fields, "Content-Transfer-Encoding")
+	cte = strings.ToLower(cte)
+
+	var body []byte
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if params["boundary"] == "" {
+			return nil, fmt.Errorf("multipart entity without boundary")
+		}
+		if body, err = encode8bitMultipart(rest, params["boundary"], depth, parts); err != nil {
+			return nil, err
+		}
+	case mediaType == "message/rfc822":
+		sep, inner := cutBlankLine(rest)
+		if inner, err = encode8bitEntity(inner, depth+1, parts); err != nil {
+			return nil, err
+		}
+		body = append(sep, inner...)
+	default:
+		if cte != "" && cte != "7bit" && cte != "8bit" && cte != "binary" {
+			// Already encoded; raw 8-bit bytes cannot be fixed here.
+			return entity, nil
+		}
+		sep, raw := cutBlankLine(rest)
+		newCTE := "base64"
+		if strings.HasPrefix(mediaType, "text/") {
+			newCTE = "quoted-printable"
+		}
+		return rebuildEntity(entity, fields, newCTE, append(sep, encodeBody(raw, newCTE, lineEnding(entity))...)), nil
+	}
+
+	// A composite body only declares 8bit for its parts, now 7-bit.
+	if (cte == "8bit" || cte == "binary") && !has8bit(body) {
+		return rebuildEntity(entity, fields, "7bit", body), nil
+	}
+	return rebuildEntity(entity, fields, "", body), nil
+}
+
+// encode8bitMultipart processes each part of a multipart body, keeping the
+// preamble, delimiters and epilogue unchanged.
+func encode8bitMultipart(body []byte, boundary string, depth int, parts *int) ([]byte, error) {
+	delim := []byte("--" + boundary)
+	var out []byte
+	var part []byte // the current part, nil in the preamble and epilogue
+	inPart, closed := false, false
+	flush := func() error {
+		if !inPart {
+			out = append(out, part...)
+			return nil
+		}
+		// The line ending before a delimiter belongs to the delimiter.
+		trailer := ""
+		if bytes.HasSuffix(part, []byte("\r\n")) {
+			part, trailer = part[:len(part)-2], "\r\n"
+		} else if bytes.HasSuffix(part, []byte("\n")) {
+			part, trailer = part[:len(part)-1], "\n"
+		}
+		encoded, err := encode8bitEntity(part, depth+1, parts)
+		if err != nil {
+			return err
+		}
+		out = append(append(out, encoded...), trailer...)
+		return nil
+	}
+	for len(body) > 0 {
+		end := bytes.IndexByte(body, '\n') + 1
+		if end == 0 {
+			end = len(body)
+		}
+		line := body[:end]
+		body = body[end:]
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		if !closed && bytes.HasPrefix(trimmed, delim) {
+			suffix := trimmed[len(delim):]
+			if len(suffix) == 0 || bytes.Equal(suffix, []byte("--")) {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				out = append(out, line...)
+				part = nil
+				closed = len(suffix) > 0
+				inPart = !closed
+				continue
+			}
+		}
+		part = append(part, line...)
+	}
+	if inPart {
+		return nil, fmt.Errorf("multipart body without closing delimiter")
+	}
+	out = append(out, part...)
+	return out, nil
+}
+
+// cutBlankLine splits the remainder returned by splitHeader into the blank
+// line separating header and body, and the body.
+func cutBlankLine(rest []byte) (sep, body []byte) {
+	end := bytes.IndexByte(rest, '\n') + 1
+	if end == 0 {
+		end = len(rest)
+	}
+	return append([]byte(nil), rest[:end]...), rest[end:]
+}
+
+// encodeBody encodes a leaf body with cte, using eol for line breaks. The
+// result ends with a line break only if raw does, as the one before a
+// multipart delimiter is kept separately.
+func encodeBody(raw []byte, cte, eol string) []byte {
+	var buf bytes.Buffer
+	if cte == "quoted-printable" {
+		w := quotedprintable.NewWriter(&buf)
+		w.Write(raw)
+		w.Close()
+		out := buf.Bytes()
+		if eol == "\n" {
+			out = bytes.ReplaceAll(out, []byte("\r\n"), []byte("\n"))
+		}
+		return out
+	}
+	enc := base64.StdEncoding.EncodeToString(raw)
+	for len(enc) > 76 {
+		buf.WriteString(enc[:76] + eol)
+		enc = enc[76:]
+	}
+	buf.WriteString(enc)
+	if bytes.HasSuffix(raw, []byte("\n")) {
+		buf.WriteString(eol)
+	}
+	return buf.Bytes()
+}
+
+// rebuildEntity returns the entity with body, and with its
+// Content-Transfer-Encoding set to cte unless cte is empty.
+func rebuildEntity(entity []byte, fields []headerField, cte string, body []byte) []byte {
+	var out []byte
+	for _, f := range fields {
+		if cte != "" && strings.EqualFold(f.name, "Content-Transfer-Encoding") {
+			continue
+		}
+		out = append(out, f.raw...)
+	}
+	if cte != "" {
+		out = append(out, "Content-Transfer-Encoding: "+cte+lineEnding(entity)...)
+	}
+	if len(body) == 0 {
+		// Header-only entity: a body needs the blank line first.
+		return out
+	}
+	return append(out, body...)
+}
+
+// ensureMIMEVersion adds "MIME-Version: 1.0" to a message without one, as
+// required once it declares a Content-Transfer-Encoding.
+func ensureMIMEVersion(data []byte) []byte {
+	fields, _ := splitHeader(data)
+	if _, ok := getHeader(fields, "MIME-Version"); ok {
+		return data
+	}
+	return prependHeader(data, "MIME-Version", "1.0")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// leafBodies returns the decoded bodies of the leaf parts of an entity with
+// header h, in order.
+func leafBodies(t *testing.T, h func(string) string, body io.Reader) []string {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(h("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var leaves []string
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := r.NextRawPart()
+			if err == io.EOF {
+				return leaves
+			}
+			if err != nil {
+				t.Fatalf("reading part: %v", err)
+			}
+			leaves = append(leaves, leafBodies(t, p.Header.Get, p)...)
+		}
+	}
+	switch strings.ToLower(h("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("decoding %s part: %v", mediaType, err)
+	}
+	return []string{string(data)}
+}
+
+// messageLeaves parses a message and returns the decoded bodies of its leaf
+// parts.
+func messageLeaves(t *testing.T, data []byte) []string {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("parsing message: %v", err)
+	}
+	return leafBodies(t, msg.Header.Get, msg.Body)
+}
+
+const eightBitSinglePart = "From: a@example.com\n" +
+	"Content-Type: text/plain; charset=utf-8\n" +
+	"Content-Transfer-Encoding: 8bit\n" +
+	"\n" +
+	"Grüße aus Köln\n" +
+	"second line\n"
+
+// eightBitNested has 8-bit text parts in a nested multipart/alternative,
+// an 8-bit binary part and a base64 part that is already 7-bit.
+const eightBitNested = "From: a@example.com\n" +
+	"MIME-Version: 1.0\n" +
+	"Content-Type: multipart/mixed; boundary=outer\n" +
+	"Content-Transfer-Encoding: 8bit\n" +
+	"\n" +
+	"preamble\n" +
+	"--outer\n" +
+	"Content-Type: multipart/alternative; boundary=inner\n" +
+	"\n" +
+	"--inner\n" +
+	"Content-Type: text/plain; charset=utf-8\n" +
+	"\n" +
+	"Grüße\n" +
+	"--inner\n" +
+	"Content-Type: text/html; charset=utf-8\n" +
+	"Content-Transfer-Encoding: 8bit\n" +
+	"\n" +
+	"<p>Grüße</p>\n" +
+	"--inner--\n" +
+	"--outer\n" +
+	"Content-Type: application/octet-stream\n" +
+	"\n" +
+	"\x00\xff\xfe binary\n" +
+	"--outer\n" +
+	"Content-Type: application/pdf\n" +
+	"Content-Transfer-Encoding: base64\n" +
+	"\n" +
+	"JVBERi0xLjQK\n" +
+	"--outer--\n" +
+	"epilogue\n"
+
+// withEOL returns message with its line breaks as eol.
+func withEOL(message, eol string) []byte {
+	return []byte(strings.ReplaceAll(message, "\n", eol))
+}
+
+func TestEncode8bitEntity(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		leaves  []string // decoded, with LF line breaks
+	}{
+		{"single part", eightBitSinglePart, []string{"Grüße aus Köln\nsecond line\n"}},
+		{"nested multipart", eightBitNested, []string{"Grüße", "<p>Grüße</p>", "\x00\xff\xfe binary", "%PDF-1.4\n"}},
+	}
+	for _, tt := range tests {
+		for _, eol := range []string{"\r\n", "\n"} {
+			t.Run(fmt.Sprintf("%s %q", tt.name, eol), func(t *testing.T) {
+				data := withEOL(tt.message, eol)
+				parts := 0
+				out, err := encode8bitEntity(data, 0, &parts)
+				if err != nil {
+					t.Fatalf("encode8bitEntity: %v", err)
+				}
+				if has8bit(out) {
+					t.Errorf("8-bit bytes left:\n%s", out)
+				}
+				if eol == "\n" && bytes.Contains(out, []byte("\r")) {
+					t.Error("CR added to an LF message")
+				}
+				if eol == "\r\n" && bytes.Count(out, []byte("\n")) != bytes.Count(out, []byte("\r\n")) {
+					t.Error("bare LF in a CRLF message")
+				}
+				got := messageLeaves(t, out)
+				if len(got) != len(tt.leaves) {
+					t.Fatalf("%d leaf parts, want %d:\n%s", len(got), len(tt.leaves), out)
+				}
+				for i, want := range tt.leaves {
+					// Base64 parts keep their bytes, line breaks included.
+					if strings.Contains(want, "binary") || strings.Contains(want, "PDF") {
+						if got[i] != want {
+							t.Errorf("part %d = %q, want %q", i, got[i], want)
+						}
+						continue
+					}
+					if strings.ReplaceAll(got[i], "\r\n", "\n") != want {
+						t.Errorf("part %d = %q, want %q", i, got[i], want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestEncode8bitEntityKeepsStructure(t *testing.T) {
+	parts := 0
+	out, err := encode8bitEntity([]byte(eightBitNested), 0, &parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kept := range []string{
+		"preamble\n--outer\n",
+		"--inner--\n--outer\n",
+		// Already encoded, left alone.
+		"Content-Type: application/pdf\nContent-Transfer-Encoding: base64\n\nJVBERi0xLjQK\n--outer--\nepilogue\n",
+	} {
+		if !bytes.Contains(out, []byte(kept)) {
+			t.Errorf("%q not kept byte for byte:\n%s", kept, out)
+		}
+	}
+	// The composite entity only contains 7-bit parts now.
+	fields, _ := splitHeader(out)
+	if cte, _ := getHeader(fields, "Content-Transfer-Encoding"); cte != "7bit" {
+		t.Errorf("top level Content-Transfer-Encoding = %q, want 7bit", cte)
+	}
+	if parts != 6 {
+		t.Errorf("%d entities visited, want 6", parts)
+	}
+}
+
+func TestEncode8bitEntityLimits(t *testing.T) {
+	deep := "Content-Type: text/plain\n\nGrüße\n"
+	for i := 0; i <= maxMIMEDepth; i++ {
+		deep = "Content-Type: message/rfc822\n\n" + deep
+	}
+	var wide strings.Builder
+	wide.WriteString("Content-Type: multipart/mixed; boundary=b\n\n")
+	for i := 0; i < maxMIMEParts; i++ {
+		wide.WriteString("--b\nContent-Type: text/plain\n\nGrüße\n")
+	}
+	wide.WriteString("--b--\n")
+
+	for name, message := range map[string]string{"depth": deep, "parts": wide.String()} {
+		parts := 0
+		if _, err := encode8bitEntity([]byte(message), 0, &parts); !errors.Is(err, errMIMETooComplex) {
+			t.Errorf("%s over the limit: %v, want %v", name, err, errMIMETooComplex)
+		}
+	}
+}
+
+func TestCheckEightBit(t *testing.T) {
+	b := newTestBackend(t, &fakeSender{})
+	b.eightBitPolicy = EightBitEncode
+	s := newTestSession(t, b, testMessage)
+
+	data := withEOL(eightBitSinglePart, "\r\n")
+	out, err := s.checkEightBit(data)
+	if err != nil {
+		t.Fatalf("checkEightBit: %v", err)
+	}
+	fields, _ := splitHeader(out)
+	if v, _ := getHeader(fields, "MIME-Version"); v != "1.0" {
+		t.Errorf("MIME-Version = %q, want 1.0 added", v)
+	}
+	if cte, _ := getHeader(fields, "Content-Transfer-Encoding"); cte != "quoted-printable" {
+		t.Errorf("Content-Transfer-Encoding = %q, want quoted-printable", cte)
+	}
+
+	// Declared with BODY=8BITMIME: relayed as is.
+	s.body8bit = true
+	if out, err := s.checkEightBit(data); err != nil || !bytes.Equal(out, data) {
+		t.Errorf("checkEightBit with BODY=8BITMIME changed the message: %v", err)
+	}
+	s.body8bit = false
+
+	// 8-bit bytes in a part declared base64 cannot be re-encoded.
+	broken := withEOL("Content-Type: text/plain\nContent-Transfer-Encoding: base64\n\nGrüße\n", "\r\n")
+	var smtpErr *smtp.SMTPError
+	if _, err := s.checkEightBit(broken); !errors.As(err, &smtpErr) || smtpErr.Code != 554 {
+		t.Errorf("checkEightBit(8-bit base64 part) = %v, want 554", err)
+	}
+
+	b.eightBitPolicy = EightBitReject
+	if _, err := s.checkEightBit(data); !errors.As(err, &smtpErr) || smtpErr.Code != 554 {
+		t.Errorf("checkEightBit with -eightbit-policy reject = %v, want 554", err)
+	}
+}
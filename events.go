@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SendMessageBatch limits on messages per call and their total size.
+const (
+	sqsMaxBatch      = 10
+	sqsMaxBatchBytes = 256 << 10
+)
+
+// eventPublishTimeout bounds each SendMessageBatch call, retries included.
+const eventPublishTimeout = 10 * time.Second
+
+// eventFlushTimeout bounds publishing the buffered events at shutdown.
+const eventFlushTimeout = 15 * time.Second
+
+var eventsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "event_publish_total",
+	Help:      "Total number of send events for -event-queue-url by result: sent, failed or dropped (buffer full or shutdown)",
+}, []string{"result"})
+
+// sendEvent is the JSON message published for each SES send.
+type sendEvent struct {
+	Time       time.Time `json:"timestamp"`
+	RelayID    string    `json:"relay_id"`
+	Conn       string    `json:"conn"`
+	Tenant     string    `json:"tenant"`
+	From       string    `json:"from"`
+	Recipients []string  `json:"recipients"`
+	Size       int       `json:"size"`
+	Result     string    `json:"result"` // sent or failed
+	MessageID  string    `json:"message_id,omitempty"`
+	ConfigSet  string    `json:"configuration_set,omitempty"`
+	Template   string    `json:"template,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// eventPublisher sends send events to an SQS queue in the background.
+// Events wait in a bounded buffer; when it is full they are dropped rather
+// than holding up the SMTP session.
+type eventPublisher struct {
+	client   *sqs.Client
+	queueURL string
+	events   chan sendEvent
+
+	// closed is set once the shutdown flush is done; later events are
+	// dropped.
+	closed atomic.Bool
+	done   chan struct{}
+}
+
+// sqsQueueHost matches the host of a standard SQS queue URL, capturing the
+// region.
+var sqsQueueHost = regexp.MustCompile(`^sqs\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// newEventPublisher returns a publisher for queueURL buffering up to buffer
+// events. The SQS client is built from cfg, in the queue's region when the
+// URL names one.
+func newEventPublisher(cfg aws.Config, queueURL string, buffer int) (*eventPublisher, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid queue URL %q", queueURL)
+	}
+	client := sqs.NewFromConfig(cfg, func(o *sqs.Options) {
+		if m := sqsQueueHost.FindStringSubmatch(u.Hostname()); m != nil {
+			o.Region = m[1]
+		}
+	})
+	return &eventPublisher{
+		client:   client,
+		queueURL: queueURL,
+		events:   make(chan sendEvent, buffer),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// publish queues e without blocking.
+func (p *eventPublisher) publish(e sendEvent) {
+	if p.closed.Load() {
+		eventsPublished.With(prometheus.Labels{"result": "dropped"}).Inc()
+		return
+	}
+	select {
+	case p.events <- e:
+	default:
+		eventsPublished.With(prometheus.Labels{"result": "dropped"}).Inc()
+	}
+}
+
+// run sends the queued events, up to sqsMaxBatch per call, until ctx is
+// done, then publishes the events still buffered within eventFlushTimeout.
+// Calls are not bound to ctx, so that a batch in flight at shutdown
+// completes.
+func (p *eventPublisher) run(ctx context.Context) {
+	defer close(p.done)
+	for {
+		select {
+		case e := <-p.events:
+			p.sendBatch(context.Background(), e)
+		case <-ctx.Done():
+			p.flush()
+			return
+		}
+	}
+}
+
+// flush publishes the buffered events at shutdown. What cannot be sent in
+// time is dropped.
+func (p *eventPublisher) flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), eventFlushTimeout)
+	defer cancel()
+	sent := 0
+	// run is the only reader, so a buffered event is still there.
+	for ctx.Err() == nil && len(p.events) > 0 {
+		sent += p.sendBatch(ctx, <-p.events)
+	}
+	p.closed.Store(true)
+	if n := len(p.events); n > 0 {
+		eventsPublished.With(prometheus.Labels{"result": "dropped"}).Add(float64(n))
+		log.Printf("events: shutting down, %d send events not published", n)
+	}
+	if sent > 0 {
+		log.Printf("events: published %d buffered send events at shutdown", sent)
+	}
+}
+
+// wait blocks until the shutdown flush is done.
+func (p *eventPublisher) wait() {
+	<-p.done
+}
+
+// sendBatch publishes first and whatever else is buffered, up to
+// sqsMaxBatch events, and returns how many were sent.
+func (p *eventPublisher) sendBatch(ctx context.Context, first sendEvent) int {
+	batch := []sendEvent{first}
+fill:
+	for len(batch) < sqsMaxBatch {
+		select {
+		case e := <-p.events:
+			batch = append(batch, e)
+		default:
+			break fill
+		}
+	}
+	failed, err := p.send(ctx, batch)
+	if err != nil {
+		log.Printf("events: publishing %d send events to %s failed: %v", failed, p.queueURL, err)
+	}
+	eventsPublished.With(prometheus.Labels{"result": "sent"}).Add(float64(len(batch) - failed))
+	eventsPublished.With(prometheus.Labels{"result": "failed"}).Add(float64(failed))
+	return len(batch) - failed
+}
+
+// send publishes batch, in as many SendMessageBatch calls as its size
+// needs, and returns how many events failed, with the first error.
+func (p *eventPublisher) send(ctx context.Context, batch []sendEvent) (int, error) {
+	var failed int
+	var firstErr error
+	var entries []types.SendMessageBatchRequestEntry
+	size := 0
+	flush := func() {
+		if len(entries) == 0 {
+			return
+		}
+		n, err := p.sendEntries(ctx, entries)
+		failed += n
+		if firstErr == nil {
+			firstErr = err
+		}
+		entries, size = nil, 0
+	}
+	for i, e := range batch {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return len(batch), err
+		}
+		if size+len(body) > sqsMaxBatchBytes {
+			flush()
+		}
+		entries = append(entries, types.SendMessageBatchRequestEntry{
+			Id:          aws.String(strconv.Itoa(i)),
+			MessageBody: aws.String(string(body)),
+		})
+		size += len(body)
+	}
+	flush()
+	return failed, firstErr
+}
+
+// sendEntries makes one SendMessageBatch call.
+func (p *eventPublisher) sendEntries(ctx context.Context, entries []types.SendMessageBatchRequestEntry) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, eventPublishTimeout)
+	defer cancel()
+	out, err := p.client.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(p.queueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		return len(entries), err
+	}
+	if len(out.Failed) > 0 {
+		f := out.Failed[0]
+		return len(out.Failed), fmt.Errorf("event %s: %s: %s", aws.ToString(f.Id), aws.ToString(f.Code), aws.ToString(f.Message))
+	}
+	return 0, nil
+}
+
+// publishEvent queues the send event of the current message, if
+// -event-queue-url is set. template names a templated send.
+func (s *Session) publishEvent(recipients []string, messageID, template string, sendErr error) {
+	p := s.backend.events
+	if p == nil {
+		return
+	}
+	e := sendEvent{
+		Time:       time.Now().UTC(),
+		RelayID:    s.trackingID,
+		Conn:       s.connID,
+		Tenant:     s.tenant,
+		From:       s.from,
+		Recipients: append([]string(nil), recipients...),
+		Size:       len(s.data),
+		Result:     "sent",
+		MessageID:  messageID,
+		ConfigSet:  aws.ToString(s.configSet()),
+		Template:   template,
+	}
+	if sendErr != nil {
+		e.Result, e.Error = "failed", sendErr.Error()
+	}
+	p.publish(e)
+}
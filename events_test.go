@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeSQS answers SendMessageBatch calls, recording the message bodies.
+type fakeSQS struct {
+	mu     sync.Mutex
+	bodies []string
+	calls  int
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if target := r.Header.Get("X-Amz-Target"); target != "AmazonSQS.SendMessageBatch" {
+		http.Error(w, "unexpected target "+target, http.StatusBadRequest)
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+	var in struct {
+		QueueUrl string
+		Entries  []struct{ Id, MessageBody string }
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	type entry struct{ Id, MessageId, MD5OfMessageBody string }
+	var out struct{ Successful []entry }
+	f.mu.Lock()
+	f.calls++
+	for _, e := range in.Entries {
+		f.bodies = append(f.bodies, e.MessageBody)
+		sum := md5.Sum([]byte(e.MessageBody))
+		out.Successful = append(out.Successful, entry{Id: e.Id, MessageId: "m-" + e.Id, MD5OfMessageBody: hex.EncodeToString(sum[:])})
+	}
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(out)
+}
+
+func newTestEventPublisher(t *testing.T, h http.Handler, buffer int) *eventPublisher {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	cfg := aws.Config{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		BaseEndpoint: aws.String(srv.URL),
+		HTTPClient:   srv.Client(),
+	}
+	p, err := newEventPublisher(cfg, srv.URL+"/123456789012/events", buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestEventPublisherFlushesAtShutdown(t *testing.T) {
+	sqsStub := &fakeSQS{}
+	p := newTestEventPublisher(t, sqsStub, 100)
+	sent := eventsPublished.With(prometheus.Labels{"result": "sent"})
+	dropped := eventsPublished.With(prometheus.Labels{"result": "dropped"})
+	sentBefore, droppedBefore := testutil.ToFloat64(sent), testutil.ToFloat64(dropped)
+
+	for i := 0; i < 25; i++ {
+		p.publish(sendEvent{From: "a@example.com", Recipients: []string{"b@example.org"}, Result: "sent"})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	go p.run(ctx)
+	p.wait()
+
+	sqsStub.mu.Lock()
+	bodies, calls := len(sqsStub.bodies), sqsStub.calls
+	sqsStub.mu.Unlock()
+	if bodies != 25 {
+		t.Errorf("SQS received %d events, want 25", bodies)
+	}
+	if calls < 3 {
+		t.Errorf("SQS received %d calls, want at least 3 for 25 events", calls)
+	}
+	if d := testutil.ToFloat64(sent) - sentBefore; d != 25 {
+		t.Errorf("event_publish_total{result=\"sent\"} increased by %v, want 25", d)
+	}
+
+	// Events after the flush are dropped.
+	p.publish(sendEvent{Result: "sent"})
+	if d := testutil.ToFloat64(dropped) - droppedBefore; d != 1 {
+		t.Errorf("event_publish_total{result=\"dropped\"} increased by %v, want 1", d)
+	}
+}
+
+func TestEventPublisherBufferFull(t *testing.T) {
+	p := newTestEventPublisher(t, &fakeSQS{}, 2)
+	dropped := eventsPublished.With(prometheus.Labels{"result": "dropped"})
+	before := testutil.ToFloat64(dropped)
+	for i := 0; i < 5; i++ {
+		p.publish(sendEvent{Result: "sent"})
+	}
+	if d := testutil.ToFloat64(dropped) - before; d != 3 {
+		t.Errorf("event_publish_total{result=\"dropped\"} increased by %v, want 3", d)
+	}
+}
+
+func TestEventPublisherFailure(t *testing.T) {
+	p := newTestEventPublisher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"__type":"com.amazonaws.sqs#QueueDoesNotExist","message":"The specified queue does not exist."}`)
+	}), 10)
+	failed, err := p.send(context.Background(), []sendEvent{{Result: "sent"}, {Result: "failed"}})
+	if failed != 2 || err == nil {
+		t.Errorf("send = %d, %v, want 2 failed with an error", failed, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var fallbackRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "fallback_relay_total",
+	Help:      "Total number of messages handed to -fallback-relay after a permanent SES failure, by result",
+}, []string{"result"})
+
+// fallbackRelay delivers messages SES permanently rejected to a
+// conventional smart host over SMTP.
+type fallbackRelay struct {
+	addr     string
+	startTLS bool // require STARTTLS with a verified certificate
+	timeout  time.Duration
+}
+
+// send delivers data from from to the recipients. The whole exchange must
+// complete within the timeout.
+func (f *fallbackRelay) send(from string, to []string, data []byte) error {
+	conn, err := net.DialTimeout("tcp", f.addr, f.timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(f.timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	var c *smtp.Client
+	if f.startTLS {
+		host, _, _ := net.SplitHostPort(f.addr)
+		if c, err = smtp.NewClientStartTLS(conn, &tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		c = smtp.NewClient(conn)
+	}
+	defer c.Close()
+	if name, err := os.Hostname(); err == nil {
+		if err := c.Hello(name); err != nil {
+			return err
+		}
+	}
+	if err := c.SendMail(from, to, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// sendFallback tries the fallback relay for a message SES permanently
+// rejected with reply. A message the fallback also rejects permanently
+// fails with the SES reply; other fallback errors are temporary, so that
+// the client retries instead of bouncing.
+func (s *Session) sendFallback(recipients []string, reply *smtp.SMTPError) error {
+	f := s.backend.fallback
+	s.logf("SES rejected message from %s permanently (%d %s), trying fallback relay %s", s.from, reply.Code, reply.Message, f.addr)
+	err := f.send(s.from, recipients, s.data)
+	var smtpErr *smtp.SMTPError
+	switch {
+	case err == nil:
+		fallbackRelayed.With(prometheus.Labels{"result": "sent"}).Inc()
+		s.logf("relayed message from %s to %v via fallback relay %s (tenant: %s)", s.from, recipients, f.addr, s.tenant)
+		return nil
+	case errors.As(err, &smtpErr) && smtpErr.Code >= 500:
+		fallbackRelayed.With(prometheus.Labels{"result": "rejected"}).Inc()
+		s.logf("fallback relay %s rejected message from %s: %v", f.addr, s.from, err)
+		return reply
+	}
+	fallbackRelayed.With(prometheus.Labels{"result": "error"}).Inc()
+	s.logf("ERROR: fallback relay %s: %v", f.addr, err)
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+		Message:      "Fallback relay could not be reached. Please try again later",
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var earlyTalkers = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "early_talker_total",
+	Help:      "Total number of connections dropped for sending before the greeting",
+})
+
+var greetingTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "greeting_timeout_total",
+	Help:      "Total number of connections dropped for sending no command within -greeting-timeout of the greeting",
+})
+
+var errEarlyTalker = errors.New("client sent data before greeting")
+
+// greetPauseListener delays the SMTP greeting of every accepted connection
+// and drops clients that start talking before it is sent.
+type greetPauseListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+// Accept implements net.Listener
+func (l *greetPauseListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &greetPauseConn{Conn: c, delay: l.delay}, nil
+}
+
+// greetPauseConn performs the pause on the first write, which is the
+// greeting. This keeps the wait on the connection's own goroutine instead of
+// blocking Accept.
+type greetPauseConn struct {
+	net.Conn
+	delay time.Duration
+	once  sync.Once
+	err   error
+}
+
+// Write implements net.Conn
+func (c *greetPauseConn) Write(b []byte) (int, error) {
+	c.once.Do(func() { c.err = c.pause() })
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Write(b)
+}
+
+// pause waits for delay while watching for client input.
+func (c *greetPauseConn) pause() error {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.delay)); err != nil {
+		return err
+	}
+	var buf [1]byte
+	n, err := c.Conn.Read(buf[:])
+	if n > 0 {
+		earlyTalkers.Inc()
+		log.Printf("dropping early talker %s", c.RemoteAddr())
+		c.Conn.Close()
+		return errEarlyTalker
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		// The client went away during the pause.
+		return err
+	}
+	return c.Conn.SetReadDeadline(time.Time{})
+}
+
+// greetingTimeoutListener drops connections whose first command does not
+// arrive within timeout of the greeting.
+type greetingTimeoutListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+// Accept implements net.Listener
+func (l *greetingTimeoutListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &greetingTimeoutConn{Conn: c, timeout: l.timeout, waiting: true}, nil
+}
+
+// greetingTimeoutConn starts the timeout with the first write, the
+// greeting, and bounds reads by it until a complete command line has been
+// read. Reads and writes both happen on the connection's goroutine.
+type greetingTimeoutConn struct {
+	net.Conn
+	timeout  time.Duration
+	waiting  bool
+	deadline time.Time
+	// requested is the read deadline last set by go-smtp, restored once
+	// the first command is in.
+	requested time.Time
+}
+
+// Write implements net.Conn
+func (c *greetingTimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	// After the write, which may include the -greet-delay pause.
+	if c.waiting && c.deadline.IsZero() {
+		c.deadline = time.Now().Add(c.timeout)
+	}
+	return n, err
+}
+
+// SetReadDeadline implements net.Conn
+func (c *greetingTimeoutConn) SetReadDeadline(t time.Time) error {
+	c.requested = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Read implements net.Conn
+func (c *greetingTimeoutConn) Read(b []byte) (int, error) {
+	if !c.waiting || c.deadline.IsZero() {
+		return c.Conn.Read(b)
+	}
+	// An earlier deadline, such as -idle-timeout, still applies.
+	deadline := c.deadline
+	if !c.requested.IsZero() && c.requested.Before(deadline) {
+		deadline = c.requested
+	}
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	if bytes.IndexByte(b[:n], '\n') >= 0 {
+		c.waiting = false
+		if derr := c.Conn.SetReadDeadline(c.requested); err == nil {
+			err = derr
+		}
+		return n, err
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() && !time.Now().Before(c.deadline) {
+		greetingTimeouts.Inc()
+		log.Printf("dropping %s: no command within %s of the greeting", c.RemoteAddr(), c.timeout)
+		// Closed, so that go-smtp neither handles a partial line read
+		// earlier nor replies after this.
+		c.Conn.Write([]byte("421 4.4.2 No command received in time, closing connection\r\n"))
+		c.Conn.Close()
+		return n, io.EOF
+	}
+	return n, err
+}
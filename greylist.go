@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var greylistResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "greylist_total",
+	Help:      "Total number of greylist checks by result: new and early are deferred, passed is accepted",
+}, []string{"result"})
+
+var greylistSize = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "smtpd",
+	Name:      "greylist_entries",
+	Help:      "Number of (client IP, sender, recipient) triples in the greylist",
+})
+
+// greylistPruneInterval is how often expired entries are dropped and the
+// greylist is saved.
+const greylistPruneInterval = time.Minute
+
+// greylistMaxEntries bounds the triples kept; the least recently seen one
+// is evicted first. Senders and recipients are chosen by the client.
+const greylistMaxEntries = 100000
+
+// Results of greylist.check.
+const (
+	GreylistNew    = "new"    // first attempt, deferred
+	GreylistEarly  = "early"  // retried before the delay elapsed, deferred
+	GreylistPassed = "passed" // retried after the delay, accepted from now on
+)
+
+type greylistEntry struct {
+	key    string    // not saved: the file maps keys to entries
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+	Passed bool      `json:"passed"`
+}
+
+// greylist defers the first delivery attempt of every (client IP, sender,
+// recipient) triple and accepts retries made after delay. Entries are
+// forgotten expiry after they were last seen. With a file, the entries
+// survive restarts.
+type greylist struct {
+	delay  time.Duration
+	expiry time.Duration
+	file   string
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // most recently seen first
+}
+
+// newGreylist creates the greylist, loading the entries saved in file if it
+// exists.
+func newGreylist(delay, expiry time.Duration, file string) (*greylist, error) {
+	g := &greylist{delay: delay, expiry: expiry, file: file, entries: make(map[string]*list.Element), lru: list.New()}
+	if file == "" {
+		return g, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved map[string]*greylistEntry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	// Oldest first, so that the most recently seen end up in front.
+	keys := slices.Collect(maps.Keys(saved))
+	slices.SortFunc(keys, func(a, b string) int { return saved[a].Last.Compare(saved[b].Last) })
+	for _, key := range keys {
+		e := saved[key]
+		e.key = key
+		g.add(e)
+	}
+	g.prune(time.Now())
+	return g, nil
+}
+
+func greylistKey(ip, from, rcpt string) string {
+	return ip + "\x00" + strings.ToLower(from) + "\x00" + strings.ToLower(rcpt)
+}
+
+// check records a delivery attempt and returns its result.
+func (g *greylist) check(ip, from, rcpt string, now time.Time) string {
+	key := greylistKey(ip, from, rcpt)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if el, ok := g.entries[key]; ok {
+		e := el.Value.(*greylistEntry)
+		if now.Sub(e.Last) <= g.expiry {
+			e.Last = now
+			g.lru.MoveToFront(el)
+			if !e.Passed && now.Sub(e.First) < g.delay {
+				return GreylistEarly
+			}
+			e.Passed = true
+			return GreylistPassed
+		}
+		g.remove(el)
+	}
+	g.add(&greylistEntry{key: key, First: now, Last: now})
+	return GreylistNew
+}
+
+// add inserts e as the most recently seen entry, evicting the least
+// recently seen one when the greylist is full. g.mu must be held, or g not
+// yet shared.
+func (g *greylist) add(e *greylistEntry) {
+	g.entries[e.key] = g.lru.PushFront(e)
+	if g.lru.Len() > greylistMaxEntries {
+		g.remove(g.lru.Back())
+	}
+	greylistSize.Set(float64(g.lru.Len()))
+}
+
+// remove drops the entry of el. g.mu must be held.
+func (g *greylist) remove(el *list.Element) {
+	g.lru.Remove(el)
+	delete(g.entries, el.Value.(*greylistEntry).key)
+	greylistSize.Set(float64(g.lru.Len()))
+}
+
+// prune drops the expired entries, which are the least recently seen.
+func (g *greylist) prune(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for el := g.lru.Back(); el != nil && now.Sub(el.Value.(*greylistEntry).Last) > g.expiry; el = g.lru.Back() {
+		g.remove(el)
+	}
+}
+
+// save writes the entries to the file, if any, replacing it atomically.
+func (g *greylist) save() error {
+	if g.file == "" {
+		return nil
+	}
+	g.mu.Lock()
+	saved := make(map[string]*greylistEntry, len(g.entries))
+	for key, el := range g.entries {
+		saved[key] = el.Value.(*greylistEntry)
+	}
+	data, err := json.Marshal(saved)
+	g.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := g.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g.file)
+}
+
+// run prunes and saves the greylist periodically until ctx is done.
+func (g *greylist) run(ctx context.Context) {
+	ticker := time.NewTicker(greylistPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.prune(time.Now())
+			if err := g.save(); err != nil {
+				log.Printf("greylist: saving %s failed: %v", g.file, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkGreylist defers a recipient whose triple has not been seen before or
+// was retried too soon. Authenticated sessions are not greylisted.
+func (s *Session) checkGreylist(to string) error {
+	g := s.backend.greylist
+	if g == nil || s.user != "" {
+		return nil
+	}
+	addr := s.conn.Conn().RemoteAddr().String()
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+	result := g.check(ip, s.from, to, time.Now())
+	greylistResults.With(prometheus.Labels{"result": result}).Inc()
+	if result == GreylistPassed {
+		return nil
+	}
+	s.logf("greylisting %s from %s to %s (%s)", ip, s.from, to, result)
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Greylisted, please try again later",
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGreylistCheck(t *testing.T) {
+	g, err := newGreylist(5*time.Minute, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		after time.Duration // since start
+		from  string
+		want  string
+	}{
+		{0, "a@example.com", GreylistNew},
+		{time.Minute, "a@example.com", GreylistEarly},
+		{time.Minute, "A@EXAMPLE.COM", GreylistEarly}, // case-insensitive
+		{time.Minute, "b@example.com", GreylistNew},   // another triple
+		{5 * time.Minute, "a@example.com", GreylistPassed},
+		{6 * time.Minute, "a@example.com", GreylistPassed},
+		// Forgotten an hour after it was last seen.
+		{6*time.Minute + time.Hour, "a@example.com", GreylistPassed},
+		{6*time.Minute + 2*time.Hour + time.Second, "a@example.com", GreylistNew},
+	}
+	for _, st := range steps {
+		if got := g.check("192.0.2.1", st.from, "rcpt@example.net", start.Add(st.after)); got != st.want {
+			t.Errorf("check(%s) after %s = %s, want %s", st.from, st.after, got, st.want)
+		}
+	}
+}
+
+func TestGreylistPrune(t *testing.T) {
+	g, err := newGreylist(time.Minute, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	g.check("192.0.2.1", "old@example.com", "rcpt@example.net", start)
+	g.check("192.0.2.1", "new@example.com", "rcpt@example.net", start.Add(30*time.Minute))
+	g.prune(start.Add(time.Hour + time.Minute))
+	if _, ok := g.entries[greylistKey("192.0.2.1", "old@example.com", "rcpt@example.net")]; ok {
+		t.Error("expired entry kept")
+	}
+	if _, ok := g.entries[greylistKey("192.0.2.1", "new@example.com", "rcpt@example.net")]; !ok {
+		t.Error("live entry pruned")
+	}
+}
+
+func TestGreylistEviction(t *testing.T) {
+	g, err := newGreylist(time.Minute, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	g.check("192.0.2.1", "first@example.com", "rcpt@example.net", now)
+	g.check("192.0.2.1", "second@example.com", "rcpt@example.net", now)
+	for i := 0; g.lru.Len() < greylistMaxEntries; i++ {
+		g.check("192.0.2.2", fmt.Sprintf("s%d@example.com", i), "rcpt@example.net", now)
+	}
+	// Seen again, first is now the most recent.
+	g.check("192.0.2.1", "first@example.com", "rcpt@example.net", now)
+	g.check("192.0.2.1", "one-more@example.com", "rcpt@example.net", now)
+	if g.lru.Len() != greylistMaxEntries || len(g.entries) != greylistMaxEntries {
+		t.Errorf("greylist holds %d entries (%d in map), want %d", g.lru.Len(), len(g.entries), greylistMaxEntries)
+	}
+	if _, ok := g.entries[greylistKey("192.0.2.1", "second@example.com", "rcpt@example.net")]; ok {
+		t.Error("least recently seen entry still kept")
+	}
+	if _, ok := g.entries[greylistKey("192.0.2.1", "first@example.com", "rcpt@example.net")]; !ok {
+		t.Error("recently seen entry evicted")
+	}
+}
+
+func TestGreylistFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "greylist.json")
+	g, err := newGreylist(time.Minute, time.Hour, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	g.check("192.0.2.1", "passed@example.com", "rcpt@example.net", now.Add(-10*time.Minute))
+	g.check("192.0.2.1", "passed@example.com", "rcpt@example.net", now.Add(-5*time.Minute))
+	g.check("192.0.2.1", "pending@example.com", "rcpt@example.net", now)
+	g.check("192.0.2.1", "expired@example.com", "rcpt@example.net", now.Add(-2*time.Hour))
+	if err := g.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err = newGreylist(time.Minute, time.Hour, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.lru.Len() != 2 {
+		t.Errorf("restored %d entries, want 2", g.lru.Len())
+	}
+	// Restored most recently seen first.
+	if e := g.lru.Back().Value.(*greylistEntry); e.key != greylistKey("192.0.2.1", "passed@example.com", "rcpt@example.net") {
+		t.Errorf("least recently seen entry is %q", e.key)
+	}
+	if got := g.check("192.0.2.1", "passed@example.com", "rcpt@example.net", now); got != GreylistPassed {
+		t.Errorf("restored passed triple = %s, want %s", got, GreylistPassed)
+	}
+	if got := g.check("192.0.2.1", "pending@example.com", "rcpt@example.net", now.Add(30*time.Second)); got != GreylistEarly {
+		t.Errorf("restored pending triple = %s, want %s", got, GreylistEarly)
+	}
+	if got := g.check("192.0.2.1", "expired@example.com", "rcpt@example.net", now); got != GreylistNew {
+		t.Errorf("expired triple = %s, want %s", got, GreylistNew)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// headerField is one header field of a message, including any folded
+// continuation lines and the trailing line ending, exactly as received.
+type headerField struct {
+	name string
+	raw  []byte
+}
+
+// value returns the unfolded field value with surrounding whitespace removed.
+func (f headerField) value() string {
+	_, v, _ := bytes.Cut(f.raw, []byte(":"))
+	v = bytes.ReplaceAll(v, []byte("\r\n"), nil)
+	v = bytes.ReplaceAll(v, []byte("\n"), nil)
+	return strings.TrimSpace(string(v))
+}
+
+// splitHeader splits a message into its header fields and the remainder,
+// which starts with the blank line separating header and body (or is empty
+// for a header-only message). Concatenating the raw fields and the remainder
+// yields the original message.
+func splitHeader(data []byte) (fields []headerField, rest []byte) {
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		line := data[:end]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields, data
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			// Folded continuation: raw is a subslice of the message, so
+			// extending it over the next line keeps it contiguous.
+			last := &fields[len(fields)-1]
+			last.raw = last.raw[:len(last.raw)+len(line)]
+		} else {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			fields = append(fields, headerField{
+				name: strings.TrimSpace(string(name)),
+				raw:  line,
+			})
+		}
+		data = data[end:]
+	}
+	return fields, nil
+}
+
+// lineEnding returns the line ending used by the message header.
+func lineEnding(data []byte) string {
+	if i := bytes.IndexByte(data, '\n'); i > 0 && data[i-1] == '\r' {
+		return "\r\n"
+	} else if i >= 0 {
+		return "\n"
+	}
+	return "\r\n"
+}
+
+// getHeader returns the value of the first field called name.
+func getHeader(fields []headerField, name string) (string, bool) {
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f.value(), true
+		}
+	}
+	return "", false
+}
+
+// prependHeader returns data with "name: value" added as the first field.
+func prependHeader(data []byte, name, value string) []byte {
+	line := name + ": " + value + lineEnding(data)
+	out := make([]byte, 0, len(line)+len(data))
+	out = append(out, line...)
+	return append(out, data...)
+}
+
+// measureHeader returns the number of header fields (folded continuation
+// lines count towards their field) and the header size in bytes, excluding
+// the separating blank line. It does not allocate, so it is safe to run on
+// abusive input before any further parsing.
+func measureHeader(data []byte) (count, size int) {
+	for size < len(data) {
+		end := bytes.IndexByte(data[size:], '\n') + 1
+		if end == 0 {
+			end = len(data) - size
+		}
+		line := data[size : size+end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' || count == 0 {
+			count++
+		}
+		size += end
+	}
+	return count, size
+}
+
+// stripBccHeaders removes blind copy headers from the message, as a
+// submission agent would, so they do not reach the other recipients.
+func (s *Session) stripBccHeaders() {
+	for _, name := range []string{"Bcc", "Resent-Bcc"} {
+		if s.removeField(name) {
+			s.logf("removed %s header from message from %s", name, s.from)
+		}
+	}
+}
+
+// Policies for -add-header-policy.
+const (
+	AddHeaderMissing = "missing" // add only if the message has no such field
+	AddHeaderAlways  = "always"  // add next to any existing fields
+	AddHeaderReplace = "replace" // remove existing fields, then add
+)
+
+// customHeader is a field added to every message with -add-header.
+type customHeader struct {
+	name  string
+	value string
+}
+
+// customHeaderFlags implements flag.Value for the repeatable -add-header
+// flag. Each value has the form "Name: value".
+type customHeaderFlags []customHeader
+
+func (f *customHeaderFlags) String() string {
+	parts := make([]string, 0, len(*f))
+	for _, h := range *f {
+		parts = append(parts, h.name+": "+h.value)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (f *customHeaderFlags) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	name, v = strings.TrimSpace(name), strings.TrimSpace(v)
+	if !ok || name == "" {
+		return fmt.Errorf("expected \"Name: value\", got %q", value)
+	}
+	for _, c := range name {
+		if c < 33 || c > 126 {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	if strings.ContainsAny(v, "\r\n") {
+		return fmt.Errorf("header value for %s must be a single line", name)
+	}
+	*f = append(*f, customHeader{name: name, value: v})
+	return nil
+}
+
+// foldHeader formats "name: value" with the line ending eol, folding at
+// whitespace so that lines stay within 78 characters where possible.
+func foldHeader(name, value, eol string) string {
+	var b strings.Builder
+	line := name + ":"
+	for _, word := range strings.Fields(value) {
+		if len(line)+1+len(word) > 78 && len(line) > len(name)+1 {
+			b.WriteString(line + eol)
+			line = ""
+		}
+		line += " " + word
+	}
+	b.WriteString(line + eol)
+	return b.String()
+}
+
+// addCustomHeaders inserts the -add-header fields at the top of the message,
+// in the order given, applying -add-header-policy to fields the message
+// already has. Under the missing policy only the first of several
+// -add-header fields of one name is added. Existing fields are otherwise
+// left untouched.
+func (s *Session) addCustomHeaders() {
+	headers := s.backend.customHeaders
+	if len(headers) == 0 {
+		return
+	}
+	fields, _ := splitHeader(s.data)
+	eol := lineEnding(s.data)
+
+	var block strings.Builder
+	removed := make(map[string]bool)
+	added := make(map[string]bool)
+	for _, h := range headers {
+		key := strings.ToLower(h.name)
+		_, present := getHeader(fields, h.name)
+		switch s.backend.customHeaderPolicy {
+		case AddHeaderAlways:
+		case AddHeaderReplace:
+			if present && !removed[key] {
+				s.removeField(h.name)
+				removed[key] = true
+			}
+		default:
+			// Fields added earlier in the loop count as present too.
+			if present || added[key] {
+				continue
+			}
+		}
+		added[key] = true
+		block.WriteString(foldHeader(h.name, h.value, eol))
+	}
+	if block.Len() == 0 {
+		return
+	}
+	s.prependFields(block.String())
+}
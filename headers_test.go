@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripBccHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "single",
+			in:   "From: a@example.com\r\nBcc: hidden@example.net\r\nSubject: hi\r\n\r\nBcc: body line\r\n",
+			want: "From: a@example.com\r\nSubject: hi\r\n\r\nBcc: body line\r\n",
+		},
+		{
+			name: "folded",
+			in:   "From: a@example.com\r\nbcc: one@example.net,\r\n two@example.net,\r\n\tthree@example.net\r\nTo: b@example.org\r\n\r\nbody\r\n",
+			want: "From: a@example.com\r\nTo: b@example.org\r\n\r\nbody\r\n",
+		},
+		{
+			name: "several",
+			in:   "Bcc: one@example.net\nFrom: a@example.com\nResent-Bcc: two@example.net\nBcc: three@example.net\n\nbody\n",
+			want: "From: a@example.com\n\nbody\n",
+		},
+		{
+			name: "none",
+			in:   "From: a@example.com\r\nTo: b@example.org\r\nX-Bcc-Note: kept\r\n\r\nbody\r\n",
+			want: "From: a@example.com\r\nTo: b@example.org\r\nX-Bcc-Note: kept\r\n\r\nbody\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession(t, &Backend{stripBcc: true}, tt.in)
+			s.stripBccHeaders()
+			if got := string(s.data); got != tt.want {
+				t.Errorf("stripBccHeaders:\n got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddCustomHeaders(t *testing.T) {
+	const msg = "From: a@example.com\r\nX-Env: staging\r\nSubject: hi\r\n\r\nX-Env: body\r\n"
+	headers := customHeaderFlags{
+		{name: "X-Env", value: "production"},
+		{name: "X-Relay", value: "ses-smtpd-relay"},
+		{name: "x-relay", value: "second"},
+	}
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{
+			policy: AddHeaderMissing,
+			want:   "X-Relay: ses-smtpd-relay\r\nFrom: a@example.com\r\nX-Env: staging\r\nSubject: hi\r\n\r\nX-Env: body\r\n",
+		},
+		{
+			policy: AddHeaderAlways,
+			want:   "X-Env: production\r\nX-Relay: ses-smtpd-relay\r\nx-relay: second\r\nFrom: a@example.com\r\nX-Env: staging\r\nSubject: hi\r\n\r\nX-Env: body\r\n",
+		},
+		{
+			policy: AddHeaderReplace,
+			want:   "X-Env: production\r\nX-Relay: ses-smtpd-relay\r\nx-relay: second\r\nFrom: a@example.com\r\nSubject: hi\r\n\r\nX-Env: body\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			s := newTestSession(t, &Backend{customHeaders: headers, customHeaderPolicy: tt.policy}, msg)
+			s.addCustomHeaders()
+			if got := string(s.data); got != tt.want {
+				t.Errorf("addCustomHeaders:\n got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddCustomHeadersFolding(t *testing.T) {
+	value := strings.Repeat("word ", 30)
+	s := newTestSession(t, &Backend{customHeaders: customHeaderFlags{{name: "X-Long", value: value}}}, "From: a@example.com\n\nbody\n")
+	s.addCustomHeaders()
+	header, rest, _ := strings.Cut(string(s.data), "From:")
+	if rest != " a@example.com\n\nbody\n" {
+		t.Errorf("message after added header = %q", rest)
+	}
+	lines := strings.Split(strings.TrimSuffix(header, "\n"), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("header not folded: %q", header)
+	}
+	for i, line := range lines {
+		if len(line) > 78 {
+			t.Errorf("line %d is %d characters: %q", i, len(line), line)
+		}
+		if i > 0 && !strings.HasPrefix(line, " ") {
+			t.Errorf("continuation line %d does not start with whitespace: %q", i, line)
+		}
+	}
+	if got := strings.Join(strings.Fields(strings.TrimPrefix(header, "X-Long:")), " "); got != strings.TrimSpace(value) {
+		t.Errorf("unfolded value = %q", got)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+// warmupRetryInterval is the pause between failed warmup SES checks.
+const warmupRetryInterval = 5 * time.Second
+
+// healthStatus is the JSON body served by the health endpoints.
+type healthStatus struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Version string `json:"version"`
+}
+
+func writeHealth(w http.ResponseWriter, code int, status string) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(healthStatus{Name: "ses-smtpd-relay", Status: status, Version: version})
+}
+
+// ready reports whether the relay should receive traffic and, if not, why.
+func (b *Backend) ready() (bool, string) {
+	if b.warming.Load() {
+		return false, "warming up"
+	}
+	if b.draining.Load() {
+		return false, "draining"
+	}
+	if b.accountPause.isPaused() {
+		return false, "SES account sending paused"
+	}
+	return true, "ok"
+}
+
+// warmup keeps the relay not ready for delay and, if checkSES is set, until
+// a GetSendQuota call has succeeded.
+func (b *Backend) warmup(ctx context.Context, client *ses.Client, delay time.Duration, checkSES bool) {
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return
+	}
+	for checkSES {
+		reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		_, err := client.GetSendQuota(reqCtx, &ses.GetSendQuotaInput{})
+		cancel()
+		if err == nil {
+			break
+		}
+		log.Printf("warmup: SES quota check failed, still not ready: %v", err)
+		select {
+		case <-time.After(warmupRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+	b.warming.Store(false)
+	log.Printf("warmup complete, relay is ready")
+}
+
+// registerHealthHandlers adds the liveness and readiness endpoints.
+func (b *Backend) registerHealthHandlers(sm *http.ServeMux) {
+	sm.Handle("/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, "ok")
+	}))
+	sm.Handle("/readyz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, status := b.ready(); !ok {
+			writeHealth(w, http.StatusServiceUnavailable, status)
+			return
+		}
+		writeHealth(w, http.StatusOK, "ok")
+	}))
+}
+
+// registerAdminHandlers adds the operational endpoints, protected by auth.
+func (b *Backend) registerAdminHandlers(sm *http.ServeMux, auth *adminAuth) {
+	sm.Handle("/admin/drain", requireAdmin(auth, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		b.draining.Store(true)
+		log.Printf("admin: drain requested by %s, refusing new mail", r.RemoteAddr)
+		writeHealth(w, http.StatusOK, "draining")
+	}))
+	sm.Handle("/admin/undrain", requireAdmin(auth, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		b.draining.Store(false)
+		log.Printf("admin: undrain requested by %s, accepting mail", r.RemoteAddr)
+		writeHealth(w, http.StatusOK, "ok")
+	}))
+	sm.Handle("/admin/config", requireAdmin(auth, http.MethodGet, b.serveConfig))
+	sm.Handle("GET /admin/config-set", requireAdmin(auth, http.MethodGet, b.serveConfigSet))
+	sm.Handle("POST /admin/config-set", requireAdmin(auth, http.MethodPost, b.setConfigSet))
+}
+
+// requireAdmin wraps h so that it only runs for method, a matching
+// "Authorization: Bearer <token>" header and, with -admin-secret, a valid
+// request signature.
+func requireAdmin(auth *adminAuth, method string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(auth.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := auth.verify(r); err != nil {
+			log.Printf("admin: refusing %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, "invalid request signature", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// resolveListenAddr validates addr for the given network ("tcp", "tcp4" or
+// "tcp6") and returns the network and address to pass to net.Listen.
+//
+// IPv6 literals must be bracketed ("[::1]:2500"); an empty host (":2500")
+// binds every address of the selected family, which for "tcp" means
+// dual-stack.
+func resolveListenAddr(network, addr string) (string, string, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return "", "", fmt.Errorf("unsupported listen network %q (want tcp, tcp4 or tcp6)", network)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+			return "", "", fmt.Errorf("invalid listen address %q: IPv6 literals must be bracketed, e.g. [%s]:2500", addr, addr)
+		}
+		return "", "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if port == "" {
+		return "", "", fmt.Errorf("invalid listen address %q: missing port", addr)
+	}
+
+	if host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			isV4 := ip.To4() != nil
+			if network == "tcp4" && !isV4 {
+				return "", "", fmt.Errorf("listen address %q is IPv6 but network is tcp4", addr)
+			}
+			if network == "tcp6" && isV4 {
+				return "", "", fmt.Errorf("listen address %q is IPv4 but network is tcp6", addr)
+			}
+		}
+	}
+
+	return network, net.JoinHostPort(host, port), nil
+}
+
+// listen resolves addr for network and opens a listener on it.
+func listen(network, addr string) (net.Listener, error) {
+	network, addr, err := resolveListenAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen(network, addr)
+}
+
+// writePortFile writes the port of each listener, one per line in -listen
+// order, to path. The file is replaced atomically so a reader never sees it
+// partially written.
+func writePortFile(path string, listeners []net.Listener) error {
+	var b strings.Builder
+	for _, l := range listeners {
+		_, port, err := net.SplitHostPort(l.Addr().String())
+		if err != nil {
+			return err
+		}
+		b.WriteString(port + "\n")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// DefaultTenant is the tenant label used by listeners without one.
+const DefaultTenant = "default"
+
+// Tenant names become metric label values, keep them short and simple.
+var tenantNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// listenerConfig describes one SMTP listener. The TLS fields override the
+// global TLS settings for this listener.
+type listenerConfig struct {
+	addr   string
+	tenant string
+
+	tlsCert    string
+	tlsKey     string
+	noTLS      bool
+	requireTLS *bool // nil uses -require-tls
+
+	proxyProtocol *bool // nil uses -proxy-protocol
+}
+
+// listenerFlags implements flag.Value for the repeatable -listen flag. Each
+// value has the form "addr[,tenant=NAME][,tls-cert=FILE,tls-key=FILE]
+// [,no-tls][,require-tls[=BOOL]][,proxy-protocol[=BOOL]]".
+type listenerFlags []listenerConfig
+
+func (f *listenerFlags) String() string {
+	parts := make([]string, 0, len(*f))
+	for _, l := range *f {
+		parts = append(parts, l.addr+",tenant="+l.tenant)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f *listenerFlags) Set(value string) error {
+	fields := strings.Split(value, ",")
+	l := listenerConfig{addr: strings.TrimSpace(fields[0]), tenant: DefaultTenant}
+	if l.addr == "" {
+		return fmt.Errorf("missing listen address in %q", value)
+	}
+	for _, opt := range fields[1:] {
+		key, val, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "tenant":
+			if !tenantNameRe.MatchString(val) {
+				return fmt.Errorf("invalid tenant name %q", val)
+			}
+			l.tenant = val
+		case "tls-cert":
+			l.tlsCert = val
+		case "tls-key":
+			l.tlsKey = val
+		case "no-tls":
+			l.noTLS = true
+		case "require-tls", "proxy-protocol":
+			on := true
+			if val != "" {
+				var err error
+				if on, err = strconv.ParseBool(val); err != nil {
+					return fmt.Errorf("invalid %s value %q", key, val)
+				}
+			}
+			if key == "require-tls" {
+				l.requireTLS = &on
+			} else {
+				l.proxyProtocol = &on
+			}
+		default:
+			return fmt.Errorf("unknown listener option %q", key)
+		}
+	}
+	if (l.tlsCert == "") != (l.tlsKey == "") {
+		return fmt.Errorf("listener %s needs both tls-cert and tls-key", l.addr)
+	}
+	if l.noTLS && (l.tlsCert != "" || (l.requireTLS != nil && *l.requireTLS)) {
+		return fmt.Errorf("listener %s: no-tls conflicts with tls-cert and require-tls", l.addr)
+	}
+	*f = append(*f, l)
+	return nil
+}
+
+// listenerTLS returns the TLS configuration of the listener and whether it
+// requires TLS, given the global configuration. A listener requiring TLS
+// must have a certificate.
+func (l listenerConfig) listenerTLS(global *tls.Config, opts tlsOptions, requireDefault bool) (*tls.Config, bool, error) {
+	cfg := global
+	if l.tlsCert != "" {
+		opts.certFile, opts.keyFile = l.tlsCert, l.tlsKey
+		var err error
+		if cfg, err = buildTLSConfig(opts); err != nil {
+			return nil, false, err
+		}
+	}
+	if l.noTLS {
+		cfg = nil
+	}
+	require := requireDefault
+	if l.requireTLS != nil {
+		require = *l.requireTLS
+	}
+	if require && cfg == nil {
+		return nil, false, fmt.Errorf("TLS is required but no certificate is configured")
+	}
+	return cfg, require, nil
+}
+
+// proxyProtocolEnabled reports whether the listener expects PROXY protocol
+// headers, given the -proxy-protocol default.
+func (l listenerConfig) proxyProtocolEnabled(def bool) bool {
+	if l.proxyProtocol != nil {
+		return *l.proxyProtocol
+	}
+	return def
+}
+
+// listenerBackend tags sessions with the tenant and TLS requirement of the
+// listener they were accepted on.
+type listenerBackend struct {
+	*Backend
+	tenant     string
+	requireTLS bool
+}
+
+// NewSession implements smtp.Backend
+func (b *listenerBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return b.newSession(c, b.tenant, b.requireTLS)
+}
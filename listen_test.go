@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestResolveListenAddr(t *testing.T) {
+	tests := []struct {
+		network, addr string
+		wantNetwork   string
+		wantAddr      string
+		wantErr       bool
+	}{
+		{"tcp", ":2500", "tcp", ":2500", false},
+		{"tcp", "[::1]:2500", "tcp", "[::1]:2500", false},
+		{"tcp6", "[::1]:2500", "tcp6", "[::1]:2500", false},
+		{"tcp4", "127.0.0.1:2500", "tcp4", "127.0.0.1:2500", false},
+		{"tcp4", "[::1]:2500", "", "", true},
+		{"tcp6", "127.0.0.1:2500", "", "", true},
+		{"tcp", "::1", "", "", true},
+		{"tcp", "127.0.0.1:", "", "", true},
+		{"udp", ":2500", "", "", true},
+	}
+	for _, tt := range tests {
+		network, addr, err := resolveListenAddr(tt.network, tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveListenAddr(%q, %q) error = %v, want error %t", tt.network, tt.addr, err, tt.wantErr)
+			continue
+		}
+		if network != tt.wantNetwork || addr != tt.wantAddr {
+			t.Errorf("resolveListenAddr(%q, %q) = %q, %q, want %q, %q", tt.network, tt.addr, network, addr, tt.wantNetwork, tt.wantAddr)
+		}
+	}
+}
+
+func TestListenIPv6Loopback(t *testing.T) {
+	for _, network := range []string{"tcp", "tcp6"} {
+		l, err := listen(network, "[::1]:0")
+		if err != nil {
+			t.Skipf("IPv6 loopback unavailable: %v", err)
+		}
+		got, ok := l.Addr().(*net.TCPAddr)
+		l.Close()
+		if !ok || !got.IP.Equal(net.IPv6loopback) || got.Port == 0 {
+			t.Errorf("%s listener bound to %v, want [::1] with a port", network, l.Addr())
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var classRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "class_rate_limited_total",
+	Help:      "Total number of messages deferred by -class-rate-limit, by mail class",
+}, []string{"class"})
+
+// Mail classes derived from the Precedence header.
+const (
+	MailClassBulk          = "bulk"
+	MailClassTransactional = "transactional"
+)
+
+// mailClass classifies the message for -class-rate-limit. A non-empty
+// classHeader field gives the class, lowercased; otherwise Precedence bulk,
+// list or junk makes the message bulk and anything else transactional.
+func mailClass(data []byte, classHeader string) string {
+	fields, _ := splitHeader(data)
+	if classHeader != "" {
+		if v, ok := getHeader(fields, classHeader); ok && strings.TrimSpace(v) != "" {
+			return strings.ToLower(strings.TrimSpace(v))
+		}
+	}
+	v, _ := getHeader(fields, "Precedence")
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "bulk", "list", "junk":
+		return MailClassBulk
+	}
+	return MailClassTransactional
+}
+
+// checkClassRateLimit defers the message if its class is over its
+// -class-rate-limit. Classes without a limit are not paced.
+func (s *Session) checkClassRateLimit() error {
+	l := s.backend.classLimiter
+	if l == nil {
+		return nil
+	}
+	class := mailClass(s.data, s.backend.classHeader)
+	if ok, _ := l.allow([]string{class}, time.Now()); ok {
+		return nil
+	}
+	classRateLimited.With(prometheus.Labels{"class": class}).Inc()
+	emailError.With(prometheus.Labels{"type": "class rate limited", "tenant": s.tenant}).Inc()
+	s.logf("deferring %s message from %s, class rate limit exceeded", class, s.from)
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Sending rate limit for " + class + " mail exceeded. Please try again later",
+	}
+}
+
+// refundClassRateLimit gives back the token checkClassRateLimit took, for a
+// message a later check refused.
+func (s *Session) refundClassRateLimit() {
+	if l := s.backend.classLimiter; l != nil {
+		l.refund([]string{mailClass(s.data, s.backend.classHeader)}, time.Now())
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestMailClass(t *testing.T) {
+	tests := []struct {
+		header, classHeader, want string
+	}{
+		{"Subject: hi\r\n", "", MailClassTransactional},
+		{"Precedence: bulk\r\n", "", MailClassBulk},
+		{"Precedence: List\r\n", "", MailClassBulk},
+		{"Precedence: first-class\r\n", "", MailClassTransactional},
+		{"X-Mail-Class: Newsletter\r\nPrecedence: bulk\r\n", "X-Mail-Class", "newsletter"},
+		{"X-Mail-Class: \r\nPrecedence: bulk\r\n", "X-Mail-Class", MailClassBulk},
+		{"Precedence: junk\r\n", "X-Mail-Class", MailClassBulk},
+	}
+	for _, tt := range tests {
+		if got := mailClass([]byte(tt.header+"\r\nbody\r\n"), tt.classHeader); got != tt.want {
+			t.Errorf("mailClass(%q, %q) = %q, want %q", tt.header, tt.classHeader, got, tt.want)
+		}
+	}
+}
+
+func TestClassRateLimit(t *testing.T) {
+	b := newTestBackend(t, &fakeSender{})
+	b.classLimiter = newRateLimiter(map[string]float64{MailClassBulk: 0.001})
+	bulk := newTestSession(t, b, "Precedence: bulk\r\n\r\nbody\r\n")
+	transactional := newTestSession(t, b, testMessage)
+
+	if err := bulk.checkClassRateLimit(); err != nil {
+		t.Fatalf("first bulk message: %v", err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := bulk.checkClassRateLimit(); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("second bulk message: %v, want 451", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := transactional.checkClassRateLimit(); err != nil {
+			t.Fatalf("transactional message %d: %v, want no limit", i, err)
+		}
+	}
+
+	// A refunded token can be taken again.
+	bulk.refundClassRateLimit()
+	if err := bulk.checkClassRateLimit(); err != nil {
+		t.Errorf("bulk message after a refund: %v", err)
+	}
+	bulk.refundClassRateLimit()
+	bulk.refundClassRateLimit()
+	if ok, _ := b.classLimiter.allow([]string{MailClassBulk}, time.Now()); !ok {
+		t.Fatal("refunded token missing")
+	}
+	if ok, _ := b.classLimiter.allow([]string{MailClassBulk}, time.Now()); ok {
+		t.Error("refunds filled the bucket over its size")
+	}
+}
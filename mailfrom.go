@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var missingMailFrom = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "missing_mail_from_total",
+	Help:      "Total number of commands rejected for lack of a usable MAIL FROM, by reason: no_mail, null_sender or no_bounce_source",
+}, []string{"reason"})
+
+// checkMailGiven refuses command (RCPT or DATA) when the transaction has no
+// MAIL FROM. go-smtp enforces the command order itself; this keeps a
+// message from ever reaching SES without an envelope sender should that
+// change. A null sender (MAIL FROM:<>) is a valid MAIL FROM.
+func (s *Session) checkMailGiven(command string) error {
+	if s.hasMail {
+		return nil
+	}
+	missingMailFrom.With(prometheus.Labels{"reason": "no_mail"}).Inc()
+	emailError.With(prometheus.Labels{"type": "missing mail from", "tenant": s.tenant}).Inc()
+	s.logf("%s without MAIL FROM from %s", command, s.conn.Conn().RemoteAddr())
+	return &smtp.SMTPError{
+		Code:         503,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "Need MAIL before " + command,
+	}
+}
+
+// checkBounceSource refuses a null sender MAIL FROM when there is no Source
+// to send it with. SES would take the From header instead, so bounces of a
+// bounce would leave with a non-null return path and could loop.
+func (s *Session) checkBounceSource(from string) error {
+	if from != "" || s.backend.acceptsNullSender() {
+		return nil
+	}
+	missingMailFrom.With(prometheus.Labels{"reason": "no_bounce_source"}).Inc()
+	emailError.With(prometheus.Labels{"type": "null sender", "tenant": s.tenant}).Inc()
+	s.logf("refusing null sender from %s, no -bounce-source is set", s.conn.Conn().RemoteAddr())
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Null sender not accepted on this relay",
+	}
+}
+
+// checkNullSender refuses templated messages with a null sender: SES needs
+// a From address for them, while raw messages take it from the From header.
+func (s *Session) checkNullSender() error {
+	if s.from != "" {
+		return nil
+	}
+	missingMailFrom.With(prometheus.Labels{"reason": "null_sender"}).Inc()
+	emailError.With(prometheus.Labels{"type": "null sender", "tenant": s.tenant}).Inc()
+	s.logf("refusing templated message with a null sender")
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 7},
+		Message:      "Templated messages need a sender address",
+	}
+}
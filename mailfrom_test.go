@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"testing"
+)
+
+func TestNullSender(t *testing.T) {
+	tests := []struct {
+		name         string
+		sourceMode   string
+		returnPath   string
+		bounceSource string
+		wantCode     int // 0 for accepted
+		wantSource   string
+	}{
+		{name: "refused", wantCode: 550},
+		{name: "header mode refused", sourceMode: SourceHeader, wantCode: 550},
+		{name: "bounce source", bounceSource: "bounces@example.com", wantSource: "bounces@example.com"},
+		{name: "header mode bounce source", sourceMode: SourceHeader, bounceSource: "bounces@example.com", wantSource: "bounces@example.com"},
+		{name: "fixed", sourceMode: SourceFixed, returnPath: "rp@example.com", wantSource: "rp@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{messageID: "0100-test"}
+			b := newTestBackend(t, sender)
+			b.sourceMode, b.returnPath, b.bounceSource = tt.sourceMode, tt.returnPath, tt.bounceSource
+			c, err := netsmtp.Dial(startTestServer(t, b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			err = c.Mail("")
+			if tt.wantCode != 0 {
+				var tpErr *textproto.Error
+				if !errors.As(err, &tpErr) || tpErr.Code != tt.wantCode {
+					t.Fatalf("MAIL FROM:<> = %v, want %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MAIL FROM:<>: %v", err)
+			}
+			if err := c.Rcpt("rcpt@example.net"); err != nil {
+				t.Fatal(err)
+			}
+			w, err := c.Data()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(testMessage))
+			if err := w.Close(); err != nil {
+				t.Fatalf("DATA: %v", err)
+			}
+			if calls := sender.sent(); len(calls) != 1 || calls[0].from != tt.wantSource {
+				t.Errorf("SendRaw calls %+v, want one with Source %s", calls, tt.wantSource)
+			}
+		})
+	}
+}
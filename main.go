@@ -2,21 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/ses"
-	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -31,67 +42,462 @@ const (
 )
 
 var (
-	emailSent = promauto.NewCounter(prometheus.CounterOpts{
+	emailSent = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "smtpd",
 		Name:      "email_send_success_total",
 		Help:      "Total number of successfuly sent emails",
-	})
+	}, []string{"tenant"})
 	emailError = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "smtpd",
 		Name:      "email_send_fail_total",
 		Help:      "Total number emails that failed to send",
-	}, []string{"type"})
+	}, []string{"type", "tenant"})
 	sesError = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: "smtpd",
 		Name:      "ses_error_total",
 		Help:      "Total number errors with SES",
 	})
+	phaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "smtpd",
+		Name:      "phase_duration_seconds",
+		Help:      "Time spent in each phase of a transaction",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14), // 5ms to ~41s
+	}, []string{"phase"})
+	connectionMessageCap = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "connection_message_cap_total",
+		Help:      "Total number of connections that reached -max-messages-per-connection",
+	})
+	rcptAttemptsExceeded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "rcpt_attempts_exceeded_total",
+		Help:      "Total number of connections dropped for exceeding -max-rcpt-attempts",
+	})
+	recipientsPerMessage = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "smtpd",
+		Name:      "recipients_per_message",
+		Help:      "Number of envelope recipients per message",
+		Buckets:   []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}, // SES allows 50 per call
+	})
 )
 
 // Backend implements smtp.Backend
 type Backend struct {
-	sesClient         *ses.Client
-	configSetName     *string
+	// ctx is cancelled when the relay shuts down; use context().
+	ctx context.Context
+
+	sender    Sender
+	templates *templateSender
+	xoauth2   *xoauth2Authenticator
+
+	// configSetName is the configuration set of messages without a user
+	// set, nil for none. POST /admin/config-set replaces it at runtime.
+	configSetName atomic.Pointer[string]
+	// sesClients holds the default account's client followed by one per
+	// routed account, used by the admin API to validate configuration sets.
+	sesClients []*ses.Client
+
+	// userConfigSets maps lower-cased authenticated users to their
+	// configuration set, overriding configSetName.
+	userConfigSets map[string]string
+
+	// rejectAuth offers AUTH PLAIN only to refuse it; requireAuth refuses
+	// MAIL FROM before a successful XOAUTH2 authentication.
+	rejectAuth  bool
+	requireAuth bool
+	// authMechanisms restricts the offered mechanisms, nil offers all
+	// configured ones.
+	authMechanisms authPolicy
+	// authFailureUsers labels AUTH failures by user, nil unless
+	// -auth-metrics-per-user is set.
+	authFailureUsers *authFailureUsers
+
+	// routes maps sender domains to the Sender of their SES account;
+	// rejectUnrouted refuses other domains instead of using sender.
+	routes         map[string]Sender
+	rejectUnrouted bool
+
+	// enforceDeclaredSize rejects messages larger than the SIZE declared in
+	// MAIL FROM by more than declaredSizeTolerance percent.
+	enforceDeclaredSize   bool
+	declaredSizeTolerance int
+
+	// breaker fails SES sends fast during outages, nil when disabled.
+	breaker *circuitBreaker
+	// sandbox rejects unverified recipients while the account is in the
+	// SES sandbox, nil when disabled.
+	sandbox *sandboxChecker
+	// greylist defers first-time (client IP, sender, recipient) triples,
+	// nil when disabled.
+	greylist *greylist
+	// capture samples relayed messages to a directory, nil when disabled.
+	capture *messageCapture
+	// fallback receives messages SES rejected permanently, nil when
+	// disabled.
+	fallback *fallbackRelay
+	// maintenance lists the windows during which mail is deferred.
+	maintenance maintenanceSchedule
+	// transactionTimeout bounds a DATA transaction from the start of the
+	// message to the SES reply, 0 disables it.
+	transactionTimeout time.Duration
+	// throttleReplies replace the default replies to SES throttling, by
+	// throttleRate or throttleQuota.
+	throttleReplies map[string]*smtp.SMTPError
+	// accountPause tracks SES pausing the default account's sending.
+	accountPause *accountPause
+
+	// sendScheduler caps the concurrent SES sends, nil when unlimited.
+	sendScheduler *fairScheduler
+	// sendPriorities orders messages waiting for the sendScheduler, nil
+	// to treat all alike.
+	sendPriorities *sendPriorities
+	// ipLimiter caps the concurrent connections per client IP, nil when
+	// -max-connections-per-ip is not set.
+	ipLimiter *ipConnLimiter
+	// idleTimeout closes connections without a command for that long, 0
+	// disables it.
+	idleTimeout time.Duration
+	// domainLimiter paces messages per recipient domain, nil when no
+	// -domain-rate-limit is set.
+	domainLimiter *rateLimiter
+	// classLimiter paces messages per mail class, classified by
+	// classHeader or Precedence; nil when no -class-rate-limit is set.
+	classLimiter *rateLimiter
+	classHeader  string
+	// outbox keeps recently sent messages for /outbox, nil when disabled.
+	outbox *outbox
+	// shadow mirrors raw sends to a second SES account, nil when disabled.
+	shadow *shadowSender
+	// batchSpool retries failed batches under -batch-failure-policy spool.
+	batchSpool *batchSpool
+	// events publishes send events to -event-queue-url.
+	events *eventPublisher
+	// byteBudget caps the message bytes sent per window, nil when
+	// disabled.
+	byteBudget *byteBudget
+	// costRates estimate the SES charges of sent messages.
+	costRates sesCostRates
+	// bufferBudget caps the message buffers held by all sessions at once,
+	// nil when disabled.
+	bufferBudget *bufferBudget
+	// reputation pauses sending while a CloudWatch alarm fires, nil when
+	// disabled.
+	reputation *reputationMonitor
+
+	// acceptGzip transparently decompresses gzip compressed DATA.
+	acceptGzip bool
+
+	// maxMessagesPerConn limits the messages per connection, 0 for no limit.
+	maxMessagesPerConn int
+
+	// maxRcptAttempts limits RCPT commands per transaction, 0 for no limit.
+	maxRcptAttempts int
+
+	// maxHeaderCount and maxHeaderBytes bound the message header, 0
+	// disables the respective check.
+	maxHeaderCount int
+	maxHeaderBytes int
+
+	// minMessageSize rejects smaller messages, 0 disables the check.
+	minMessageSize int
+
+	// trackingHeader names the header carrying the tracking ID, empty to
+	// not add one; trackingOverwrite replaces an existing value.
+	trackingHeader    string
+	trackingOverwrite bool
+
+	// logPerRecipient logs one record per recipient on success.
+	logPerRecipient bool
+	// logPolicyDecisions logs the outcome of each policy check.
+	logPolicyDecisions bool
+
+	// attachments blocks attachment types, nil when no policy is set.
+	attachments *attachmentPolicy
+
+	// redirectAllTo replaces the recipients of every message, for
+	// non-production environments.
+	redirectAllTo string
+
+	// testRecipients lets the X-Test-Recipients header replace the
+	// envelope recipients of raw messages, for load tests in the sandbox.
+	testRecipients bool
+
+	// exemplars attaches the tracking ID to send latency observations.
+	exemplars bool
+
+	// replyMessageID includes the SES message ID in the DATA reply.
+	replyMessageID bool
+
+	// stripBcc removes Bcc and Resent-Bcc headers before sending.
+	stripBcc bool
+
+	// customHeaders are added to every message according to
+	// customHeaderPolicy.
+	customHeaders      customHeaderFlags
+	customHeaderPolicy string
+
+	// dateCheck validates the Date header against the server clock.
+	dateCheck dateCheck
+
+	// fromAlignment is the -require-from-alignment mode.
+	fromAlignment string
+
+	// normalizeRecipients is the -normalize-recipients mode.
+	normalizeRecipients string
+	// dedupeRecipients sends to each recipient of a message only once.
+	dedupeRecipients bool
+
+	// dmarc evaluates -dmarc-check alignment, nil when off.
+	dmarc *dmarcChecker
+
+	// eightBitPolicy is the -eightbit-policy for 8-bit bodies sent without
+	// BODY=8BITMIME.
+	eightBitPolicy string
+
+	// missingToPolicy is the -missing-to-policy for messages without To
+	// and Cc fields.
+	missingToPolicy string
+
+	// returnPath replaces MAIL FROM as the SES envelope sender when set.
+	returnPath string
+	// sourceMode selects the SES Source of raw sends, see envelopeFrom.
+	sourceMode string
+	// bounceSource is the SES Source of null sender messages, which are
+	// refused without it unless sourceMode is fixed.
+	bounceSource string
+
+	// extensions are the enabled configurable ESMTP extensions.
+	extensions ehloExtensions
+
+	// draining refuses new transactions while in-flight sends complete.
+	draining atomic.Bool
+
+	// warming reports not ready until the startup warmup has completed.
+	warming atomic.Bool
+
+	// config is served on /admin/config, nil until startup is complete.
+	config atomic.Pointer[effectiveConfig]
 }
 
 // NewSession implements smtp.Backend
 func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{
-		backend: b,
-		conn:    c,
-	}, nil
+	return b.newSession(c, DefaultTenant, false)
+}
+
+func (b *Backend) newSession(c *smtp.Conn, tenant string, requireTLS bool) (smtp.Session, error) {
+	s := &Session{
+		backend:    b,
+		conn:       c,
+		tenant:     tenant,
+		requireTLS: requireTLS,
+		connID:     newConnID(),
+	}
+	_, s.startedTLS = c.TLSConnectionState()
+	restarted := false
+	s.probe = isProxyHealthCheck(c.Conn().RemoteAddr())
+	if ct := trackedConn(c.Conn()); ct != nil {
+		s.connID = ct.id
+		restarted = ct.sessions > 0
+		if !restarted {
+			ct.opened = time.Now()
+			if !s.probe {
+				if err := s.limitConnection(ct); err != nil {
+					observeReply("EHLO", err)
+					return nil, err
+				}
+			}
+		}
+		ct.sessions++
+	}
+	s.observeReply("EHLO", nil)
+	switch {
+	case s.probe:
+	case restarted:
+		s.logf("session restarted after STARTTLS")
+	default:
+		s.logf("connection from %s (tenant: %s)", c.Conn().RemoteAddr(), tenant)
+	}
+	return s, nil
 }
 
 // Session implements smtp.Session
 type Session struct {
-	backend       *Backend
-	conn          *smtp.Conn
-	from          string
-	recipients    []string
-	data          []byte
+	backend    *Backend
+	conn       *smtp.Conn
+	tenant     string
+	user       string
+	from       string
+	recipients []string
+	data       []byte
+	// msg holds data, with room for prepending header fields.
+	msg *messageBuffer
+	// hasMail is set by MAIL FROM, which may give a null sender.
+	hasMail bool
+
+	// connID identifies the connection in logs across transactions.
+	connID string
+	// probe is set on PROXY protocol health check connections, which are
+	// neither logged nor counted and cannot send mail.
+	probe bool
+	// startedTLS is set if the session began on a TLS connection. go-smtp
+	// logs a plaintext session out when STARTTLS succeeds.
+	startedTLS bool
+	// requireTLS refuses transactions before STARTTLS on this listener.
+	requireTLS bool
+
+	// trackingID identifies the current transaction in logs and headers.
+	trackingID string
+
+	// messages counts DATA commands on this connection.
+	messages      int
+	messageCapHit bool
+
+	// rcptAttempts counts RCPT commands in the transaction, accepted or not.
+	rcptAttempts int
+
+	// declaredSize is the SIZE parameter from MAIL FROM, 0 if absent.
+	declaredSize int64
+	// body8bit is set when MAIL FROM declared BODY=8BITMIME.
+	body8bit bool
+
+	// ctx bounds the current DATA transaction, see startTransaction.
+	ctx context.Context
 }
 
-// AuthPlain implements smtp.Session (no-op for unauthenticated server)
+// AuthPlain checks PLAIN credentials, which is only offered with
+// -reject-auth. There is no credential store, so every attempt fails.
 func (s *Session) AuthPlain(username, password string) error {
-	return nil
+	s.logf("rejecting AUTH PLAIN for %q, no credentials are accepted", username)
+	s.observeAuth(sasl.Plain, AuthFailure, username)
+	s.observeReply("AUTH", errAuthPlainRejected)
+	return errAuthPlainRejected
 }
 
 // Mail implements smtp.Session
-func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+func (s *Session) Mail(from string, opts *smtp.MailOptions) (err error) {
+	defer func() { s.observeReply("MAIL", err) }()
+	if s.probe {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Health check connections cannot send mail",
+		}
+	}
+	if _, isTLS := s.conn.TLSConnectionState(); s.requireTLS && !isTLS {
+		emailError.With(prometheus.Labels{"type": "tls required", "tenant": s.tenant}).Inc()
+		return &smtp.SMTPError{
+			Code:         530,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+			Message:      "Must issue a STARTTLS command first",
+		}
+	}
+	if s.backend.requireAuth && s.user == "" {
+		emailError.With(prometheus.Labels{"type": "auth required", "tenant": s.tenant}).Inc()
+		return &smtp.SMTPError{
+			Code:         530,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+			Message:      "Authentication required",
+		}
+	}
+	if s.backend.draining.Load() {
+		emailError.With(prometheus.Labels{"type": "draining", "tenant": s.tenant}).Inc()
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+			Message:      "Service not available, relay is draining",
+		}
+	}
+	if max := s.backend.maxMessagesPerConn; max > 0 && s.messages >= max {
+		if !s.messageCapHit {
+			s.messageCapHit = true
+			connectionMessageCap.Inc()
+			s.logf("connection from %s reached %d messages, asking client to reconnect", s.conn.Conn().RemoteAddr(), max)
+		}
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many messages on this connection, please reconnect",
+		}
+	}
+	if opts != nil {
+		if opts.Size > 0 && !s.backend.extensions[ExtSize] {
+			return errParamNotSupported("SIZE")
+		}
+		if opts.Body == smtp.Body8BitMIME && !s.backend.extensions[Ext8BitMIME] {
+			return errParamNotSupported("BODY=8BITMIME")
+		}
+	}
+	if err := s.checkBounceSource(from); err != nil {
+		return err
+	}
+	if _, ok := s.backend.senderFor(from); !ok {
+		emailError.With(prometheus.Labels{"type": "unrouted sender", "tenant": s.tenant}).Inc()
+		s.logf("no SES route for sender %s", from)
+		return s.decide("sender_route", &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Sender domain not allowed on this relay",
+		})
+	}
+	s.logDecision("sender_route", s.backend.routeDetail(from), nil)
 	s.from = from
+	s.hasMail = true
+	if opts != nil {
+		s.declaredSize = opts.Size
+		s.body8bit = opts.Body == smtp.Body8BitMIME
+	}
+	s.logf("MAIL FROM:<%s>", from)
 	return nil
 }
 
 // Rcpt implements smtp.Session
-func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
+	defer func() { s.observeReply("RCPT", err) }()
+	if err := s.checkMailGiven("RCPT"); err != nil {
+		return err
+	}
+	s.rcptAttempts++
+	if max := s.backend.maxRcptAttempts; max > 0 && s.rcptAttempts > max {
+		if s.rcptAttempts == max+1 {
+			rcptAttemptsExceeded.Inc()
+			s.logf("dropping %s after %d RCPT attempts in one transaction", s.conn.Conn().RemoteAddr(), s.rcptAttempts)
+		}
+		if ct := trackedConn(s.conn.Conn()); ct != nil {
+			ct.drop()
+		}
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many recipients attempted, closing connection",
+		}
+	}
+	to, err = s.normalizeRecipient(to)
+	if err != nil {
+		return err
+	}
+	if err := s.logDecision("greylist", "recipient="+to, s.checkGreylist(to)); err != nil {
+		return err
+	}
+	if err := s.logDecision("sandbox_recipient", "recipient="+to, s.checkSandboxRecipient(to)); err != nil {
+		return err
+	}
 	s.recipients = append(s.recipients, to)
+	s.logf("RCPT TO:<%s>", to)
 	return nil
 }
 
 // Data implements smtp.Session
-func (s *Session) Data(r io.Reader) error {
+func (s *Session) Data(r io.Reader) (err error) {
+	defer func() { s.observeReply("DATA", err) }()
+	if err := s.checkMailGiven("DATA"); err != nil {
+		return err
+	}
+	s.messages++
+	s.logf("DATA from %s for %d recipients", s.from, len(s.recipients))
+	recipientsPerMessage.Observe(float64(len(s.recipients)))
+
 	if len(s.recipients) == 0 {
-		emailError.With(prometheus.Labels{"type": "no valid recipients"}).Inc()
+		emailError.With(prometheus.Labels{"type": "no valid recipients", "tenant": s.tenant}).Inc()
 		return &smtp.SMTPError{
 			Code:         554,
 			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
@@ -99,87 +505,437 @@ func (s *Session) Data(r io.Reader) error {
 		}
 	}
 
+	if err := s.decide("buffer_budget", s.checkBufferBudget()); err != nil {
+		emailError.With(prometheus.Labels{"type": "buffer budget", "tenant": s.tenant}).Inc()
+		return err
+	}
+
+	stop := s.startTransaction()
+	defer stop()
+
+	// go-smtp sets the -idle-timeout deadline once before the DATA command;
+	// let it follow the message data as it arrives instead.
+	if ct := trackedConn(s.conn.Conn()); ct != nil && s.backend.idleTimeout > 0 {
+		ct.extendReads(s.backend.idleTimeout)
+		defer ct.extendReads(0)
+	}
+
+	compressed := false
+	if s.backend.acceptGzip {
+		var err error
+		if r, compressed, err = maybeDecompress(r); err != nil {
+			return s.decompressError(err)
+		}
+	}
+
 	// Read message data with size limit
-	data, err := io.ReadAll(io.LimitReader(r, SesSizeLimit+1))
+	readStart := time.Now()
+	msg, err := readMessage(r, SesSizeLimit, s.declaredSize, s.backend.bufferBudget)
+	if err == nil {
+		// Held until the SES reply; whatever still references the data
+		// afterwards, such as a shadow send, is not counted.
+		defer s.backend.bufferBudget.release(msg.charged)
+	}
+	phaseDuration.With(prometheus.Labels{"phase": "data_read"}).Observe(time.Since(readStart).Seconds())
+	if err != nil && s.transactionExpired() {
+		return s.transactionTimedOut("data_read")
+	}
+	if errors.Is(err, errMessageTooLarge) {
+		emailError.With(prometheus.Labels{"type": "minimum message size exceed", "tenant": s.tenant}).Inc()
+		s.logf("message exceeds SES limit of %d bytes", SesSizeLimit)
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Error: maximum message size exceeded",
+		}
+	}
+	if errors.Is(err, errBufferBudget) {
+		emailError.With(prometheus.Labels{"type": "buffer budget", "tenant": s.tenant}).Inc()
+		s.logf("message from %s deferred: -max-total-buffer-bytes reached", s.from)
+		return errBufferBudgetReply
+	}
+	if err != nil && compressed && isCorruptCompression(err) {
+		return s.decompressError(err)
+	}
+	if err != nil && isClientDisconnect(err) {
+		emailError.With(prometheus.Labels{"type": "client disconnect", "tenant": s.tenant}).Inc()
+		s.logf("client %s disconnected during DATA: %v", s.conn.Conn().RemoteAddr(), err)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+			Message:      "Connection lost while reading message",
+		}
+	}
 	if err != nil {
-		emailError.With(prometheus.Labels{"type": "read error"}).Inc()
+		s.logf("ERROR: reading message data from %s: %v", s.conn.Conn().RemoteAddr(), err)
+		emailError.With(prometheus.Labels{"type": "read error", "tenant": s.tenant}).Inc()
 		return &smtp.SMTPError{
 			Code:         451,
-			EnhancedCode: smtp.EnhancedCode{4, 5, 1},
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
 			Message:      "Temporary server error reading message",
 		}
 	}
 
-	if len(data) > SesSizeLimit {
-		emailError.With(prometheus.Labels{"type": "minimum message size exceed"}).Inc()
-		log.Printf("message size %d exceeds SES limit of %d", len(data), SesSizeLimit)
+	data := msg.bytes()
+	if min := s.backend.minMessageSize; min > 0 && len(data) < min {
+		emailError.With(prometheus.Labels{"type": "message too small", "tenant": s.tenant}).Inc()
+		s.logf("message from %s is %d bytes, below the minimum of %d", s.from, len(data), min)
 		return &smtp.SMTPError{
 			Code:         554,
-			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
-			Message:      "Error: maximum message size exceeded",
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Error: message is below the minimum size",
 		}
 	}
 
-	s.data = data
+	if b := s.backend; b.enforceDeclaredSize && s.declaredSize > 0 {
+		limit := s.declaredSize + s.declaredSize*int64(b.declaredSizeTolerance)/100
+		if int64(len(data)) > limit {
+			emailError.With(prometheus.Labels{"type": "declared size exceeded", "tenant": s.tenant}).Inc()
+			s.logf("message size %d exceeds declared SIZE %d from %s", len(data), s.declaredSize, s.from)
+			return &smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+				Message:      "Error: message size exceeds declared SIZE",
+			}
+		}
+	}
+
+	if err := s.decide("header_limits", s.checkHeaderLimits(data)); err != nil {
+		return err
+	}
+	if err := s.decide("date", s.checkDate(data)); err != nil {
+		return err
+	}
+	if err := s.decide("attachments", s.checkAttachments(data)); err != nil {
+		return err
+	}
+	if err := s.decide("from_alignment", s.checkFromAlignment(data)); err != nil {
+		return err
+	}
+	data, err = s.checkEightBit(data)
+	if err := s.decide("eightbit", err); err != nil {
+		return err
+	}
+
+	if !msg.holds(data) {
+		// Re-encoded by -eightbit-policy.
+		msg.set(data)
+	}
+	s.msg, s.data = msg, data
+	s.applyTrackingID()
+	if s.backend.stripBcc {
+		s.stripBccHeaders()
+	}
+	s.addCustomHeaders()
+	if compressed {
+		s.logf("decompressed gzip message from %s to %d bytes", s.from, len(data))
+	}
+
+	if err := s.decide("maintenance", s.checkMaintenance()); err != nil {
+		return err
+	}
+	if err := s.decide("reputation", s.checkReputation()); err != nil {
+		return err
+	}
+	if err := s.decide("account_paused", s.checkAccountPaused()); err != nil {
+		return err
+	}
 
-	// Send via SES
-	input := &ses.SendRawEmailInput{
-		ConfigurationSetName: s.backend.configSetName,
-		Source:               &s.from,
-		Destinations:         s.recipients,
-		RawMessage:           &types.RawMessage{Data: s.data},
+	// Recipients are de-duplicated once the final list is known, as
+	// X-Test-Recipients may replace it.
+	if t := s.backend.templates; t != nil {
+		if triggered, rest := t.splitRecipients(s.recipients); triggered {
+			return s.sendTemplated(s.dedupeRecipients(rest))
+		}
 	}
 
-	_, err = s.backend.sesClient.SendRawEmail(context.TODO(), input)
+	recipients, err := s.testRecipients(s.recipients)
 	if err != nil {
-		log.Printf("ERROR: ses: %v", err)
-		emailError.With(prometheus.Labels{"type": "ses error"}).Inc()
-		sesError.Inc()
+		return err
+	}
+	recipients = s.dedupeRecipients(recipients)
+	s.addMissingTo(recipients)
+	s.reportDMARC()
+	if s.backend.redirectAllTo != "" {
+		s.stampOriginalRecipients(recipients)
+		recipients = s.redirectRecipients(recipients)
+	}
+
+	// Added header fields count towards the SES limit as well.
+	if len(s.data) > SesSizeLimit {
+		emailError.With(prometheus.Labels{"type": "minimum message size exceed", "tenant": s.tenant}).Inc()
+		s.logf("message with added headers is %d bytes, over the SES limit of %d", len(s.data), SesSizeLimit)
 		return &smtp.SMTPError{
-			Code:         451,
-			EnhancedCode: smtp.EnhancedCode{4, 5, 1},
-			Message:      "Temporary server error. Please try again later",
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Error: maximum message size exceeded",
 		}
 	}
+	done, err := s.startSend(recipients)
+	if err != nil {
+		return err
+	}
+	sender, _ := s.backend.senderFor(s.from)
+	messageID, err := sender.SendRaw(s.ctx, s.envelopeFrom(), recipients, s.data, aws.ToString(s.configSet()))
+	done(err)
+	if p := asPartialSend(err); p != nil {
+		messageID, recipients = s.acceptPartial(sender, p)
+		err = nil
+	}
+	s.shadowSend(err)
+	s.captureMessage(recipients, messageID, err)
+	return s.finishSend(recipients, messageID, "", err)
+}
+
+// startSend makes the policy checks every SES send goes through, raw or
+// templated, and takes a send slot. The returned function must be called
+// with the result of the send: it frees the slot and feeds the circuit
+// breaker.
+func (s *Session) startSend(recipients []string) (func(error), error) {
+	if err := s.decide("class_rate_limit", s.checkClassRateLimit()); err != nil {
+		return nil, err
+	}
+	// What a check took is given back when a later one refuses the
+	// message, as the client will send it again.
+	if err := s.decide("domain_rate_limit", s.checkDomainRateLimit(recipients)); err != nil {
+		s.refundClassRateLimit()
+		return nil, err
+	}
+	if err := s.decide("byte_budget", s.checkByteBudget()); err != nil {
+		s.refundRateLimits(recipients)
+		return nil, err
+	}
+	release, err := s.acquireSendSlot()
+	if err := s.decide("send_slot", err); err != nil {
+		s.refundRateLimits(recipients)
+		s.backend.byteBudget.refund(len(s.data))
+		return nil, err
+	}
+	// Checked once the slot is held: a half-open probe let through must
+	// reach breaker.record.
+	if err := s.decide("circuit_breaker", s.checkBreaker()); err != nil {
+		release()
+		s.refundRateLimits(recipients)
+		s.backend.byteBudget.refund(len(s.data))
+		return nil, err
+	}
+
+	sendStart := time.Now()
+	return func(err error) {
+		s.observePhase("ses_send", time.Since(sendStart))
+		release()
+		s.backend.breaker.record(err)
+	}, nil
+}
+
+// refundRateLimits gives back the class and domain rate limit tokens of a
+// message refused before it was sent.
+func (s *Session) refundRateLimits(recipients []string) {
+	s.refundClassRateLimit()
+	s.refundDomainRateLimit(recipients)
+}
+
+// finishSend publishes the send event and returns the reply to a send to
+// recipients, logging and counting it. template is the name of the SES
+// template of a templated send, "" for a raw one; only raw sends fall back
+// to -fallback-relay.
+func (s *Session) finishSend(recipients []string, messageID, template string, err error) error {
+	s.publishEvent(recipients, messageID, template, err)
+	if err != nil {
+		s.backend.byteBudget.refund(len(s.data))
+		if s.transactionExpired() {
+			return s.transactionTimedOut("ses_send")
+		}
+		if s.backend.context().Err() != nil {
+			return errShuttingDown
+		}
+		s.logf("ERROR: ses: %v", err)
+		emailError.With(prometheus.Labels{"type": "ses error", "tenant": s.tenant}).Inc()
+		sesError.Inc()
+		reply := s.sesReply(err)
+		if template == "" && s.backend.fallback != nil && reply.Code >= 500 {
+			return s.sendFallback(recipients, reply)
+		}
+		return reply
+	}
 
 	// Log successful send
 	configSetInfo := "no config set"
-	if s.backend.configSetName != nil {
-		configSetInfo = fmt.Sprintf("config set: %s", *s.backend.configSetName)
+	if cs := s.configSet(); cs != nil {
+		configSetInfo = fmt.Sprintf("config set: %s", *cs)
 	}
-	log.Printf("sending message from %s to %v (%s)", s.from, s.recipients, configSetInfo)
-	emailSent.Inc()
+	if template != "" {
+		s.logf("sending templated message %q from %s to %v (%s, tenant: %s)", template, s.from, recipients, configSetInfo, s.tenant)
+	} else {
+		s.logf("sending message from %s to %v (%s, tenant: %s)", s.from, recipients, configSetInfo, s.tenant)
+	}
+	emailSent.With(prometheus.Labels{"tenant": s.tenant}).Inc()
+	s.recordCost(recipients)
+	s.logRecipients(recipients, messageID)
+	s.recordOutbox(recipients, messageID, template)
+
+	return s.accepted(messageID)
+}
+
+// accepted returns the result of a successful send. With -reply-message-id
+// the SES message ID is included in the 250 reply, Postfix style; go-smtp
+// writes a returned SMTPError as the reply, whatever its code.
+func (s *Session) accepted(messageID string) error {
+	if !s.backend.replyMessageID || messageID == "" {
+		return nil
+	}
+	return &smtp.SMTPError{
+		Code:         250,
+		EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+		Message:      "OK: queued as " + messageID,
+	}
+}
+
+// errMessageTooLarge is returned by readMessage for messages over the limit.
+var errMessageTooLarge = errors.New("message exceeds size limit")
 
+// isClientDisconnect reports whether a DATA read error means the client
+// went away, as opposed to a server side failure.
+func isClientDisconnect(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// decompressError rejects a message whose gzip stream is invalid.
+func (s *Session) decompressError(err error) error {
+	emailError.With(prometheus.Labels{"type": "decompression error", "tenant": s.tenant}).Inc()
+	s.logf("invalid gzip data from %s: %v", s.from, err)
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Error: invalid compressed message data",
+	}
+}
+
+// checkHeaderLimits rejects messages with too many or too large headers.
+func (s *Session) checkHeaderLimits(data []byte) error {
+	b := s.backend
+	if b.maxHeaderCount <= 0 && b.maxHeaderBytes <= 0 {
+		return nil
+	}
+	count, size := measureHeader(data)
+	if b.maxHeaderCount > 0 && count > b.maxHeaderCount {
+		emailError.With(prometheus.Labels{"type": "too many headers", "tenant": s.tenant}).Inc()
+		s.logf("message from %s has %d header fields, limit is %d", s.from, count, b.maxHeaderCount)
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Error: too many header fields",
+		}
+	}
+	if b.maxHeaderBytes > 0 && size > b.maxHeaderBytes {
+		emailError.With(prometheus.Labels{"type": "header size exceeded", "tenant": s.tenant}).Inc()
+		s.logf("message from %s has %d header bytes, limit is %d", s.from, size, b.maxHeaderBytes)
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Error: message header too large",
+		}
+	}
 	return nil
 }
 
+// checkBreaker fails the transaction while the SES circuit breaker is open.
+func (s *Session) checkBreaker() error {
+	if s.backend.breaker.allow() {
+		return nil
+	}
+	emailError.With(prometheus.Labels{"type": "circuit open", "tenant": s.tenant}).Inc()
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "SES temporarily unavailable. Please try again later",
+	}
+}
+
+// logRecipients writes one key=value record per recipient of a successful
+// send when per-recipient logging is enabled.
+func (s *Session) logRecipients(recipients []string, messageID string) {
+	if !s.backend.logPerRecipient {
+		return
+	}
+	for _, rcpt := range recipients {
+		s.logf("recipient_result from=%q recipient=%q message_id=%q result=sent tenant=%s", s.from, rcpt, messageID, s.tenant)
+	}
+}
+
 // Reset implements smtp.Session
 func (s *Session) Reset() {
 	s.from = ""
+	s.hasMail = false
 	s.recipients = nil
 	s.data = nil
+	s.msg = nil
+	s.declaredSize = 0
+	s.body8bit = false
+	s.rcptAttempts = 0
+	s.trackingID = ""
 }
 
 // Logout implements smtp.Session
 func (s *Session) Logout() error {
+	state, isTLS := connTLSState(s.conn)
+	if isTLS && !s.startedTLS {
+		// STARTTLS, the connection stays open.
+		return nil
+	}
+	if s.probe {
+		return nil
+	}
+	reason := closeReason(s.conn.Conn())
+	connectionClose.With(prometheus.Labels{"reason": reason}).Inc()
+	if ct := trackedConn(s.conn.Conn()); ct != nil {
+		connectionDuration.Observe(time.Since(ct.opened).Seconds())
+	}
+	observeConnectionTLS(state, isTLS)
+	s.logf("disconnect from %s after %d messages (%s)", s.conn.Conn().RemoteAddr(), s.messages, reason)
 	return nil
 }
 
-func validateConfigurationSet(ctx context.Context, sesClient *ses.Client, configSetName string) error {
-	_, err := sesClient.DescribeConfigurationSet(ctx, &ses.DescribeConfigurationSetInput{
-		ConfigurationSetName: &configSetName,
+func validateConfigurationSet(ctx context.Context, sesClient *ses.Client, configSetName string) (*ses.DescribeConfigurationSetOutput, error) {
+	return sesClient.DescribeConfigurationSet(ctx, &ses.DescribeConfigurationSetInput{
+		ConfigurationSetName:           &configSetName,
+		ConfigurationSetAttributeNames: configurationSetAttributes,
 	})
-	return err
 }
 
-func makeSesClient(ctx context.Context) (*ses.Client, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
+// loadAWSConfig resolves the AWS config with the HTTP client, region and
+// role assumption from opts.
+func loadAWSConfig(ctx context.Context, opts sesClientOptions) (aws.Config, error) {
+	httpClient, err := newAwsHTTPClient(opts)
 	if err != nil {
-		return nil, err
+		return aws.Config{}, err
 	}
 
-	// Check for role assumption from environment variables
-	if roleArn := os.Getenv("AWS_ROLE_ARN"); roleArn != "" {
+	loadOpts := []func(*config.LoadOptions) error{config.WithHTTPClient(httpClient)}
+	if opts.region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(opts.region))
+	}
+	if opts.maxAttempts > 0 {
+		loadOpts = append(loadOpts, config.WithRetryMaxAttempts(opts.maxAttempts))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if opts.operationTimeout > 0 {
+		cfg.APIOptions = append(cfg.APIOptions, withOperationTimeout(opts.operationTimeout))
+	}
+
+	// Check for role assumption from the options or environment variables
+	roleArn := opts.roleARN
+	if roleArn == "" {
+		roleArn = os.Getenv("AWS_ROLE_ARN")
+	}
+	if roleArn != "" {
 		sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
 		if sessionName == "" {
 			sessionName = "ses-smtpd-relay-session"
@@ -192,17 +948,30 @@ func makeSesClient(ctx context.Context) (*ses.Client, error) {
 		
 		cfg.Credentials = aws.NewCredentialsCache(provider)
 	}
+	return cfg, nil
+}
+
+// makeSesClient builds the SES client. The resolved AWS config is returned as
+// well so that other AWS clients share the same credentials.
+func makeSesClient(ctx context.Context, opts sesClientOptions) (*ses.Client, aws.Config, error) {
+	cfg, err := loadAWSConfig(ctx, opts)
+	if err != nil {
+		return nil, aws.Config{}, err
+	}
 
 	// Log current AWS identity
 	stsClient := sts.NewFromConfig(cfg)
 	identity, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil && opts.requireIdentity {
+		return nil, aws.Config{}, fmt.Errorf("verifying AWS identity: %w", err)
+	}
 	if err != nil {
 		log.Printf("Warning: Could not verify AWS identity: %v", err)
 	} else {
 		log.Printf("AWS Identity - Account: %s, ARN: %s", *identity.Account, *identity.Arn)
 	}
 
-	return ses.NewFromConfig(cfg), nil
+	return ses.NewFromConfig(cfg), cfg, nil
 }
 
 func main() {
@@ -215,6 +984,150 @@ func main() {
 	configurationSetName := flag.String("configuration-set-name", "", "Configuration set name with which SendRawEmail will be invoked")
 	enableHealthCheck := flag.Bool("enable-health-check", false, "Enable health check server")
 	healthCheckBind := flag.String("health-check-bind", ":3000", "Address/port on which to bind health check server")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token enabling the /admin endpoints on the health check server (default $ADMIN_TOKEN)")
+	adminSecret := flag.String("admin-secret", os.Getenv("ADMIN_SECRET"), "HMAC key; admin requests must also carry a fresh signature made with it (default $ADMIN_SECRET)")
+	enableTemplates := flag.Bool("enable-templates", false, "Send messages addressed to -template-trigger-address as SES templated emails")
+	templateTriggerAddress := flag.String("template-trigger-address", "", "Pseudo-recipient that triggers templated sending")
+	userConfigSetsFile := flag.String("user-configuration-sets-file", "", "File of \"username configuration-set\" pairs overriding -configuration-set-name for authenticated users")
+	xoauth2TokensFile := flag.String("xoauth2-tokens-file", "", "File of \"username token\" pairs accepted for XOAUTH2")
+	xoauth2IntrospectionURL := flag.String("xoauth2-introspection-url", "", "OAuth2 token introspection endpoint (RFC 7662) used to validate XOAUTH2 tokens")
+	authMechanisms := flag.String("auth-mechanisms", "", "Comma separated SASL mechanisms to offer, each optionally with :tls to offer it over TLS only, e.g. XOAUTH2,PLAIN:tls (default: all configured)")
+	rejectAuth := flag.Bool("reject-auth", false, "Advertise AUTH PLAIN and reject every attempt with 535")
+	authMetricsPerUser := flag.Bool("auth-metrics-per-user", false, fmt.Sprintf("Count AUTH failures per user in smtpd_auth_user_failures_total (at most %d users)", maxAuthFailureUsers))
+	requireAuth := flag.Bool("require-auth", false, "Require XOAUTH2 authentication before MAIL FROM")
+	xoauth2ClientID := flag.String("xoauth2-introspection-client-id", "", "Client ID for the introspection endpoint (secret read from XOAUTH2_INTROSPECTION_CLIENT_SECRET)")
+	logSyslog := flag.Bool("log-syslog", false, "Send logs to syslog instead of stderr")
+	syslogAddress := flag.String("syslog-address", "", "Syslog server as [network://]host:port (default: local daemon)")
+	syslogFacility := flag.String("syslog-facility", "daemon", "Syslog facility")
+	enforceDeclaredSize := flag.Bool("enforce-declared-size", false, "Reject messages larger than the SIZE declared in MAIL FROM")
+	declaredSizeTolerance := flag.Int("declared-size-tolerance", 10, "Percentage by which a message may exceed its declared SIZE")
+	acceptGzip := flag.Bool("accept-gzip-data", false, "Transparently decompress message data that starts with a gzip header (non-standard)")
+	maxMessagesPerConn := flag.Int("max-messages-per-connection", 0, "Messages accepted per connection before the client is asked to reconnect (0 unlimited)")
+	rateLimitReply := flag.String("ses-rate-limit-reply", "", "Reply when SES throttles the sending rate, as \"CODE X.Y.Z message\" (default: 451 4.4.5)")
+	quotaReply := flag.String("ses-quota-reply", "", "Reply when the SES 24-hour sending quota is exhausted, as \"CODE X.Y.Z message\" (default: 451 4.3.1)")
+	accountPausedReply := flag.String("ses-account-paused-reply", "", "Reply while SES account sending is paused, as \"CODE X.Y.Z message\"; 5xx rejects permanently (default: 451 4.3.2)")
+	maxConcurrentSends := flag.Int("max-concurrent-sends", 0, "SES sends in flight at once across all sessions; further messages wait their turn (0 unlimited)")
+	sendFairnessKey := flag.String("send-fairness-key", FairnessTenant, "What -max-concurrent-sends shares slots fairly between: tenant, user or ip")
+	sendPriorityHeader := flag.String("send-priority-header", "", "Header whose value gives messages waiting for -max-concurrent-sends their priority (e.g. X-Priority)")
+	sendPriorityLevels := flag.String("send-priorities", DefaultSendPriorities, "Priority levels for -send-priority-header, highest first, as \"name=value,...;...\" with * marking the default level")
+	maxConnsPerIP := flag.Int("max-connections-per-ip", 0, "Concurrent connections per client IP; excess sessions get 421 (0 unlimited)")
+	maxRcptAttempts := flag.Int("max-rcpt-attempts", 500, "RCPT commands per transaction, including rejected ones, before the connection is dropped (0 unlimited)")
+	maxHeaderCount := flag.Int("max-header-count", 1000, "Maximum number of header fields per message (0 disables)")
+	minMessageSize := flag.Int("min-message-size", 0, "Reject messages smaller than this many bytes, e.g. empty or header-only cron mail (0 disables)")
+	maxHeaderBytes := flag.Int("max-header-bytes", 1<<20, "Maximum total header size in bytes per message (0 disables)")
+	trackingHeader := flag.String("tracking-header", DefaultTrackingHeader, "Header carrying the relay generated message ID (empty to not add one)")
+	trackingOverwrite := flag.Bool("tracking-header-overwrite", false, "Replace an existing tracking header instead of adopting its value")
+	blockedExtensions := flag.String("blocked-attachment-extensions", "", "Comma separated attachment file extensions to reject, e.g. .exe,.bat")
+	blockedTypes := flag.String("blocked-attachment-types", "", "Comma separated attachment MIME types to reject, e.g. application/x-msdownload")
+	metricsExemplars := flag.Bool("metrics-exemplars", false, "Attach the relay tracking ID as an exemplar to SES send latency (served with OpenMetrics)")
+	enableTestRecipients := flag.Bool("enable-test-recipients", false, "Send raw messages to the addresses of their "+TestRecipientsHeader+" header instead of the envelope recipients (SES sandbox load tests only)")
+	redirectAllTo := flag.String("redirect-all-to", "", "Send every message to this address only, keeping the real recipients in "+OriginalRecipientsHeader+" (testing environments)")
+	replyMessageID := flag.Bool("reply-message-id", false, "Include the SES MessageId in the 250 reply to DATA (\"OK: queued as <id>\")")
+	captureDir := flag.String("capture-dir", "", "Directory a sample of relayed messages is written to for debugging (with -capture-sample-rate)")
+	captureRate := flag.Float64("capture-sample-rate", 0, "Fraction of raw messages written to -capture-dir, e.g. 0.01 (0 disables)")
+	captureMaxBytes := flag.Int("capture-max-bytes", 1<<20, "Bytes of each message kept by -capture-dir")
+	captureMaxFiles := flag.Int("capture-max-files", 1000, "Messages kept in -capture-dir, older ones are removed")
+	captureMaxAge := flag.Duration("capture-max-age", 24*time.Hour, "Age after which messages are removed from -capture-dir")
+	fallbackRelayAddr := flag.String("fallback-relay", "", "SMTP smart host (host:port) that raw messages SES rejects permanently are relayed to")
+	fallbackRelayTLS := flag.Bool("fallback-relay-starttls", false, "Require STARTTLS with a verified certificate on the -fallback-relay connection")
+	fallbackRelayTimeout := flag.Duration("fallback-relay-timeout", time.Minute, "Time a delivery to -fallback-relay must complete in")
+	var maintenance maintenanceSchedule
+	flag.Var(&maintenance, "maintenance-schedule", "Window \"START/END\" of RFC 3339 times during which DATA is deferred with 451; may be repeated")
+	classRates := rateFlags{}
+	flag.Var(classRates, "class-rate-limit", "Messages per second of a mail class as \"class=RATE\" (bulk, transactional or a -mail-class-header value); may be repeated")
+	classHeader := flag.String("mail-class-header", "", "Header whose value, when present, names the mail class instead of Precedence (e.g. X-Mail-Class)")
+	domainRates := rateFlags{}
+	flag.Var(domainRates, "domain-rate-limit", "Messages per second to a recipient domain as \"domain=RATE\", \"*\" for all others; may be repeated")
+	var customHeaders customHeaderFlags
+	flag.Var(&customHeaders, "add-header", "Header added to every message as \"Name: value\"; may be repeated")
+	customHeaderPolicy := flag.String("add-header-policy", AddHeaderMissing, "Handling of -add-header fields the message already has: missing (keep the message's), always (add anyway) or replace")
+	stripBcc := flag.Bool("strip-bcc", false, "Remove Bcc and Resent-Bcc headers from messages before sending")
+	logPerRecipient := flag.Bool("log-per-recipient", false, "Log one structured record per recipient for each successful send")
+	logPolicyDecisions := flag.Bool("log-policy-decisions", false, "Log one structured record per policy check and its outcome")
+	var dateOpts dateCheck
+	flag.StringVar(&dateOpts.mode, "date-check", DateCheckOff, "Date header check: off, metric (record skew only) or reject")
+	flag.DurationVar(&dateOpts.maxPast, "date-max-past", 72*time.Hour, "Reject messages dated further in the past (0 disables, reject mode only)")
+	flag.DurationVar(&dateOpts.maxFuture, "date-max-future", 15*time.Minute, "Reject messages dated further in the future (0 disables, reject mode only)")
+	flag.StringVar(&dateOpts.invalidPolicy, "date-invalid-policy", DatePolicyAccept, "Handling of missing or unparseable Date headers when -date-check is on: accept or reject")
+	fromAlignment := flag.String("require-from-alignment", AlignmentOff, "Require the From header to match MAIL FROM: off, address, domain or relaxed (subdomains allowed)")
+	normalizeRecipients := flag.String("normalize-recipients", NormalizeOff, "Clean up RCPT TO addresses before sending: off, domain (trim, strip comments, lowercase the domain) or full (lowercase the local part too)")
+	dedupeRecipients := flag.Bool("dedupe-recipients", false, "Send to each recipient of a message once, dropping repeated RCPT TO addresses (domains compared case-insensitively)")
+	dmarcCheck := flag.String("dmarc-check", DMARCCheckOff, "Evaluate whether messages would pass DKIM/SPF aligned with their From domain when sent by SES: off or report (log and count only)")
+	missingToPolicy := flag.String("missing-to-policy", MissingToOff, "Messages without To and Cc fields: off, envelope (add To listing the envelope recipients) or undisclosed (add To: undisclosed-recipients:;)")
+	eightBitPolicy := flag.String("eightbit-policy", EightBitPass, "Handling of 8-bit bodies sent without BODY=8BITMIME: pass, reject or encode (to quoted-printable or base64)")
+	returnPath := flag.String("return-path", "", "Verified address used as the SES envelope sender so bounces go there; the From header is unchanged")
+	bounceSource := flag.String("bounce-source", "", "Verified address passed as SES Source of null sender (MAIL FROM:<>) messages; without it, or -return-path, they are refused")
+	sesSourceMode := flag.String("ses-source-mode", "", "SES Source of raw sends: envelope (MAIL FROM), header (the From address) or fixed (-return-path) (default envelope, fixed with -return-path)")
+	greylistEnabled := flag.Bool("greylist", false, "Defer first-time (client IP, sender, recipient) triples with 451 until retried after -greylist-delay")
+	greylistDelay := flag.Duration("greylist-delay", 5*time.Minute, "Time a greylisted triple must wait before a retry is accepted")
+	greylistExpiry := flag.Duration("greylist-expiry", 36*time.Hour, "Time after which a greylist entry not seen again is forgotten")
+	greylistFile := flag.String("greylist-file", "", "File the greylist is saved to and restored from (default: memory only)")
+	sandboxRejectUnverified := flag.Bool("sandbox-reject-unverified", false, "If the SES account is in the sandbox, reject unverified recipients at RCPT TO")
+	enableOutbox := flag.Bool("enable-outbox", false, "Keep recently sent messages in memory and serve them on /outbox of the health check server (debugging only, not for production)")
+	outboxCapacity := flag.Int("outbox-capacity", 100, "Number of messages kept by -enable-outbox")
+	outboxBodyBytes := flag.Int("outbox-body-bytes", 0, "Body bytes kept per outbox message (0 keeps headers and metadata only)")
+	shadowSES := flag.Bool("shadow-ses", false, "Mirror every raw send to a second SES client, delivering only to -shadow-recipient")
+	shadowRegion := flag.String("shadow-ses-region", "", "Region of the shadow SES client (default: same as the primary)")
+	shadowRoleARN := flag.String("shadow-ses-role-arn", "", "Role assumed for the shadow SES client, e.g. in the new account")
+	shadowRecipient := flag.String("shadow-recipient", DefaultShadowRecipient, "Only recipient of shadow sends")
+	shadowConfigSet := flag.String("shadow-configuration-set-name", "", "Configuration set for shadow sends")
+	sesCostPer1000 := flag.Float64("ses-cost-per-1000", DefaultSESCostPer1000, "SES price per 1000 recipients, for smtpd_ses_estimated_cost_total (0 with -ses-cost-per-gb 0 disables)")
+	sesCostPerGB := flag.Float64("ses-cost-per-gb", DefaultSESCostPerGB, "SES price per GB of message data, counted per recipient, for smtpd_ses_estimated_cost_total")
+	maxTotalBufferBytes := flag.Int64("max-total-buffer-bytes", 0, "Message buffer bytes all sessions may hold at once; DATA beyond it gets 451 (0 disables)")
+	byteBudgetLimit := flag.Int64("byte-budget", 0, "Message bytes that may be sent per -byte-budget-window; further sends get 451 (0 disables)")
+	byteBudgetWindow := flag.Duration("byte-budget-window", time.Hour, "Length of the -byte-budget window")
+	reputationAlarm := flag.String("reputation-alarm-name", "", "CloudWatch alarm that pauses sending with 451 while in ALARM (e.g. on the SES bounce rate)")
+	reputationInterval := flag.Duration("reputation-poll-interval", time.Minute, "Interval between -reputation-alarm-name state checks")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "Consecutive SES failures that open the circuit breaker (0 disables)")
+	breakerWindow := flag.Duration("breaker-window", time.Minute, "Window in which -breaker-threshold failures must occur")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "Time the circuit breaker stays open before probing SES again")
+	ehloExtensionList := flag.String("ehlo-extensions", DefaultEHLOExtensions, "Comma separated ESMTP extensions to enable: "+strings.Join(configurableExtensions, ", "))
+	senderRoutesFile := flag.String("sender-routes-file", "", "File of \"domain region [role-arn]\" lines routing sender domains to SES accounts")
+	senderRoutesFallback := flag.String("sender-routes-fallback", RouteFallbackDefault, "Senders without a route: default (use the default SES client) or reject")
+	networkRetryAttempts := flag.Int("network-retry-attempts", 1, "Attempts per message when SES cannot be reached (1 disables relay level retries)")
+	networkRetryBackoff := flag.Duration("network-retry-backoff", 200*time.Millisecond, "Initial delay between network retries, doubled per attempt")
+	networkRetryAmbiguous := flag.Bool("network-retry-ambiguous", false, "Also retry sends that timed out or lost their connection, which SES may have taken already (can duplicate mail)")
+	retryBudgetSize := flag.Int("retry-budget", 0, "Relay level retries that may be made in a burst across all sessions (0 disables the budget)")
+	retryBudgetRefill := flag.Float64("retry-budget-refill", 1, "Retries per second added back to -retry-budget")
+	batchSize := flag.Int("batch-size", SesMaxRecipients, "Recipients per SES call; larger recipient lists are sent in batches (max 50)")
+	batchDelay := flag.Duration("batch-delay", 0, "Pause between batches of one message")
+	batchTimeout := flag.Duration("batch-timeout", 5*time.Minute, "Time all batches of one message must complete in before a temporary failure is returned")
+	batchFailurePolicy := flag.String("batch-failure-policy", BatchFailureFail, "What to do when some batches of a message fail: fail (the client retries all recipients), accept (log the undelivered recipients) or spool (retry the failed batches from memory)")
+	eventQueueURL := flag.String("event-queue-url", "", "SQS queue URL receiving a JSON event for each SES send (off)")
+	eventQueueBuffer := flag.Int("event-queue-buffer", 1000, "Send events buffered for -event-queue-url before new ones are dropped")
+	batchSpoolSize := flag.Int("batch-spool-size", 1000, "Failed batches -batch-failure-policy spool holds for retry at once")
+	warmupDelay := flag.Duration("warmup-delay", 0, "Time after startup during which /readyz reports not ready")
+	warmupSESCheck := flag.Bool("warmup-ses-check", false, "Keep /readyz not ready until an SES GetSendQuota call succeeds")
+	ssmPrefix := flag.String("ssm-prefix", "", "SSM Parameter Store path whose parameters, named after flags, set flags not given on the command line")
+	transactionTimeout := flag.Duration("transaction-timeout", 0, "Time a message may take from DATA to the SES reply before 451 (0 disables)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Close connections that send no command for this long with 421 (0 disables)")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Expect a PROXY protocol v1/v2 header on every connection (per listener: proxy-protocol[=BOOL])")
+	proxyProtocolTrusted := flag.String("proxy-protocol-trusted-cidrs", "", "Comma separated networks whose PROXY protocol headers are honored; other clients connect directly (default: all must send one)")
+	proxyProtocolTimeout := flag.Duration("proxy-protocol-timeout", 5*time.Second, "Time allowed for the PROXY protocol header to arrive")
+	greetDelay := flag.Duration("greet-delay", 0, "Delay before sending the SMTP greeting; clients talking earlier are dropped (0 disables)")
+	greetingTimeout := flag.Duration("greeting-timeout", 0, "Close connections that send no command this long after the greeting with 421 (0 disables)")
+	var sesOpts sesClientOptions
+	flag.StringVar(&sesOpts.region, "region", "", "AWS region for SES (default: from the AWS environment)")
+	flag.StringVar(&sesOpts.egressIP, "egress-ip", "", "Local IP address AWS API connections are made from, on multi-homed hosts (default: chosen by the system)")
+	flag.StringVar(&sesOpts.proxyURL, "ses-proxy-url", "", "HTTP(S) or SOCKS5 proxy URL for AWS API calls (default: HTTPS_PROXY/NO_PROXY)")
+	flag.IntVar(&sesOpts.maxAttempts, "ses-max-attempts", 0, "Attempts per AWS API call made by the SDK, including the first (0: AWS_MAX_ATTEMPTS or the SDK default of 3)")
+	flag.DurationVar(&sesOpts.attemptTimeout, "ses-attempt-timeout", 0, "Timeout of each HTTP attempt of an AWS API call (0 disables)")
+	flag.DurationVar(&sesOpts.operationTimeout, "ses-operation-timeout", 0, "Timeout of an AWS API call including the SDK's retries (0 disables)")
+	flag.BoolVar(&sesOpts.requireIdentity, "require-identity", false, "Exit at startup if the AWS identity cannot be verified with sts:GetCallerIdentity")
+	startupJitterMax := flag.Duration("startup-jitter-max", 0, "Wait a random time up to this long before the startup AWS calls, to stagger fleet restarts (0 disables)")
+	var tlsOpts tlsOptions
+	flag.StringVar(&tlsOpts.certFile, "tls-cert", "", "TLS certificate file; enables STARTTLS together with -tls-key")
+	flag.StringVar(&tlsOpts.keyFile, "tls-key", "", "TLS private key file")
+	flag.StringVar(&tlsOpts.policy, "tls-policy", TLSPolicyIntermediate, "TLS policy preset: modern (TLS 1.3 only) or intermediate (TLS 1.2+)")
+	flag.StringVar(&tlsOpts.minVersion, "tls-min-version", "", "Override the policy's minimum TLS version (1.2 or 1.3)")
+	flag.StringVar(&tlsOpts.cipherSuites, "tls-cipher-suites", "", "Comma separated TLS 1.2 cipher suites overriding the policy")
+	flag.StringVar(&tlsOpts.curves, "tls-curves", "", "Comma separated curve preferences (X25519, P256, P384, P521)")
+	flag.Var(&tlsOpts.sniCerts, "tls-sni-cert", "Certificate for an SNI hostname as hostname=certfile,keyfile; may be repeated")
+	var listeners listenerFlags
+	flag.Var(&listeners, "listen", "SMTP listener as addr[,tenant=NAME][,tls-cert=FILE,tls-key=FILE][,no-tls][,require-tls[=BOOL]]; may be repeated")
+	requireTLS := flag.Bool("require-tls", false, "Require STARTTLS before MAIL FROM on listeners that do not set require-tls")
+	portFile := flag.String("port-file", "", "Write the bound port of each listener to this file, e.g. when listening on :0")
+	listenNetwork := flag.String("listen-network", "tcp", "Network for the SMTP listener: tcp (dual-stack), tcp4 (IPv4 only) or tcp6 (IPv6 only)")
 
 	flag.Parse()
 
@@ -223,41 +1136,284 @@ func main() {
 		return
 	}
 
-	if *enableHealthCheck {
-		sm := http.NewServeMux()
-		ps := &http.Server{Addr: *healthCheckBind, Handler: sm}
-		sm.Handle("/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Add("Content-Type", "application/json")
-			w.Write([]byte("{\"name\": \"ses-smtpd-relay\", \"status\": \"ok\", \"version\": \"" + version + "\"}"))
-		}))
-		go ps.ListenAndServe()
-		log.Printf("Health check server listening on %s", *healthCheckBind)
+	if *ssmPrefix != "" {
+		cfg, err := loadAWSConfig(ctx, sesOpts)
+		if err != nil {
+			log.Fatalf("Error creating AWS session for SSM: %s", err)
+		}
+		applied, err := loadSSMSettings(ctx, ssm.NewFromConfig(cfg), *ssmPrefix, flag.CommandLine)
+		if err != nil {
+			log.Fatalf("Error loading settings from SSM: %s", err)
+		}
+		log.Printf("Loaded %d settings from SSM under %s: %s", len(applied), *ssmPrefix, strings.Join(applied, ", "))
+	}
+
+	if *logSyslog {
+		if err := setupSyslog(*syslogAddress, *syslogFacility); err != nil {
+			log.Fatalf("Error connecting to syslog: %s", err)
+		}
+	}
+
+	backend := &Backend{ctx: ctx}
+	warmupEnabled := *warmupDelay > 0 || *warmupSESCheck
+	backend.warming.Store(warmupEnabled)
+
+	if *enableOutbox {
+		if !*enableHealthCheck {
+			log.Fatalf("-enable-outbox requires -enable-health-check")
+		}
+		if *outboxCapacity <= 0 || *outboxBodyBytes < 0 {
+			log.Fatalf("-outbox-capacity must be positive and -outbox-body-bytes not negative")
+		}
+		backend.outbox = newOutbox(*outboxCapacity, *outboxBodyBytes)
+	}
+
+	if *adminSecret != "" && *adminToken == "" {
+		log.Fatalf("-admin-secret requires -admin-token")
 	}
 
-	sesClient, err := makeSesClient(ctx)
+	if *declaredSizeTolerance < 0 {
+		log.Fatalf("-declared-size-tolerance must not be negative")
+	}
+
+	if err := dateOpts.validate(); err != nil {
+		log.Fatalf("Invalid Date check configuration: %s", err)
+	}
+	switch *customHeaderPolicy {
+	case AddHeaderMissing, AddHeaderAlways, AddHeaderReplace:
+	default:
+		log.Fatalf("Unknown -add-header-policy %q (want %s, %s or %s)", *customHeaderPolicy, AddHeaderMissing, AddHeaderAlways, AddHeaderReplace)
+	}
+	if err := validateAlignmentMode(*fromAlignment); err != nil {
+		log.Fatalf("Invalid From alignment configuration: %s", err)
+	}
+	if err := validateNormalizeMode(*normalizeRecipients); err != nil {
+		log.Fatalf("Invalid recipient normalization: %s", err)
+	}
+	if err := validateDMARCMode(*dmarcCheck); err != nil {
+		log.Fatalf("Invalid DMARC check configuration: %s", err)
+	}
+	switch *eightBitPolicy {
+	case EightBitPass, EightBitReject, EightBitEncode:
+	default:
+		log.Fatalf("Unknown -eightbit-policy %q (want %s, %s or %s)", *eightBitPolicy, EightBitPass, EightBitReject, EightBitEncode)
+	}
+	if *eightBitPolicy != EightBitPass {
+		log.Printf("8-bit bodies sent without BODY=8BITMIME: %s", *eightBitPolicy)
+	}
+	switch *missingToPolicy {
+	case MissingToOff, MissingToEnvelope, MissingToUndisclosed:
+	default:
+		log.Fatalf("Unknown -missing-to-policy %q (want %s, %s or %s)", *missingToPolicy, MissingToOff, MissingToEnvelope, MissingToUndisclosed)
+	}
+
+	tlsConfig, err := buildTLSConfig(tlsOpts)
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %s", err)
+	}
+
+	extensions, err := parseEHLOExtensions(*ehloExtensionList)
+	if err != nil {
+		log.Fatalf("Invalid -ehlo-extensions: %s", err)
+	}
+	if tlsConfig != nil && !extensions[ExtStartTLS] {
+		log.Printf("STARTTLS disabled by -ehlo-extensions, ignoring TLS certificate")
+		tlsConfig = nil
+	}
+
+	if *enableTemplates && *templateTriggerAddress == "" {
+		log.Fatalf("-enable-templates requires -template-trigger-address")
+	}
+
+	if sesOpts.maxAttempts < 0 || sesOpts.attemptTimeout < 0 || sesOpts.operationTimeout < 0 {
+		log.Fatalf("-ses-max-attempts, -ses-attempt-timeout and -ses-operation-timeout must not be negative")
+	}
+	if sesOpts.maxAttempts > 0 || sesOpts.attemptTimeout > 0 || sesOpts.operationTimeout > 0 {
+		log.Printf("AWS API calls: max attempts %d, attempt timeout %s, operation timeout %s (0: default)", sesOpts.maxAttempts, sesOpts.attemptTimeout, sesOpts.operationTimeout)
+	}
+	if *startupJitterMax < 0 {
+		log.Fatalf("-startup-jitter-max must not be negative")
+	}
+	if !startupJitter(ctx, *startupJitterMax) {
+		log.Printf("Shutting down during startup jitter")
+		return
+	}
+
+	sesClient, awsCfg, err := makeSesClient(ctx, sesOpts)
 	if err != nil {
 		log.Fatalf("Error creating AWS session: %s", err)
 	}
 
 	// Validate configuration set if provided
 	if *configurationSetName != "" {
-		if err := validateConfigurationSet(ctx, sesClient, *configurationSetName); err != nil {
+		out, err := validateConfigurationSet(ctx, sesClient, *configurationSetName)
+		if err != nil {
 			log.Fatalf("Configuration set '%s' not found or inaccessible: %s", *configurationSetName, err)
 		}
 		log.Printf("Configuration set '%s' validated successfully", *configurationSetName)
+		logConfigurationSet(*configurationSetName, out)
 	}
 
-	addr := DefaultAddr
-	if flag.Arg(0) != "" {
-		addr = flag.Arg(0)
-	} else if flag.NArg() > 1 {
-		log.Fatalf("usage: %s [listen_host:port]", os.Args[0])
+	sandboxed, method, err := detectSandbox(ctx, sesv2.NewFromConfig(awsCfg), sesClient)
+	switch {
+	case err != nil:
+		log.Printf("Warning: could not determine whether the SES account is in the sandbox: %v", err)
+	case sandboxed:
+		sandboxMode.Set(1)
+		log.Printf("WARNING: the SES account is in the SANDBOX (detected with %s); mail to unverified recipients will be rejected by SES", method)
+		if *sandboxRejectUnverified && *redirectAllTo != "" {
+			log.Printf("-sandbox-reject-unverified has no effect with -redirect-all-to")
+		} else if *sandboxRejectUnverified {
+			backend.sandbox = newSandboxChecker(sesClient)
+			log.Printf("Rejecting unverified recipients at RCPT TO")
+		}
+	default:
+		log.Printf("SES account has production access (detected with %s)", method)
+	}
+	if *dmarcCheck == DMARCCheckReport {
+		backend.dmarc = newDMARCChecker(sesClient)
+		go backend.dmarc.run(ctx)
+		log.Printf("Reporting DKIM/SPF alignment of relayed messages (report only)")
+	}
+	if *enableTestRecipients {
+		// Routed senders use other accounts, which are not checked.
+		if err != nil || !sandboxed || *senderRoutesFile != "" {
+			log.Fatalf("-enable-test-recipients requires an SES account in the sandbox and no -sender-routes-file")
+		}
+		backend.testRecipients = true
+		testRecipientsActive.Set(1)
+		log.Printf("WARNING: test recipients enabled, the %s header of a message replaces its recipients", TestRecipientsHeader)
+	}
+
+	if *captureDir != "" && *captureRate > 0 {
+		if *captureRate > 1 || *captureMaxBytes <= 0 || *captureMaxFiles <= 0 || *captureMaxAge <= 0 {
+			log.Fatalf("-capture-sample-rate must be at most 1 and the -capture-max-* limits positive")
+		}
+		if backend.capture, err = newMessageCapture(*captureDir, *captureRate, *captureMaxBytes, *captureMaxFiles, *captureMaxAge); err != nil {
+			log.Fatalf("Error creating -capture-dir: %s", err)
+		}
+		log.Printf("WARNING: capturing %g of messages to %s (debugging only, contains message content)", *captureRate, *captureDir)
+	}
+
+	if *fallbackRelayAddr != "" {
+		if _, _, err := net.SplitHostPort(*fallbackRelayAddr); err != nil {
+			log.Fatalf("Invalid -fallback-relay %q: %s", *fallbackRelayAddr, err)
+		}
+		backend.fallback = &fallbackRelay{addr: *fallbackRelayAddr, startTLS: *fallbackRelayTLS, timeout: *fallbackRelayTimeout}
+		log.Printf("Permanently rejected messages go to fallback relay %s (starttls: %t)", *fallbackRelayAddr, *fallbackRelayTLS)
+	}
+
+	if len(maintenance) > 0 {
+		backend.maintenance = maintenance
+		registerMaintenanceGauge(maintenance)
+		log.Printf("Maintenance windows: %s", maintenance.String())
+	}
+
+	if len(classRates) > 0 {
+		if _, ok := classRates[DefaultRateLimit]; ok {
+			log.Fatalf("-class-rate-limit does not accept %q, name each class", DefaultRateLimit)
+		}
+		backend.classLimiter = newRateLimiter(classRates)
+		backend.classHeader = *classHeader
+		log.Printf("Mail class rate limits: %s", classRates)
+	}
+
+	if len(domainRates) > 0 {
+		backend.domainLimiter = newRateLimiter(domainRates)
+		log.Printf("Recipient domain rate limits: %s", domainRates)
+	}
+
+	if *greylistEnabled {
+		if *greylistDelay <= 0 || *greylistExpiry <= *greylistDelay {
+			log.Fatalf("-greylist-delay must be positive and shorter than -greylist-expiry")
+		}
+		if backend.greylist, err = newGreylist(*greylistDelay, *greylistExpiry, *greylistFile); err != nil {
+			log.Fatalf("Error loading greylist: %s", err)
+		}
+		go backend.greylist.run(ctx)
+		log.Printf("Greylisting enabled (delay: %s, expiry: %s)", *greylistDelay, *greylistExpiry)
+	}
+
+	if *shadowSES {
+		o := sesOpts
+		if *shadowRegion != "" {
+			o.region = *shadowRegion
+		}
+		o.roleARN = *shadowRoleARN
+		client, _, err := makeSesClient(ctx, o)
+		if err != nil {
+			log.Fatalf("Error creating shadow SES client: %s", err)
+		}
+		if *shadowConfigSet != "" {
+			if _, err := validateConfigurationSet(ctx, client, *shadowConfigSet); err != nil {
+				log.Fatalf("Shadow configuration set '%s' not found or inaccessible: %s", *shadowConfigSet, err)
+			}
+		}
+		backend.shadow = &shadowSender{sender: &sesSender{client: client}, recipient: *shadowRecipient, configSet: *shadowConfigSet}
+		log.Printf("Shadow sending enabled: copies go to %s (region: %s, role: %s)", *shadowRecipient, orDefault(*shadowRegion), orDefault(*shadowRoleARN))
+	}
+
+	mode, err := resolveSourceMode(*sesSourceMode, *returnPath)
+	if err != nil {
+		log.Fatalf("Invalid SES Source configuration: %s", err)
+	}
+	backend.sourceMode = mode
+	if mode == SourceHeader {
+		log.Printf("Using the From header address as SES Source of raw sends")
+	}
+	if *returnPath != "" {
+		if err := validateReturnPath(ctx, sesClient, *returnPath); err != nil {
+			log.Fatalf("Invalid -return-path: %s", err)
+		}
+		backend.returnPath = *returnPath
+		log.Printf("Using %s as envelope sender, bounces go there", *returnPath)
+	}
+	if *bounceSource != "" {
+		if mode == SourceFixed {
+			log.Fatalf("-bounce-source cannot be combined with -return-path, which is used for null senders as well")
+		}
+		if err := validateReturnPath(ctx, sesClient, *bounceSource); err != nil {
+			log.Fatalf("Invalid -bounce-source: %s", err)
+		}
+		backend.bounceSource = *bounceSource
+		log.Printf("Using %s as SES Source of null sender messages", *bounceSource)
+	}
+
+	if *userConfigSetsFile != "" {
+		sets, err := loadUserConfigSets(*userConfigSetsFile)
+		if err != nil {
+			log.Fatalf("Error loading user configuration sets: %s", err)
+		}
+		validated := make(map[string]bool)
+		for user, name := range sets {
+			if !validated[name] {
+				if _, err := validateConfigurationSet(ctx, sesClient, name); err != nil {
+					log.Fatalf("Configuration set '%s' for user %s not found or inaccessible: %s", name, user, err)
+				}
+				validated[name] = true
+			}
+			log.Printf("User %s sends with configuration set '%s'", user, name)
+		}
+		backend.userConfigSets = sets
+	}
+
+	if len(listeners) == 0 {
+		addr := DefaultAddr
+		if flag.Arg(0) != "" {
+			addr = flag.Arg(0)
+		} else if flag.NArg() > 1 {
+			log.Fatalf("usage: %s [listen_host:port]", os.Args[0])
+		}
+		listeners = append(listeners, listenerConfig{addr: addr, tenant: DefaultTenant})
+	} else if flag.NArg() > 0 {
+		log.Fatalf("usage: %s [-listen addr[,tenant=NAME]]... (positional address not allowed with -listen)", os.Args[0])
 	}
 
 	if *enablePrometheus {
 		sm := http.NewServeMux()
 		ps := &http.Server{Addr: *prometheusBind, Handler: sm}
-		sm.Handle("/metrics", promhttp.Handler())
+		sm.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
 		go ps.ListenAndServe()
 	}
 
@@ -266,27 +1422,425 @@ func main() {
 		configSetPtr = configurationSetName
 	}
 
-	backend := &Backend{
-		sesClient:     sesClient,
-		configSetName: configSetPtr,
+	backend.sender = &sesSender{client: sesClient}
+	var templateRoutes map[string]templateClient
+	if *senderRoutesFile != "" {
+		routes, err := loadSenderRoutes(*senderRoutesFile)
+		if err != nil {
+			log.Fatalf("Error loading sender routes: %s", err)
+		}
+		if backend.routes, templateRoutes, err = buildSenderRoutes(ctx, sesOpts, routes); err != nil {
+			log.Fatalf("Error creating routed SES clients: %s", err)
+		}
+		backend.sesClients = routeSESClients(backend.routes)
+		switch *senderRoutesFallback {
+		case RouteFallbackDefault:
+		case RouteFallbackReject:
+			backend.rejectUnrouted = true
+		default:
+			log.Fatalf("-sender-routes-fallback must be %s or %s", RouteFallbackDefault, RouteFallbackReject)
+		}
+	}
+	if *batchSize < 1 || *batchSize > SesMaxRecipients {
+		log.Fatalf("-batch-size must be between 1 and %d", SesMaxRecipients)
+	}
+	if err := validateBatchFailurePolicy(*batchFailurePolicy); err != nil {
+		log.Fatal(err)
+	}
+	if *batchFailurePolicy == BatchFailureSpool {
+		if *batchSpoolSize < 1 {
+			log.Fatalf("-batch-spool-size must be positive")
+		}
+		backend.batchSpool = newBatchSpool(*batchSpoolSize)
+	}
+	var retries *retryBudget
+	if *retryBudgetSize > 0 {
+		if *retryBudgetRefill <= 0 {
+			log.Fatalf("-retry-budget-refill must be positive")
+		}
+		retries = newRetryBudget(*retryBudgetSize, *retryBudgetRefill)
+	}
+	wrapSender := func(next Sender) Sender {
+		if *networkRetryAttempts > 1 {
+			next = &networkRetrySender{next: next, attempts: *networkRetryAttempts, backoff: *networkRetryBackoff, budget: retries, ambiguous: *networkRetryAmbiguous}
+		}
+		return &batchingSender{next: next, size: *batchSize, delay: *batchDelay, timeout: *batchTimeout, policy: *batchFailurePolicy}
+	}
+	backend.sender = wrapSender(backend.sender)
+	for domain, sender := range backend.routes {
+		backend.routes[domain] = wrapSender(sender)
+	}
+	backend.configSetName.Store(configSetPtr)
+	backend.sesClients = append([]*ses.Client{sesClient}, backend.sesClients...)
+	backend.enforceDeclaredSize = *enforceDeclaredSize
+	if *greetingTimeout < 0 {
+		log.Fatalf("-greeting-timeout must not be negative")
+	}
+	if *idleTimeout < 0 {
+		log.Fatalf("-idle-timeout must not be negative")
+	}
+	backend.idleTimeout = *idleTimeout
+	if *transactionTimeout < 0 {
+		log.Fatalf("-transaction-timeout must not be negative")
+	}
+	backend.transactionTimeout = *transactionTimeout
+	backend.logPerRecipient = *logPerRecipient
+	backend.logPolicyDecisions = *logPolicyDecisions
+	backend.stripBcc = *stripBcc
+	backend.replyMessageID = *replyMessageID
+	backend.exemplars = *metricsExemplars
+	if *redirectAllTo != "" {
+		backend.redirectAllTo = *redirectAllTo
+		redirectActive.Set(1)
+		log.Printf("WARNING: redirecting ALL mail to %s, real recipients are only kept in %s", *redirectAllTo, OriginalRecipientsHeader)
+	}
+	backend.attachments = newAttachmentPolicy(*blockedExtensions, *blockedTypes)
+	backend.extensions = extensions
+	backend.dateCheck = dateOpts
+	backend.fromAlignment = *fromAlignment
+	backend.eightBitPolicy = *eightBitPolicy
+	backend.missingToPolicy = *missingToPolicy
+	backend.normalizeRecipients = *normalizeRecipients
+	backend.dedupeRecipients = *dedupeRecipients
+	backend.customHeaders = customHeaders
+	backend.customHeaderPolicy = *customHeaderPolicy
+	backend.trackingHeader = *trackingHeader
+	backend.maxHeaderCount = *maxHeaderCount
+	backend.maxMessagesPerConn = *maxMessagesPerConn
+	backend.maxRcptAttempts = *maxRcptAttempts
+	if *maxConnsPerIP < 0 {
+		log.Fatalf("-max-connections-per-ip must not be negative")
+	}
+	if *maxConnsPerIP > 0 {
+		backend.ipLimiter = newIPConnLimiter(*maxConnsPerIP)
+		log.Printf("Limiting connections to %d per client IP", *maxConnsPerIP)
+	}
+	for _, r := range []struct{ flag, kind, value string }{
+		{"ses-rate-limit-reply", throttleRate, *rateLimitReply},
+		{"ses-quota-reply", throttleQuota, *quotaReply},
+	} {
+		if r.value == "" {
+			continue
+		}
+		reply, err := parseReply(r.value)
+		if err != nil {
+			log.Fatalf("Invalid -%s: %s", r.flag, err)
+		}
+		if backend.throttleReplies == nil {
+			backend.throttleReplies = make(map[string]*smtp.SMTPError)
+		}
+		backend.throttleReplies[r.kind] = reply
+		log.Printf("Replying %d %d.%d.%d to SES %s throttling", reply.Code, reply.EnhancedCode[0], reply.EnhancedCode[1], reply.EnhancedCode[2], r.kind)
+	}
+	backend.accountPause = &accountPause{client: sesClient, reply: defaultAccountPausedReply}
+	if *accountPausedReply != "" {
+		reply, err := parseReply(*accountPausedReply)
+		if err != nil {
+			log.Fatalf("Invalid -ses-account-paused-reply: %s", err)
+		}
+		backend.accountPause.reply = reply
+		log.Printf("Replying %s while SES account sending is paused", formatReply(reply))
+	}
+	if *maxConcurrentSends < 0 {
+		log.Fatalf("-max-concurrent-sends must not be negative")
+	}
+	if err := validateFairnessKey(*sendFairnessKey); err != nil {
+		log.Fatalf("Invalid send concurrency configuration: %s", err)
+	}
+	if *sendPriorityHeader != "" {
+		if *maxConcurrentSends == 0 {
+			log.Fatalf("-send-priority-header requires -max-concurrent-sends")
+		}
+		p, err := parseSendPriorities(*sendPriorityHeader, *sendPriorityLevels)
+		if err != nil {
+			log.Fatalf("Invalid -send-priorities: %s", err)
+		}
+		backend.sendPriorities = p
+		log.Printf("Ordering waiting SES sends by %s, priorities %s", p.header, strings.Join(p.names, " > "))
+	}
+	if *maxConcurrentSends > 0 {
+		levels := 1
+		if backend.sendPriorities != nil {
+			levels = len(backend.sendPriorities.names)
+		}
+		backend.sendScheduler = newFairScheduler(*maxConcurrentSends, *sendFairnessKey, levels)
+		log.Printf("Limiting concurrent SES sends to %d, shared fairly by %s", *maxConcurrentSends, *sendFairnessKey)
+	}
+	backend.acceptGzip = *acceptGzip
+	backend.maxHeaderBytes = *maxHeaderBytes
+	backend.minMessageSize = *minMessageSize
+	backend.trackingOverwrite = *trackingOverwrite
+	if *breakerThreshold > 0 {
+		backend.breaker = newCircuitBreaker(*breakerThreshold, *breakerWindow, *breakerCooldown)
+	}
+	backend.declaredSizeTolerance = *declaredSizeTolerance
+	if *byteBudgetLimit > 0 {
+		if *byteBudgetWindow <= 0 {
+			log.Fatalf("-byte-budget-window must be positive")
+		}
+		backend.byteBudget = newByteBudget(*byteBudgetLimit, *byteBudgetWindow)
+		log.Printf("Byte budget: %d bytes per %s", *byteBudgetLimit, *byteBudgetWindow)
+	}
+	if *sesCostPer1000 < 0 || *sesCostPerGB < 0 {
+		log.Fatalf("-ses-cost-per-1000 and -ses-cost-per-gb must not be negative")
+	}
+	backend.costRates = sesCostRates{per1000: *sesCostPer1000, perGB: *sesCostPerGB}
+	if *maxTotalBufferBytes < 0 {
+		log.Fatalf("-max-total-buffer-bytes must not be negative")
+	}
+	if *maxTotalBufferBytes > 0 {
+		if *maxTotalBufferBytes < SesSizeLimit+messageHeadroom {
+			log.Printf("WARNING: -max-total-buffer-bytes %d is below the %d byte message size limit; larger messages are always deferred", *maxTotalBufferBytes, SesSizeLimit)
+		}
+		backend.bufferBudget = &bufferBudget{max: *maxTotalBufferBytes}
+	}
+
+	if *enableTemplates {
+		backend.templates = &templateSender{
+			client:         sesv2.NewFromConfig(awsCfg),
+			triggerAddress: *templateTriggerAddress,
+			routes:         templateRoutes,
+		}
+		log.Printf("Templated sending enabled via %s", *templateTriggerAddress)
+	}
+
+	if *reputationAlarm != "" {
+		if *reputationInterval <= 0 {
+			log.Fatalf("-reputation-poll-interval must be positive")
+		}
+		m := &reputationMonitor{
+			client:   cloudwatch.NewFromConfig(awsCfg),
+			alarm:    *reputationAlarm,
+			interval: *reputationInterval,
+		}
+		state, err := m.alarmState(ctx)
+		if err != nil {
+			log.Fatalf("Reputation alarm '%s' not found or inaccessible: %s", *reputationAlarm, err)
+		}
+		log.Printf("Pausing sending while CloudWatch alarm '%s' is in ALARM (now %s, polled every %s)", m.alarm, state, m.interval)
+		m.poll(ctx)
+		backend.reputation = m
+		go m.run(ctx)
+	}
+
+	if *eventQueueURL != "" {
+		if *eventQueueBuffer < 1 {
+			log.Fatalf("-event-queue-buffer must be positive")
+		}
+		p, err := newEventPublisher(awsCfg, *eventQueueURL, *eventQueueBuffer)
+		if err != nil {
+			log.Fatalf("-event-queue-url: %s", err)
+		}
+		backend.events = p
+		go p.run(ctx)
+		log.Printf("Publishing send events to %s", *eventQueueURL)
+	}
+
+	if *xoauth2TokensFile != "" || *xoauth2IntrospectionURL != "" {
+		a := &xoauth2Authenticator{
+			introspectionURL: *xoauth2IntrospectionURL,
+			clientID:         *xoauth2ClientID,
+			clientSecret:     os.Getenv("XOAUTH2_INTROSPECTION_CLIENT_SECRET"),
+			httpClient:       &http.Client{Timeout: 10 * time.Second},
+		}
+		if *xoauth2TokensFile != "" {
+			if a.static, err = loadTokenFile(*xoauth2TokensFile); err != nil {
+				log.Fatalf("Error loading XOAUTH2 tokens: %s", err)
+			}
+		}
+		backend.xoauth2 = a
+		log.Printf("XOAUTH2 authentication enabled (%d static tokens, introspection: %t)", len(a.static), a.introspectionURL != "")
 	}
 
-	s := smtp.NewServer(backend)
-	s.Addr = addr
-	s.Domain = "localhost"
-	s.AllowInsecureAuth = true // Allow plain auth over non-TLS (as per original design)
+	if *requireAuth && backend.xoauth2 == nil {
+		log.Fatalf("-require-auth needs XOAUTH2 (-xoauth2-tokens-file or -xoauth2-introspection-url)")
+	}
+	backend.rejectAuth = *rejectAuth
+	if *authMetricsPerUser {
+		backend.authFailureUsers = &authFailureUsers{users: make(map[string]bool)}
+	}
+	backend.requireAuth = *requireAuth
+	if *authMechanisms != "" {
+		p, err := parseAuthPolicy(*authMechanisms)
+		if err != nil {
+			log.Fatalf("Invalid -auth-mechanisms: %s", err)
+		}
+		configured := make(map[string]bool)
+		for _, mech := range backend.authConfigured() {
+			configured[mech] = true
+		}
+		for mech := range p {
+			if !configured[mech] {
+				log.Fatalf("-auth-mechanisms lists %s, which is not configured (XOAUTH2 needs a token source, PLAIN -reject-auth)", mech)
+			}
+		}
+		if _, ok := p[XOAuth2]; *requireAuth && !ok {
+			log.Fatalf("-require-auth needs XOAUTH2 in -auth-mechanisms")
+		}
+		backend.authMechanisms = p
+		log.Printf("AUTH mechanisms restricted to %s", *authMechanisms)
+	}
 
+	if tlsConfig != nil {
+		log.Printf("STARTTLS enabled (policy: %s)", tlsOpts.policy)
+	}
+
+	// Validate every listener's TLS settings before any of them starts.
+	listenerTLSConfigs := make([]*tls.Config, len(listeners))
+	listenerRequireTLS := make([]bool, len(listeners))
+	for i, lc := range listeners {
+		if !extensions[ExtStartTLS] {
+			lc.tlsCert, lc.tlsKey = "", ""
+		}
+		cfg, require, err := lc.listenerTLS(tlsConfig, tlsOpts, *requireTLS)
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration for listener %s: %s", lc.addr, err)
+		}
+		listenerTLSConfigs[i], listenerRequireTLS[i] = cfg, require
+	}
+	if backend.authMechanisms != nil && !backend.authMechanisms.usable(listenerTLSConfigs, listenerRequireTLS) {
+		log.Fatalf("-auth-mechanisms: no listener can offer any of the mechanisms (TLS-only mechanisms need STARTTLS)")
+	}
+	var trustedProxies []netip.Prefix
+	if *proxyProtocolTrusted != "" {
+		if trustedProxies, err = parseTrustedProxies(*proxyProtocolTrusted); err != nil {
+			log.Fatalf("Invalid -proxy-protocol-trusted-cidrs: %s", err)
+		}
+		if !slices.ContainsFunc(listeners, func(lc listenerConfig) bool { return lc.proxyProtocolEnabled(*proxyProtocol) }) {
+			log.Fatalf("-proxy-protocol-trusted-cidrs requires -proxy-protocol or a listener with proxy-protocol")
+		}
+		log.Printf("Honoring PROXY protocol headers only from %s", *proxyProtocolTrusted)
+	}
+
+	var servers []*smtp.Server
+	var bound []net.Listener
+	var configListeners []configListener
+	var bridge *tlsBridge // shared by the listeners filtering EHLO over TLS
+	for i, lc := range listeners {
+		l, err := listen(*listenNetwork, lc.addr)
+		if err != nil {
+			log.Fatalf("Error listening on %s: %s", lc.addr, err)
+		}
+		bound = append(bound, l)
+		proxied := lc.proxyProtocolEnabled(*proxyProtocol)
+		if proxied {
+			// Innermost, the header precedes everything else.
+			l = &proxyListener{Listener: l, timeout: *proxyProtocolTimeout, trusted: trustedProxies}
+		}
+		if *greetDelay > 0 {
+			l = &greetPauseListener{Listener: l, delay: *greetDelay}
+		}
+		if *greetingTimeout > 0 {
+			// Outside the greeting pause, so the timeout starts once the
+			// greeting is sent.
+			l = &greetingTimeoutListener{Listener: l, timeout: *greetingTimeout}
+		}
+		smtpTLSConfig := listenerTLSConfigs[i]
+		if hidden := extensions.hidden(); len(hidden) > 0 {
+			fl := &ehloFilterListener{Listener: l, hidden: hidden}
+			if smtpTLSConfig != nil {
+				// The filter handles STARTTLS, go-smtp only sees the bridge.
+				if bridge == nil {
+					if bridge, err = newTLSBridge(); err != nil {
+						log.Fatalf("Error creating the STARTTLS bridge: %s", err)
+					}
+				}
+				fl.tlsConfig, fl.bridge = smtpTLSConfig, bridge
+				smtpTLSConfig = bridge.server
+			}
+			l = fl
+		}
+		// Outermost, so the session can find it under a STARTTLS connection.
+		l = &closeTrackListener{Listener: l}
+
+		s := smtp.NewServer(&listenerBackend{Backend: backend, tenant: lc.tenant, requireTLS: listenerRequireTLS[i]})
+		s.Addr = l.Addr().String()
+		s.Domain = "localhost"
+		s.AllowInsecureAuth = !listenerRequireTLS[i] // Allow plain auth over non-TLS (as per original design) unless TLS is required
+		s.TLSConfig = smtpTLSConfig
+		s.EnableSMTPUTF8 = extensions[ExtSMTPUTF8]
+		s.ReadTimeout = *idleTimeout
+		s.ErrorLog = log.Default()
+		servers = append(servers, s)
+		cl := configListener{Addr: s.Addr, Tenant: lc.tenant, StartTLS: s.TLSConfig != nil, RequireTLS: listenerRequireTLS[i], ProxyProtocol: proxied}
+		if proxied {
+			for _, p := range trustedProxies {
+				cl.ProxyTrusted = append(cl.ProxyTrusted, p.String())
+			}
+		}
+		configListeners = append(configListeners, cl)
+
+		go func() {
+			log.Printf("Listening on %s (network: %s, tenant: %s, starttls: %t, require-tls: %t, proxy-protocol: %t)", l.Addr(), *listenNetwork, lc.tenant, s.TLSConfig != nil, listenerRequireTLS[i], proxied)
+			if err := s.Serve(l); err != nil {
+				log.Printf("Error in Serve: %v", err)
+			}
+		}()
+	}
+
+	backend.config.Store(backend.effectiveConfig(awsCfg.Region, sesOpts, configListeners))
+
+	// Started once the Backend is complete: the handlers read its fields.
+	if *enableHealthCheck {
+		sm := http.NewServeMux()
+		ps := &http.Server{Addr: *healthCheckBind, Handler: sm}
+		backend.registerHealthHandlers(sm)
+		var auth *adminAuth
+		if *adminToken != "" {
+			auth = newAdminAuth(*adminToken, *adminSecret)
+			backend.registerAdminHandlers(sm, auth)
+			if auth.secret != nil {
+				log.Printf("Admin endpoints enabled on %s, signed requests required", *healthCheckBind)
+			} else {
+				log.Printf("Admin endpoints enabled on %s", *healthCheckBind)
+			}
+		}
+		if backend.outbox != nil {
+			backend.registerOutboxHandler(sm, auth)
+			log.Printf("WARNING: outbox enabled, the last %d sent messages are served on %s/outbox (not for production)", *outboxCapacity, *healthCheckBind)
+		}
+		go ps.ListenAndServe()
+		log.Printf("Health check server listening on %s", *healthCheckBind)
+	}
+
+	if *portFile != "" {
+		if err := writePortFile(*portFile, bound); err != nil {
+			log.Fatalf("Error writing -port-file: %s", err)
+		}
+		log.Printf("Wrote bound ports to %s", *portFile)
+	}
+
+	if warmupEnabled {
+		go backend.warmup(ctx, sesClient, *warmupDelay, *warmupSESCheck)
+	}
+
+	// SIGHUP reloads the TLS certificates, e.g. after rotation.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		log.Printf("ListenAndServe on %s", addr)
-		if err := s.ListenAndServe(); err != nil {
-			log.Printf("Error in ListenAndServe: %v", err)
+		for range hup {
+			log.Printf("SIGHUP received, reloading TLS certificates")
+			reloadCertificates()
 		}
 	}()
 
 	select {
 	case <-ctx.Done():
 		log.Printf("SIGTERM/SIGINT received, shutting down")
-		s.Close()
+		for _, s := range servers {
+			s.Close()
+		}
+		if backend.greylist != nil {
+			if err := backend.greylist.save(); err != nil {
+				log.Printf("Error saving greylist: %v", err)
+			}
+		}
+		if backend.batchSpool != nil {
+			backend.batchSpool.wait()
+		}
+		if backend.events != nil {
+			backend.events.wait()
+		}
 		os.Exit(0)
 	}
 }
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testMessage = "From: sender@example.com\r\n" +
+	"To: rcpt@example.net\r\n" +
+	"Subject: test\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+// newTestBackend returns a Backend sending with sender and advertising the
+// default extensions.
+func newTestBackend(t *testing.T, sender Sender) *Backend {
+	t.Helper()
+	exts, err := parseEHLOExtensions(DefaultEHLOExtensions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Backend{sender: sender, extensions: exts}
+}
+
+// startTestServer serves b on a loopback port, as main does for a listener
+// without TLS, and returns its address.
+func startTestServer(t *testing.T, b *Backend) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(b)
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	go s.Serve(&closeTrackListener{Listener: l})
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// newTestSession returns a session of b holding data as the current message,
+// as Data leaves it once the message has been read.
+func newTestSession(t *testing.T, b *Backend, data string) *Session {
+	t.Helper()
+	msg, err := readMessage(strings.NewReader(data), SesSizeLimit, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Session{backend: b, from: "sender@example.com", msg: msg, data: msg.bytes()}
+}
+
+func TestSessionData(t *testing.T) {
+	tests := []struct {
+		name      string
+		sendErr   error
+		wantCode  int    // 0 for success
+		wantReply string // enhanced code expected in the reply
+		wantSent  float64
+		wantFail  float64
+	}{
+		{name: "sent", wantSent: 1},
+		{
+			name:      "rejected",
+			sendErr:   &smithy.GenericAPIError{Code: "MessageRejected", Message: "Email address is blacklisted."},
+			wantCode:  554,
+			wantReply: "5.7.1",
+			wantFail:  1,
+		},
+		{
+			name:      "unverified",
+			sendErr:   &smithy.GenericAPIError{Code: "MessageRejected", Message: "Email address is not verified."},
+			wantCode:  550,
+			wantReply: "5.7.1",
+			wantFail:  1,
+		},
+		{
+			name:      "throttled",
+			sendErr:   &smithy.GenericAPIError{Code: "Throttling", Message: "Maximum sending rate exceeded."},
+			wantCode:  451,
+			wantReply: "4.4.5",
+			wantFail:  1,
+		},
+		{
+			name:      "timeout",
+			sendErr:   context.DeadlineExceeded,
+			wantCode:  451,
+			wantReply: "4.4.1",
+			wantFail:  1,
+		},
+		{
+			name:      "other",
+			sendErr:   errors.New("unexpected"),
+			wantCode:  451,
+			wantReply: "4.3.0",
+			wantFail:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{messageID: "0100-test", err: tt.sendErr}
+			addr := startTestServer(t, newTestBackend(t, sender))
+
+			sent := emailSent.With(prometheus.Labels{"tenant": DefaultTenant})
+			failed := emailError.With(prometheus.Labels{"type": "ses error", "tenant": DefaultTenant})
+			sentBefore, failedBefore := testutil.ToFloat64(sent), testutil.ToFloat64(failed)
+
+			c, err := netsmtp.Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if err := c.Mail("sender@example.com"); err != nil {
+				t.Fatalf("MAIL: %v", err)
+			}
+			for _, rcpt := range []string{"rcpt@example.net", "other@example.org"} {
+				if err := c.Rcpt(rcpt); err != nil {
+					t.Fatalf("RCPT %s: %v", rcpt, err)
+				}
+			}
+			w, err := c.Data()
+			if err != nil {
+				t.Fatalf("DATA: %v", err)
+			}
+			if _, err := w.Write([]byte(testMessage)); err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("DATA reply: %v, want success", err)
+				}
+			} else {
+				var tpErr *textproto.Error
+				if !errors.As(err, &tpErr) {
+					t.Fatalf("DATA reply: %v, want %d", err, tt.wantCode)
+				}
+				if tpErr.Code != tt.wantCode || !strings.HasPrefix(tpErr.Msg, tt.wantReply+" ") {
+					t.Errorf("DATA reply = %d %s, want %d %s", tpErr.Code, tpErr.Msg, tt.wantCode, tt.wantReply)
+				}
+			}
+
+			calls := sender.sent()
+			if len(calls) != 1 {
+				t.Fatalf("SendRaw called %d times, want 1", len(calls))
+			}
+			got := calls[0]
+			if got.from != "sender@example.com" {
+				t.Errorf("SendRaw from = %q, want sender@example.com", got.from)
+			}
+			if strings.Join(got.to, ",") != "rcpt@example.net,other@example.org" {
+				t.Errorf("SendRaw to = %v", got.to)
+			}
+			if string(got.data) != testMessage {
+				t.Errorf("SendRaw data = %q, want %q", got.data, testMessage)
+			}
+			if got.configSet != "" {
+				t.Errorf("SendRaw configSet = %q, want none", got.configSet)
+			}
+
+			if d := testutil.ToFloat64(sent) - sentBefore; d != tt.wantSent {
+				t.Errorf("email_send_success_total increased by %v, want %v", d, tt.wantSent)
+			}
+			if d := testutil.ToFloat64(failed) - failedBefore; d != tt.wantFail {
+				t.Errorf("email_send_fail_total{type=\"ses error\"} increased by %v, want %v", d, tt.wantFail)
+			}
+		})
+	}
+}
+
+// pipelineReplies writes cmds in one write and reads one reply per command.
+func pipelineReplies(t *testing.T, c *textproto.Conn, cmds ...string) []int {
+	t.Helper()
+	if _, err := c.W.WriteString(strings.Join(cmds, "\r\n") + "\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	codes := make([]int, len(cmds))
+	for i, cmd := range cmds {
+		code, msg, err := c.ReadResponse(0)
+		if err != nil && code == 0 {
+			t.Fatalf("reading reply to %q: %v", cmd, err)
+		}
+		t.Logf("%s -> %d %s", cmd, code, msg)
+		codes[i] = code
+	}
+	return codes
+}
+
+func TestPipelining(t *testing.T) {
+	sender := &fakeSender{messageID: "0100-test"}
+	b := newTestBackend(t, sender)
+	// Greylisting is checked at RCPT: the first recipient has been seen
+	// before, the second is deferred.
+	now := time.Now()
+	g, err := newGreylist(time.Minute, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.add(&greylistEntry{key: greylistKey("127.0.0.1", "sender@example.com", "known@example.net"), First: now.Add(-time.Hour), Last: now, Passed: true})
+	b.greylist = g
+	b.routes = map[string]Sender{"example.com": sender}
+	b.rejectUnrouted = true
+	addr := startTestServer(t, b)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(nc)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PrintfLine("EHLO client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	_, ehlo, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ehlo, "\nPIPELINING") {
+		t.Fatalf("EHLO reply does not advertise PIPELINING:\n%s", ehlo)
+	}
+
+	tests := []struct {
+		name string
+		cmds []string
+		want []int
+	}{
+		{
+			name: "greylisted recipient",
+			cmds: []string{"MAIL FROM:<sender@example.com>", "RCPT TO:<known@example.net>", "RCPT TO:<new@example.net>", "DATA"},
+			want: []int{250, 250, 451, 354},
+		},
+		{
+			name: "rejected sender",
+			cmds: []string{"RSET", "MAIL FROM:<sender@unrouted.example>", "RCPT TO:<known@example.net>", "DATA"},
+			want: []int{250, 550, 502, 502},
+		},
+		{
+			name: "no accepted recipient",
+			cmds: []string{"RSET", "MAIL FROM:<sender@example.com>", "RCPT TO:<new@example.net>", "DATA", "NOOP"},
+			want: []int{250, 250, 451, 502, 250},
+		},
+	}
+	for _, tt := range tests {
+		got := pipelineReplies(t, c, tt.cmds...)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: replies %v, want %v", tt.name, got, tt.want)
+		}
+		if tt.want[len(tt.want)-1] != 354 {
+			continue
+		}
+		w := c.DotWriter()
+		w.Write([]byte(testMessage))
+		w.Close()
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("%s: message reply: %v", tt.name, err)
+		}
+	}
+
+	calls := sender.sent()
+	if len(calls) != 1 {
+		t.Fatalf("SendRaw called %d times, want 1", len(calls))
+	}
+	if got := strings.Join(calls[0].to, ","); got != "known@example.net" {
+		t.Errorf("SendRaw to = %s, want known@example.net", got)
+	}
+}
+
+// sendTestMessage sends testMessage from sender@example.com to
+// rcpt@example.net and returns the DATA reply error.
+func sendTestMessage(t *testing.T, addr string) error {
+	t.Helper()
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	if err := c.Rcpt("rcpt@example.net"); err != nil {
+		t.Fatalf("RCPT: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	if _, err := w.Write([]byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	return w.Close()
+}
+
+// TestBreakerProbeSlotTimeout checks that a message timing out while waiting
+// for a send slot does not use up the half-open breaker's probe.
+func TestBreakerProbeSlotTimeout(t *testing.T) {
+	sender := &fakeSender{messageID: "0100-test"}
+	b := newTestBackend(t, sender)
+	b.transactionTimeout = 100 * time.Millisecond
+	b.sendScheduler = newFairScheduler(1, FairnessTenant, 1)
+	b.breaker = newCircuitBreaker(1, time.Minute, time.Minute)
+	b.breaker.record(errors.New("SES down"))
+	b.breaker.openedAt = time.Now().Add(-2 * time.Minute) // cooldown over
+	addr := startTestServer(t, b)
+
+	// Another send holds the only slot.
+	if err := b.sendScheduler.acquire(context.Background(), DefaultTenant, 0); err != nil {
+		t.Fatal(err)
+	}
+	var tpErr *textproto.Error
+	if err := sendTestMessage(t, addr); !errors.As(err, &tpErr) || tpErr.Code != 451 {
+		t.Fatalf("DATA reply with no free slot: %v, want 451", err)
+	}
+	b.sendScheduler.release()
+
+	if err := sendTestMessage(t, addr); err != nil {
+		t.Fatalf("DATA reply once the slot is free: %v, want the probe sent", err)
+	}
+	if n := len(sender.sent()); n != 1 {
+		t.Errorf("SendRaw called %d times, want 1", n)
+	}
+	if b.breaker.state != breakerClosed {
+		t.Errorf("breaker %s after the probe succeeded, want closed", b.breaker.state)
+	}
+}
+
+// TestStartSendRefunds checks that a message refused by the circuit breaker
+// gets back the rate limit tokens and budget bytes taken by earlier checks.
+func TestStartSendRefunds(t *testing.T) {
+	b := newTestBackend(t, &fakeSender{})
+	b.classLimiter = newRateLimiter(map[string]float64{MailClassTransactional: 0.001})
+	b.domainLimiter = newRateLimiter(map[string]float64{DefaultRateLimit: 0.001})
+	b.byteBudget = &byteBudget{limit: 1 << 20, window: time.Hour, start: time.Now()}
+	b.breaker = newCircuitBreaker(1, time.Minute, time.Minute)
+	b.breaker.record(errors.New("SES down"))
+	s := newTestSession(t, b, testMessage)
+	recipients := []string{"rcpt@example.net"}
+
+	var smtpErr *smtp.SMTPError
+	if _, err := s.startSend(recipients); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("startSend with the breaker open: %v, want 451", err)
+	}
+	if ok, _ := b.classLimiter.allow([]string{MailClassTransactional}, time.Now()); !ok {
+		t.Error("class rate limit token not refunded")
+	}
+	if ok, _ := b.domainLimiter.allow(recipientDomains(recipients), time.Now()); !ok {
+		t.Error("domain rate limit token not refunded")
+	}
+	if got := b.byteBudget.remaining(); got != b.byteBudget.limit {
+		t.Errorf("byte budget has %d bytes left, want all %d", got, b.byteBudget.limit)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maintenanceWindow is a period, end excluded, during which mail is
+// deferred.
+type maintenanceWindow struct {
+	start, end time.Time
+}
+
+// maintenanceSchedule implements flag.Value for the repeatable
+// -maintenance-schedule flag. Each value is a window "START/END" of two
+// RFC 3339 times, e.g. "2026-10-20T02:00:00Z/2026-10-20T04:00:00Z".
+type maintenanceSchedule []maintenanceWindow
+
+func (m *maintenanceSchedule) String() string {
+	parts := make([]string, 0, len(*m))
+	for _, w := range *m {
+		parts = append(parts, w.start.Format(time.RFC3339)+"/"+w.end.Format(time.RFC3339))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (m *maintenanceSchedule) Set(value string) error {
+	start, end, ok := strings.Cut(value, "/")
+	if !ok {
+		return fmt.Errorf("expected \"START/END\" RFC 3339 times, got %q", value)
+	}
+	var w maintenanceWindow
+	var err error
+	if w.start, err = time.Parse(time.RFC3339, strings.TrimSpace(start)); err != nil {
+		return fmt.Errorf("invalid window start: %w", err)
+	}
+	if w.end, err = time.Parse(time.RFC3339, strings.TrimSpace(end)); err != nil {
+		return fmt.Errorf("invalid window end: %w", err)
+	}
+	if !w.end.After(w.start) {
+		return fmt.Errorf("window %q ends before it starts", value)
+	}
+	*m = append(*m, w)
+	return nil
+}
+
+// active returns the window containing now, if any.
+func (m maintenanceSchedule) active(now time.Time) (maintenanceWindow, bool) {
+	for _, w := range m {
+		if !now.Before(w.start) && now.Before(w.end) {
+			return w, true
+		}
+	}
+	return maintenanceWindow{}, false
+}
+
+// registerMaintenanceGauge exports whether a window is currently active.
+func registerMaintenanceGauge(m maintenanceSchedule) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "maintenance_active",
+		Help:      "1 while a -maintenance-schedule window is active and mail is deferred",
+	}, func() float64 {
+		if _, ok := m.active(time.Now()); ok {
+			return 1
+		}
+		return 0
+	})
+}
+
+// checkMaintenance defers the message during a maintenance window.
+func (s *Session) checkMaintenance() error {
+	w, ok := s.backend.maintenance.active(time.Now())
+	if !ok {
+		return nil
+	}
+	emailError.With(prometheus.Labels{"type": "maintenance", "tenant": s.tenant}).Inc()
+	s.logf("deferring message from %s, maintenance window until %s", s.from, w.end.Format(time.RFC3339))
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Relay in scheduled maintenance until " + w.end.UTC().Format(time.RFC3339) + ". Please try again later",
+	}
+}
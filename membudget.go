@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	bufferedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "buffered_message_bytes",
+		Help:      "Bytes of message buffers held by sessions between DATA and the SES reply",
+	})
+	bufferBudgetExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "buffer_budget_exceeded_total",
+		Help:      "Total number of messages refused by -max-total-buffer-bytes, by phase: start (before reading) or read",
+	}, []string{"phase"})
+)
+
+// errBufferBudget is returned by readMessage when the message would take
+// the buffers of all sessions over -max-total-buffer-bytes.
+var errBufferBudget = errors.New("total message buffer limit reached")
+
+// errBufferBudgetReply defers a message while the buffer budget is used up.
+var errBufferBudgetReply = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+	Message:      "Server busy: message buffer limit reached. Please try again later",
+}
+
+// bufferBudget bounds the memory held by message buffers across all
+// sessions. Buffers are charged as they grow while DATA is read and
+// released once the message has been sent. A nil budget charges nothing.
+type bufferBudget struct {
+	max  int64
+	used atomic.Int64
+}
+
+// reserve charges n bytes, reporting false, and charging nothing, if that
+// would exceed the budget.
+func (b *bufferBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	if b.used.Add(n) > b.max {
+		b.used.Add(-n)
+		return false
+	}
+	bufferedBytes.Add(float64(n))
+	return true
+}
+
+// release returns n reserved bytes.
+func (b *bufferBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.used.Add(-n)
+	bufferedBytes.Sub(float64(n))
+}
+
+// checkBufferBudget defers a message before it is read if the budget has no
+// room for its first buffer, or for its declared SIZE.
+func (s *Session) checkBufferBudget() error {
+	b := s.backend.bufferBudget
+	if b == nil {
+		return nil
+	}
+	need := max(int64(messageHeadroom+readMessageChunk), s.declaredSize)
+	if used := b.used.Load(); used+need > b.max {
+		bufferBudgetExceeded.With(prometheus.Labels{"phase": "start"}).Inc()
+		s.logf("deferring message from %s, %d of %d -max-total-buffer-bytes in use", s.from, used, b.max)
+		return errBufferBudgetReply
+	}
+	return nil
+}
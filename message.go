@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// messageHeadroom is the space kept free in front of the message data read
+// in DATA, so that the fields the relay prepends fit without moving the
+// message.
+const messageHeadroom = 4 << 10
+
+// messageBuffer holds a message with free space in front of it. Fields are
+// prepended by moving the start back, and removed by moving the bytes
+// before them forward, so header edits copy header bytes only and the body
+// stays where it was read. The SES APIs take the raw message as one byte
+// slice, so that is what bytes returns.
+type messageBuffer struct {
+	buf []byte
+	off int // start of the message in buf
+	// charged is what readMessage reserved from the buffer budget.
+	charged int64
+}
+
+// bytes returns the message. It shares the buffer: later edits change it.
+func (m *messageBuffer) bytes() []byte {
+	return m.buf[m.off:]
+}
+
+// set replaces the message with data, without headroom.
+func (m *messageBuffer) set(data []byte) {
+	m.buf, m.off = data, 0
+}
+
+// holds reports whether data is the current message itself, not a copy.
+func (m *messageBuffer) holds(data []byte) bool {
+	cur := m.bytes()
+	return len(data) == len(cur) && (len(data) == 0 || &data[0] == &cur[0])
+}
+
+// prepend adds p in front of the message. Without enough headroom the
+// message is moved once into a new buffer with fresh headroom.
+func (m *messageBuffer) prepend(p string) {
+	if m.off < len(p) {
+		msg := m.bytes()
+		buf := make([]byte, messageHeadroom+len(p)+len(msg))
+		copy(buf[messageHeadroom+len(p):], msg)
+		m.buf, m.off = buf, messageHeadroom+len(p)
+	}
+	m.off -= len(p)
+	copy(m.buf[m.off:], p)
+}
+
+// remove cuts message bytes start to end by moving the bytes before them
+// forward. Offsets before start stay valid.
+func (m *messageBuffer) remove(start, end int) {
+	n := end - start
+	copy(m.buf[m.off+n:], m.buf[m.off:m.off+start])
+	m.off += n
+}
+
+// readMessageChunk is the buffer readMessage starts with.
+const readMessageChunk = 64 << 10
+
+// readMessage reads at most limit bytes of message data into a buffer with
+// headroom. Once more than limit bytes have arrived it stops reading and
+// returns errMessageTooLarge, even if the same read also failed, so that
+// oversized messages are never reported as I/O errors. go-smtp discards the
+// unread rest of the DATA.
+//
+// hint is the SIZE declared in MAIL FROM, 0 if none. A message outgrowing
+// the first chunk gets a buffer of that size in one step rather than by
+// doubling; a SIZE not backed by data costs nothing.
+//
+// Buffer growth is charged to budget; past it errBufferBudget is returned.
+// Only a message returned without error keeps its charge, for the caller
+// to release.
+func readMessage(r io.Reader, limit, hint int64, budget *bufferBudget) (_ *messageBuffer, err error) {
+	m := &messageBuffer{off: messageHeadroom}
+	defer func() {
+		if err != nil {
+			budget.release(m.charged)
+			m.charged = 0
+		}
+	}()
+	if !m.charge(budget, messageHeadroom+readMessageChunk) {
+		return nil, errBufferBudget
+	}
+	m.buf = make([]byte, messageHeadroom, messageHeadroom+readMessageChunk)
+	lr := io.LimitReader(r, limit+1)
+	for {
+		if len(m.buf) == cap(m.buf) {
+			if want := int64(messageHeadroom) + hint + 1; hint > 0 && hint <= limit && want > int64(cap(m.buf)) {
+				// One byte over hint, so that reading to EOF fits too.
+				if !m.charge(budget, want) {
+					return nil, errBufferBudget
+				}
+				buf := make([]byte, len(m.buf), want)
+				copy(buf, m.buf)
+				m.buf = buf
+			} else {
+				// Let append pick the growth.
+				grown := append(m.buf, 0)[:len(m.buf)]
+				if !m.charge(budget, int64(cap(grown))) {
+					return nil, errBufferBudget
+				}
+				m.buf = grown
+			}
+		}
+		n, err := lr.Read(m.buf[len(m.buf):cap(m.buf)])
+		m.buf = m.buf[:len(m.buf)+n]
+		if int64(len(m.buf)-m.off) > limit {
+			return nil, errMessageTooLarge
+		}
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+}
+
+// charge reserves from budget what a buffer of capacity size adds to the
+// current charge.
+func (m *messageBuffer) charge(budget *bufferBudget, size int64) bool {
+	if !budget.reserve(size - m.charged) {
+		bufferBudgetExceeded.With(prometheus.Labels{"phase": "read"}).Inc()
+		return false
+	}
+	m.charged = size
+	return true
+}
+
+// removeField removes every header field called name from the message, and
+// reports whether there was one.
+func (s *Session) removeField(name string) bool {
+	fields, _ := splitHeader(s.data)
+	var spans [][2]int
+	off := 0
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			spans = append(spans, [2]int{off, off + len(f.raw)})
+		}
+		off += len(f.raw)
+	}
+	// Back to front, since removing a field keeps the offsets before it.
+	for i := len(spans) - 1; i >= 0; i-- {
+		s.msg.remove(spans[i][0], spans[i][1])
+	}
+	s.data = s.msg.bytes()
+	return len(spans) > 0
+}
+
+// prependFields adds block, complete header lines, as the first fields.
+func (s *Session) prependFields(block string) {
+	s.msg.prepend(block)
+	s.data = s.msg.bytes()
+}
+
+// prependField adds "name: value" as the first field.
+func (s *Session) prependField(name, value string) {
+	s.prependFields(name + ": " + value + lineEnding(s.data))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// errAfterReader returns n bytes of 'x' in reads of up to chunk bytes, then
+// err. The read returning the last bytes returns err as well.
+type errAfterReader struct {
+	n, chunk int
+	err      error
+}
+
+func (r *errAfterReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, r.err
+	}
+	k := min(len(p), r.n, r.chunk)
+	copy(p, bytes.Repeat([]byte("x"), k))
+	r.n -= k
+	if r.n == 0 {
+		return k, r.err
+	}
+	return k, nil
+}
+
+func TestReadMessage(t *testing.T) {
+	errReset := errors.New("connection reset")
+	const limit = 200 << 10
+	tests := []struct {
+		name    string
+		r       io.Reader
+		budget  int64 // 0 for no budget
+		wantErr error // nil for success
+		wantLen int
+	}{
+		{"eof", &errAfterReader{n: 1000, chunk: 100, err: io.EOF}, 0, nil, 1000},
+		{"eof at limit", &errAfterReader{n: limit, chunk: 4096, err: io.EOF}, 0, nil, limit},
+		{"error", &errAfterReader{n: 1000, chunk: 100, err: errReset}, 0, errReset, 0},
+		{"error at limit", &errAfterReader{n: limit, chunk: 4096, err: errReset}, 0, errReset, 0},
+		{"oversized", &errAfterReader{n: limit + 1, chunk: 4096, err: io.EOF}, 0, errMessageTooLarge, 0},
+		{"oversized and error", &errAfterReader{n: limit + 1, chunk: 4096, err: errReset}, 0, errMessageTooLarge, 0},
+		{"oversized in one read", &errAfterReader{n: 2 * limit, chunk: 2 * limit, err: errReset}, 0, errMessageTooLarge, 0},
+		{"eof with budget", &errAfterReader{n: 1000, chunk: 100, err: io.EOF}, 1 << 20, nil, 1000},
+		{"error with budget", &errAfterReader{n: 100 << 10, chunk: 4096, err: errReset}, 1 << 20, errReset, 0},
+		{"oversized with budget", &errAfterReader{n: limit + 1, chunk: 4096, err: errReset}, 1 << 20, errMessageTooLarge, 0},
+		{"budget exceeded", &errAfterReader{n: 100 << 10, chunk: 4096, err: io.EOF}, 80 << 10, errBufferBudget, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var budget *bufferBudget
+			if tt.budget > 0 {
+				budget = &bufferBudget{max: tt.budget}
+			}
+			m, err := readMessage(tt.r, limit, 0, budget)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readMessage error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if budget != nil && budget.used.Load() != 0 {
+					t.Errorf("budget holds %d bytes after error, want 0", budget.used.Load())
+				}
+				return
+			}
+			if got := len(m.bytes()); got != tt.wantLen {
+				t.Errorf("read %d bytes, want %d", got, tt.wantLen)
+			}
+			if budget != nil {
+				if used := budget.used.Load(); used != m.charged || used < int64(cap(m.buf)) {
+					t.Errorf("budget holds %d bytes, charged %d, buffer capacity %d", used, m.charged, cap(m.buf))
+				}
+				budget.release(m.charged)
+				if used := budget.used.Load(); used != 0 {
+					t.Errorf("budget holds %d bytes after release, want 0", used)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadMessage reads a message and prepends a tracking header, once
+// into a buffer with headroom as Data does, and once as before, reading it
+// whole and copying it behind the new field.
+func BenchmarkReadMessage(b *testing.B) {
+	const field = "X-Relay-ID: 0123456789abcdef\r\n"
+	for _, size := range []int{64 << 10, 1 << 20, 10 << 20} {
+		data := append([]byte("From: a@example.com\r\nTo: b@example.org\r\nSubject: benchmark\r\n\r\n"),
+			bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ\r\n"), size/64)...)
+
+		b.Run(fmt.Sprintf("headroom/%dKiB", size>>10), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				m, err := readMessage(bytes.NewReader(data), SesSizeLimit, int64(len(data)), nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				m.prepend(field)
+				if len(m.bytes()) != len(field)+len(data) {
+					b.Fatal("wrong length")
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("copy/%dKiB", size>>10), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				msg, err := io.ReadAll(io.LimitReader(bytes.NewReader(data), SesSizeLimit+1))
+				if err != nil {
+					b.Fatal(err)
+				}
+				out := make([]byte, 0, len(field)+len(msg))
+				out = append(append(out, field...), msg...)
+				if len(out) != len(field)+len(data) {
+					b.Fatal("wrong length")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Policies for -missing-to-policy, applied to messages without To and Cc
+// fields.
+const (
+	MissingToOff         = "off"         // relay unchanged
+	MissingToEnvelope    = "envelope"    // add a To field listing the envelope recipients
+	MissingToUndisclosed = "undisclosed" // add "To: undisclosed-recipients:;"
+)
+
+// undisclosedRecipients is the empty group RFC 5322 suggests for messages
+// whose recipients are not to be shown.
+const undisclosedRecipients = "undisclosed-recipients:;"
+
+var missingToAdded = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "missing_to_added_total",
+	Help:      "Total number of messages without To or Cc given a To field by -missing-to-policy",
+}, []string{"policy"})
+
+// addMissingTo adds a To field, as -missing-to-policy says, to a message
+// that has neither To nor Cc. recipients are the envelope recipients the
+// message is sent to.
+func (s *Session) addMissingTo(recipients []string) {
+	policy := s.backend.missingToPolicy
+	if policy == "" || policy == MissingToOff {
+		return
+	}
+	fields, _ := splitHeader(s.data)
+	for _, name := range []string{"To", "Cc"} {
+		if _, ok := getHeader(fields, name); ok {
+			return
+		}
+	}
+	value, desc := undisclosedRecipients, undisclosedRecipients
+	if policy == MissingToEnvelope {
+		value = strings.Join(recipients, ", ")
+		desc = fmt.Sprintf("listing %d envelope recipients", len(recipients))
+	}
+	s.prependFields(foldHeader("To", value, lineEnding(s.data)))
+	missingToAdded.With(prometheus.Labels{"policy": policy}).Inc()
+	s.logf("added To field (%s) to message from %s without To or Cc", desc, s.from)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddMissingTo(t *testing.T) {
+	const bare = "From: a@example.com\r\nSubject: hi\r\n\r\nTo: not a header\r\n"
+	recipients := []string{"one@example.net", "two@example.org"}
+	tests := []struct {
+		name   string
+		policy string
+		data   string
+		want   string
+	}{
+		{"unset", "", bare, bare},
+		{"off", MissingToOff, bare, bare},
+		{"envelope", MissingToEnvelope, bare, "To: one@example.net, two@example.org\r\n" + bare},
+		{"undisclosed", MissingToUndisclosed, bare, "To: undisclosed-recipients:;\r\n" + bare},
+		{"bare LF", MissingToUndisclosed, "From: a@example.com\n\nbody\n", "To: undisclosed-recipients:;\nFrom: a@example.com\n\nbody\n"},
+		{"has To", MissingToEnvelope, "From: a@example.com\r\nTo: x@example.com\r\n\r\nbody\r\n", "From: a@example.com\r\nTo: x@example.com\r\n\r\nbody\r\n"},
+		{"has Cc", MissingToUndisclosed, "From: a@example.com\r\ncc: x@example.com\r\n\r\nbody\r\n", "From: a@example.com\r\ncc: x@example.com\r\n\r\nbody\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession(t, &Backend{missingToPolicy: tt.policy}, tt.data)
+			s.addMissingTo(recipients)
+			if got := string(s.data); got != tt.want {
+				t.Errorf("addMissingTo:\n got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddMissingToFolds(t *testing.T) {
+	var recipients []string
+	for _, c := range "abcdefghij" {
+		recipients = append(recipients, string(c)+"-recipient@example.net")
+	}
+	s := newTestSession(t, &Backend{missingToPolicy: MissingToEnvelope}, "From: a@example.com\r\n\r\nbody\r\n")
+	s.addMissingTo(recipients)
+	fields, _ := splitHeader(s.data)
+	to, ok := getHeader(fields, "To")
+	if !ok {
+		t.Fatalf("no To field in %q", s.data)
+	}
+	if len(fields[0].raw) <= 80 {
+		t.Errorf("To field not folded: %q", fields[0].raw)
+	}
+	for _, r := range recipients {
+		if !strings.Contains(to, r) {
+			t.Errorf("To field %q misses %s", to, r)
+		}
+	}
+}
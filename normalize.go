@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Modes for -normalize-recipients.
+const (
+	NormalizeOff    = "off"
+	NormalizeDomain = "domain" // clean up and lowercase the domain only
+	NormalizeFull   = "full"   // lowercase the local part as well
+)
+
+var recipientsNormalized = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "recipients_normalized_total",
+	Help:      "Total number of RCPT addresses changed by -normalize-recipients",
+})
+
+// validateNormalizeMode rejects unknown -normalize-recipients modes.
+func validateNormalizeMode(mode string) error {
+	switch mode {
+	case NormalizeOff, NormalizeDomain, NormalizeFull:
+		return nil
+	}
+	return fmt.Errorf("unknown -normalize-recipients mode %q (want %s, %s or %s)", mode, NormalizeOff, NormalizeDomain, NormalizeFull)
+}
+
+// normalizeAddress returns addr, a RCPT TO path as parsed by go-smtp, with
+// surrounding whitespace and angle brackets, comments and a trailing dot
+// removed from the domain and the domain lowercased. The local part is case
+// sensitive (RFC 5321 section 2.4) and only lowercased in full mode; it is
+// quoted again if go-smtp unquoted it to something that is not a dot-atom.
+// It returns "" if no usable address remains.
+func normalizeAddress(mode, addr string) string {
+	addr = strings.TrimSpace(addr)
+	i := strings.LastIndexByte(addr, '@')
+	if i <= 0 {
+		return ""
+	}
+	local, domain := addr[:i], stripComments(addr[i+1:])
+	domain = strings.Trim(domain, " \t<>")
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" || strings.ContainsAny(domain, " \t<>@") {
+		return ""
+	}
+	if mode == NormalizeFull {
+		local = strings.ToLower(local)
+	}
+	if !isDotAtom(local) {
+		local = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(local) + `"`
+	}
+	return local + "@" + domain
+}
+
+// stripComments removes parenthesized, possibly nested RFC 5322 comments.
+func stripComments(s string) string {
+	var b strings.Builder
+	depth := 0
+	for _, c := range s {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// isDotAtom reports whether s can be used as a local part without quoting.
+func isDotAtom(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for _, c := range s {
+		if c < 0x80 && !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(".!#$%&'*+-/=?^_`{|}~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeRecipient applies -normalize-recipients to a RCPT TO address.
+func (s *Session) normalizeRecipient(to string) (string, error) {
+	mode := s.backend.normalizeRecipients
+	if mode == "" || mode == NormalizeOff {
+		return to, nil
+	}
+	clean := normalizeAddress(mode, to)
+	if clean == "" {
+		emailError.With(prometheus.Labels{"type": "invalid recipient", "tenant": s.tenant}).Inc()
+		s.logf("invalid recipient address %q", to)
+		return "", &smtp.SMTPError{
+			Code:         501,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      "Bad recipient address syntax",
+		}
+	}
+	if clean != to {
+		recipientsNormalized.Inc()
+		s.logf("normalized recipient %q to %q", to, clean)
+	}
+	return clean, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		mode, in, want string
+	}{
+		{NormalizeDomain, "User@Example.COM", "User@example.com"},
+		{NormalizeFull, "User@Example.COM", "user@example.com"},
+		{NormalizeDomain, "  user@example.com  ", "user@example.com"},
+		{NormalizeDomain, "user@<Example.com>", "user@example.com"},
+		{NormalizeDomain, "user@example.com>", "user@example.com"},
+		{NormalizeDomain, "user@example.com.", "user@example.com"},
+		{NormalizeDomain, "user@(office)Example.com", "user@example.com"},
+		{NormalizeDomain, "user@example.com(nested (comment))", "user@example.com"},
+		{NormalizeDomain, "First Last@example.com", `"First Last"@example.com`},
+		{NormalizeDomain, `a"b@example.com`, `"a\"b"@example.com`},
+		{NormalizeFull, "Mixed.Case+Tag@EXAMPLE.org", "mixed.case+tag@example.org"},
+		{NormalizeDomain, "user@", ""},
+		{NormalizeDomain, "@example.com", ""},
+		{NormalizeDomain, "user", ""},
+		{NormalizeDomain, "user@exa mple.com", ""},
+		{NormalizeDomain, "user@<>", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeAddress(tt.mode, tt.in); got != tt.want {
+			t.Errorf("normalizeAddress(%s, %q) = %q, want %q", tt.mode, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeRecipient(t *testing.T) {
+	tests := []struct {
+		mode, in, want string
+		wantErr        bool
+	}{
+		{NormalizeOff, " User@<Example.COM> ", " User@<Example.COM> ", false},
+		{"", "User@Example.COM", "User@Example.COM", false},
+		{NormalizeDomain, "User@<Example.COM>", "User@example.com", false},
+		{NormalizeFull, "User@<Example.COM>", "user@example.com", false},
+		{NormalizeDomain, "user@<>", "", true},
+	}
+	for _, tt := range tests {
+		s := &Session{backend: &Backend{normalizeRecipients: tt.mode}}
+		got, err := s.normalizeRecipient(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeRecipient(%s, %q) = %q, %v, want %q, error %t", tt.mode, tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
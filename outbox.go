@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// outboxEntry describes one message accepted by SES.
+type outboxEntry struct {
+	Time          time.Time           `json:"time"`
+	RelayID       string              `json:"relay_id"`
+	Conn          string              `json:"conn"`
+	Tenant        string              `json:"tenant"`
+	From          string              `json:"from"`
+	Recipients    []string            `json:"recipients"`
+	MessageID     string              `json:"message_id"`
+	ConfigSet     string              `json:"configuration_set,omitempty"`
+	Template      string              `json:"template,omitempty"`
+	Size          int                 `json:"size"`
+	Headers       map[string][]string `json:"headers"`
+	Body          *string             `json:"body,omitempty"`
+	BodyTruncated bool                `json:"body_truncated,omitempty"`
+}
+
+// outbox keeps the most recently sent messages in a ring buffer for the
+// /outbox debugging endpoint. It holds message content and must not be
+// enabled in production.
+type outbox struct {
+	bodyBytes int // 0 leaves bodies out
+
+	mu      sync.Mutex
+	entries []outboxEntry
+	next    int
+	full    bool
+}
+
+func newOutbox(capacity, bodyBytes int) *outbox {
+	return &outbox{bodyBytes: bodyBytes, entries: make([]outboxEntry, capacity)}
+}
+
+func (o *outbox) add(e outboxEntry) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries[o.next] = e
+	o.next = (o.next + 1) % len(o.entries)
+	if o.next == 0 {
+		o.full = true
+	}
+}
+
+// list returns the entries, newest first.
+func (o *outbox) list() []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := o.next
+	if o.full {
+		n = len(o.entries)
+	}
+	out := make([]outboxEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, o.entries[(o.next-i+len(o.entries))%len(o.entries)])
+	}
+	return out
+}
+
+// recordOutbox adds the message just sent to the outbox, if enabled.
+func (s *Session) recordOutbox(recipients []string, messageID, template string) {
+	o := s.backend.outbox
+	if o == nil {
+		return
+	}
+	fields, rest := splitHeader(s.data)
+	e := outboxEntry{
+		Time:       time.Now().UTC(),
+		RelayID:    s.trackingID,
+		Conn:       s.connID,
+		Tenant:     s.tenant,
+		From:       s.from,
+		Recipients: append([]string(nil), recipients...),
+		MessageID:  messageID,
+		ConfigSet:  aws.ToString(s.configSet()),
+		Template:   template,
+		Size:       len(s.data),
+		Headers:    make(map[string][]string),
+	}
+	for _, f := range fields {
+		e.Headers[f.name] = append(e.Headers[f.name], f.value())
+	}
+	if o.bodyBytes > 0 {
+		// rest starts with the blank line ending the header.
+		_, body, _ := strings.Cut(string(rest), "\n")
+		if len(body) > o.bodyBytes {
+			body, e.BodyTruncated = body[:o.bodyBytes], true
+		}
+		e.Body = &body
+	}
+	o.add(e)
+}
+
+// registerOutboxHandler serves the outbox as JSON on /outbox, behind the
+// admin token when one is configured (auth not nil).
+func (b *Backend) registerOutboxHandler(sm *http.ServeMux, auth *adminAuth) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.outbox.list())
+	}
+	if auth != nil {
+		sm.Handle("/outbox", requireAdmin(auth, http.MethodGet, h))
+		return
+	}
+	sm.HandleFunc("/outbox", h)
+}
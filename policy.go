@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Outcomes of a policy check in the -log-policy-decisions log.
+const (
+	decisionPass   = "pass"
+	decisionDefer  = "defer"  // 4xx reply
+	decisionReject = "reject" // 5xx reply
+	decisionError  = "error"  // not an SMTP reply, go-smtp picks the code
+)
+
+// decide logs the outcome of the policy check named check for
+// -log-policy-decisions and returns err unchanged, so that checks can be
+// wrapped in place.
+func (s *Session) decide(check string, err error) error {
+	return s.logDecision(check, "", err)
+}
+
+// logDecision writes one key=value record for a policy check and returns
+// err. detail says what was checked or what matched.
+func (s *Session) logDecision(check, detail string, err error) error {
+	if !s.backend.logPolicyDecisions || s.probe {
+		return err
+	}
+	result, reply := decisionPass, ""
+	var smtpErr *smtp.SMTPError
+	switch {
+	case errors.As(err, &smtpErr):
+		result = decisionReject
+		if smtpErr.Code < 500 {
+			result = decisionDefer
+		}
+		reply = formatReply(smtpErr)
+	case err != nil:
+		result, reply = decisionError, err.Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "policy_decision check=%s result=%s tenant=%s", check, result, s.tenant)
+	if detail != "" {
+		fmt.Fprintf(&b, " detail=%q", detail)
+	}
+	if reply != "" {
+		fmt.Fprintf(&b, " reply=%q", reply)
+	}
+	s.logf("%s", b.String())
+	return err
+}
+
+// routeDetail names the -sender-routes-file route used for from, for the
+// decision log.
+func (b *Backend) routeDetail(from string) string {
+	_, domain, _ := strings.Cut(from, "@")
+	if _, ok := b.routes[strings.ToLower(domain)]; ok {
+		return "route=" + strings.ToLower(domain)
+	}
+	return "route=default"
+}
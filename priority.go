@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultSendPriorities is the -send-priorities default, matching the
+// X-Priority values 1 (Highest) to 5 (Lowest).
+const DefaultSendPriorities = "high=1,2;normal=3,*;low=4,5"
+
+var sendPriorityWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "smtpd",
+	Name:      "send_priority_wait_seconds",
+	Help:      "Time messages waited for one of the -max-concurrent-sends slots, by -send-priorities level",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+}, []string{"priority"})
+
+// sendPriorities orders waiting sends by a header of the message.
+type sendPriorities struct {
+	header string
+	// names are the levels, highest priority first.
+	names []string
+	// levels maps lowercased header values to their level.
+	levels map[string]int
+	// fallback is the level of messages without a listed value.
+	fallback int
+}
+
+// parseSendPriorities parses the -send-priorities levels, highest first,
+// as "name=value,value;name=value", e.g. "high=1,2;normal=3,*;low=4,5".
+// The value * marks the level of messages without the header or with an
+// unlisted value; exactly one level must have it.
+func parseSendPriorities(header, spec string) (*sendPriorities, error) {
+	p := &sendPriorities{header: header, levels: make(map[string]int), fallback: -1}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, values, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("level %q: want \"name=value,...\"", entry)
+		}
+		level := len(p.names)
+		for _, v := range strings.Split(values, ",") {
+			v = strings.ToLower(strings.TrimSpace(v))
+			switch {
+			case v == "":
+				return nil, fmt.Errorf("level %q: empty value", name)
+			case v == "*":
+				if p.fallback >= 0 {
+					return nil, fmt.Errorf("level %q: * already given for level %q", name, p.names[p.fallback])
+				}
+				p.fallback = level
+			default:
+				if prev, dup := p.levels[v]; dup {
+					return nil, fmt.Errorf("level %q: value %q already given for level %q", name, v, p.names[prev])
+				}
+				p.levels[v] = level
+			}
+		}
+		p.names = append(p.names, name)
+	}
+	if len(p.names) == 0 {
+		return nil, errors.New("no level given")
+	}
+	if p.fallback < 0 {
+		return nil, errors.New("no level marked * for messages without a listed value")
+	}
+	return p, nil
+}
+
+// level returns the level of a header value. Only its first word counts,
+// so "1 (Highest)" matches 1.
+func (p *sendPriorities) level(value string) int {
+	if f := strings.Fields(value); len(f) > 0 {
+		if level, ok := p.levels[strings.ToLower(f[0])]; ok {
+			return level
+		}
+	}
+	return p.fallback
+}
+
+// sendPriority returns the -send-priorities level of the message and its
+// name, 0 and "" when priorities are not configured.
+func (s *Session) sendPriority() (int, string) {
+	p := s.backend.sendPriorities
+	if p == nil {
+		return 0, ""
+	}
+	fields, _ := splitHeader(s.data)
+	value, _ := getHeader(fields, p.header)
+	level := p.level(value)
+	return level, p.names[level]
+}
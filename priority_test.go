@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSendPriorities(t *testing.T) {
+	p, err := parseSendPriorities("X-Priority", DefaultSendPriorities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(p.names, ",") != "high,normal,low" {
+		t.Errorf("levels %v, want high,normal,low", p.names)
+	}
+	for value, want := range map[string]int{
+		"1":           0,
+		"2 (High)":    0,
+		"3":           1,
+		"5 (Lowest)":  2,
+		"4":           2,
+		"":            1,
+		"urgent":      1,
+		"  1  ":       0,
+		"(Highest) 1": 1, // only the first word counts
+	} {
+		if got := p.level(value); got != want {
+			t.Errorf("level(%q) = %d, want %d", value, got, want)
+		}
+	}
+
+	p, err = parseSendPriorities("Importance", "urgent=High; rest=*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.level("high") != 0 || p.level("low") != 1 {
+		t.Errorf("values are not matched case-insensitively: high=%d low=%d", p.level("high"), p.level("low"))
+	}
+
+	for _, spec := range []string{
+		"",
+		"high=1",                 // no *
+		"high=1,*;low=*",         // two *
+		"high=1;low=1,*",         // value in two levels
+		"high=1,,2;low=*",        // empty value
+		"=1;low=*",               // no name
+		"high;low=*",             // no =
+		"high=1;normal=*;low=1 ", // duplicate after trimming
+	} {
+		if _, err := parseSendPriorities("X-Priority", spec); err == nil {
+			t.Errorf("parseSendPriorities(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestSendPriority(t *testing.T) {
+	b := newTestBackend(t, &fakeSender{})
+	s := newTestSession(t, b, "X-Priority: 1 (Highest)\r\n\r\nbody\r\n")
+	if level, name := s.sendPriority(); level != 0 || name != "" {
+		t.Errorf("sendPriority() without -send-priorities = %d %q, want 0 \"\"", level, name)
+	}
+
+	p, err := parseSendPriorities("X-Priority", DefaultSendPriorities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.sendPriorities = p
+	if level, name := s.sendPriority(); level != 0 || name != "high" {
+		t.Errorf("sendPriority() = %d %q, want 0 high", level, name)
+	}
+	s = newTestSession(t, b, testMessage)
+	if level, name := s.sendPriority(); level != 1 || name != "normal" {
+		t.Errorf("sendPriority() without the header = %d %q, want 1 normal", level, name)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var proxyConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "proxy_protocol_connection_total",
+	Help:      "Total number of connections on PROXY protocol listeners by header command",
+}, []string{"command"})
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the longest version 1 header, CRLF included.
+const proxyV1MaxLength = 107
+
+// proxyListener expects a PROXY protocol (version 1 or 2) header on every
+// accepted connection, as sent by HAProxy's send-proxy and send-proxy-v2,
+// and reports the client address it carries as the remote address.
+// Connections without a valid header are closed.
+//
+// With trusted set, only connections from those networks must and may send
+// the header. Others are served as direct connections with their own
+// address, and closed if they send a header anyway.
+type proxyListener struct {
+	net.Listener
+	timeout time.Duration
+	trusted []netip.Prefix
+}
+
+// Accept implements net.Listener
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.trusted != nil && !addrInPrefixes(c.RemoteAddr(), l.trusted) {
+		proxyConnections.With(prometheus.Labels{"command": "direct"}).Inc()
+		return &untrustedProxyConn{Conn: c}, nil
+	}
+	return &proxyConn{Conn: c, timeout: l.timeout}, nil
+}
+
+// parseTrustedProxies parses -proxy-protocol-trusted-cidrs, a comma
+// separated list of networks or single addresses. IPv4-mapped IPv6 entries
+// are stored as IPv4, as addrInPrefixes compares peers unmapped.
+func parseTrustedProxies(spec string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range strings.Split(spec, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		if a := prefix.Addr(); a.Is4In6() {
+			if prefix.Bits() < 96 {
+				return nil, fmt.Errorf("%s: IPv4-mapped network shorter than /96", v)
+			}
+			prefix = netip.PrefixFrom(a.Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.New("no network given")
+	}
+	return prefixes, nil
+}
+
+// addrInPrefixes reports whether the IP of addr, a *net.TCPAddr, is in one
+// of prefixes. IPv4-mapped IPv6 addresses match IPv4 networks.
+func addrInPrefixes(addr net.Addr, prefixes []netip.Prefix) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcp.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// untrustedProxyConn is a direct connection on a PROXY protocol listener.
+// Its first data is checked for a PROXY header, which would otherwise reach
+// go-smtp as a command; the connection is closed instead, as the client is
+// trying to pass off another address as its own.
+type untrustedProxyConn struct {
+	net.Conn
+	checked bool // only used from the connection's goroutine
+}
+
+// Read implements net.Conn
+func (c *untrustedProxyConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.checked || n == 0 {
+		return n, err
+	}
+	c.checked = true
+	if bytes.HasPrefix(b[:n], []byte("PROXY ")) || (n >= 5 && bytes.HasPrefix(proxyV2Signature, b[:min(n, len(proxyV2Signature))])) {
+		proxyConnections.With(prometheus.Labels{"command": "untrusted"}).Inc()
+		log.Printf("rejecting connection from %s: PROXY protocol header from outside -proxy-protocol-trusted-cidrs", c.RemoteAddr())
+		c.Conn.Close()
+		// go-smtp ends the connection quietly on EOF.
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// proxyLocalAddr is the remote address of a connection the proxy opened on
+// its own behalf (the LOCAL command, or UNKNOWN in version 1), typically a
+// health check. It is the proxy's own address.
+type proxyLocalAddr struct {
+	net.Addr
+}
+
+// isProxyHealthCheck reports whether addr belongs to a connection made by
+// the proxy itself rather than relayed for a client.
+func isProxyHealthCheck(addr net.Addr) bool {
+	_, ok := addr.(proxyLocalAddr)
+	return ok
+}
+
+// proxyConn reads the PROXY header before the first read, write or deadline
+// change, so that the wait happens on the connection's own goroutine and
+// ahead of the greeting pause.
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+}
+
+func (c *proxyConn) handshake() error {
+	c.once.Do(func() {
+		c.remote, c.err = c.readHeader()
+		if c.err != nil {
+			proxyConnections.With(prometheus.Labels{"command": "error"}).Inc()
+			log.Printf("rejecting connection from %s: invalid PROXY protocol header: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+			return
+		}
+		command := "proxy"
+		if isProxyHealthCheck(c.remote) {
+			command = "local"
+		}
+		proxyConnections.With(prometheus.Labels{"command": command}).Inc()
+	})
+	return c.err
+}
+
+// Read implements net.Conn
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// Write implements net.Conn
+func (c *proxyConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// SetDeadline implements net.Conn
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	if err := c.handshake(); err != nil {
+		return err
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	if err := c.handshake(); err != nil {
+		return err
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// RemoteAddr implements net.Conn
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.handshake() != nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// readHeader reads the PROXY header, without reading past it, and returns
+// the client address.
+func (c *proxyConn) readHeader() (net.Addr, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	start := make([]byte, 5)
+	if _, err := io.ReadFull(c.Conn, start); err != nil {
+		return nil, err
+	}
+	switch {
+	case string(start) == "PROXY":
+		return c.readV1(start)
+	case bytes.Equal(start, proxyV2Signature[:5]):
+		return c.readV2(start)
+	}
+	return nil, errors.New("missing PROXY header")
+}
+
+// readV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n". The line
+// is read a byte at a time so that nothing after it is consumed.
+func (c *proxyConn) readV1(start []byte) (net.Addr, error) {
+	line := append([]byte(nil), start...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("version 1 header too long")
+		}
+		if _, err := io.ReadFull(c.Conn, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return proxyLocalAddr{c.Conn.RemoteAddr()}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed version 1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("malformed version 1 header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 parses a binary version 2 header. LOCAL commands and families other
+// than TCP over IPv4 or IPv6 keep the connection's own address, only the
+// former marking a health check; TLVs are skipped.
+func (c *proxyConn) readV2(start []byte) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	copy(hdr, start)
+	if _, err := io.ReadFull(c.Conn, hdr[len(start):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return nil, errors.New("bad version 2 signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL
+		return proxyLocalAddr{c.Conn.RemoteAddr()}, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unknown version 2 command %#x", hdr[12]&0x0f)
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return c.Conn.RemoteAddr(), nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("version 2 address block too short")
+	}
+	ip := net.IP(append([]byte(nil), payload[:ipLen]...))
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// proxyV2Header returns a version 2 header with command cmd (0 LOCAL, 1
+// PROXY), address family and protocol fam and the given address block.
+func proxyV2Header(cmd, fam byte, block []byte) []byte {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x20|cmd, fam)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(block)))
+	return append(hdr, block...)
+}
+
+// proxyV2Block returns the address block for src:sport to dst:dport.
+func proxyV2Block(src, dst net.IP, sport, dport uint16) []byte {
+	block := append(append([]byte(nil), src...), dst...)
+	block = binary.BigEndian.AppendUint16(block, sport)
+	return binary.BigEndian.AppendUint16(block, dport)
+}
+
+// pipeProxyConn returns a proxyConn reading what is written to client after
+// the conn has been set up, and the client end.
+func pipeProxyConn(t *testing.T) (*proxyConn, net.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &proxyConn{Conn: server, timeout: time.Second}, client
+}
+
+func TestProxyConnV2(t *testing.T) {
+	const command = "EHLO client.example.com\r\n"
+	tests := []struct {
+		name        string
+		header      []byte
+		wantAddr    string // "" for the pipe's own address
+		healthCheck bool
+	}{
+		{
+			name:        "local",
+			header:      proxyV2Header(0x0, 0x00, nil),
+			healthCheck: true,
+		},
+		{
+			name:        "local with addresses",
+			header:      proxyV2Header(0x0, 0x11, proxyV2Block(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 4242, 25)),
+			healthCheck: true,
+		},
+		{
+			name:     "tcp4",
+			header:   proxyV2Header(0x1, 0x11, proxyV2Block(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 4242, 25)),
+			wantAddr: "192.0.2.1:4242",
+		},
+		{
+			name:     "tcp6",
+			header:   proxyV2Header(0x1, 0x21, proxyV2Block(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 4242, 25)),
+			wantAddr: "[2001:db8::1]:4242",
+		},
+		{
+			name:     "tcp4 with TLVs",
+			header:   proxyV2Header(0x1, 0x11, append(proxyV2Block(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 4242, 25), 0x04, 0x00, 0x01, 0xff)),
+			wantAddr: "192.0.2.1:4242",
+		},
+		{
+			name:   "unix",
+			header: proxyV2Header(0x1, 0x31, make([]byte, 216)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client := pipeProxyConn(t)
+			go client.Write(append(tt.header, command...))
+
+			buf := make([]byte, len(command))
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Fatalf("reading after header: %v", err)
+			}
+			if string(buf) != command {
+				t.Errorf("read %q after header, want %q", buf, command)
+			}
+			addr := c.RemoteAddr()
+			if got := isProxyHealthCheck(addr); got != tt.healthCheck {
+				t.Errorf("isProxyHealthCheck(%v) = %t, want %t", addr, got, tt.healthCheck)
+			}
+			want := tt.wantAddr
+			if want == "" {
+				want = c.Conn.RemoteAddr().String()
+			}
+			if addr.String() != want {
+				t.Errorf("RemoteAddr = %v, want %s", addr, want)
+			}
+		})
+	}
+}
+
+func TestProxyConnV2Invalid(t *testing.T) {
+	tcp4 := proxyV2Block(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 4242, 25)
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"truncated address block", proxyV2Header(0x1, 0x11, tcp4[:8])},
+		{"tcp4 in tcp6 length", proxyV2Header(0x1, 0x21, tcp4)},
+		{"short payload", proxyV2Header(0x1, 0x11, tcp4)[:16+6]},
+		{"bad version", append(append([]byte(nil), proxyV2Signature...), 0x11, 0x11, 0, 0)},
+		{"unknown command", proxyV2Header(0x2, 0x11, tcp4)},
+		{"bad signature", append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client := pipeProxyConn(t)
+			go func() {
+				client.Write(tt.header)
+				client.Close()
+			}()
+			if _, err := c.Read(make([]byte, 1)); err == nil {
+				t.Fatal("Read succeeded, want header error")
+			}
+			if isProxyHealthCheck(c.RemoteAddr()) {
+				t.Error("invalid header reported as a health check")
+			}
+		})
+	}
+}
+
+func TestProxyConnV1(t *testing.T) {
+	tests := []struct {
+		header      string
+		wantAddr    string
+		healthCheck bool
+		wantErr     bool
+	}{
+		{header: "PROXY TCP4 192.0.2.1 198.51.100.1 4242 25\r\n", wantAddr: "192.0.2.1:4242"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 4242 25\r\n", wantAddr: "[2001:db8::1]:4242"},
+		{header: "PROXY UNKNOWN\r\n", healthCheck: true},
+		{header: "PROXY TCP4 2001:db8::1 198.51.100.1 4242 25\r\n", wantErr: true},
+		{header: "PROXY TCP4 192.0.2.1\r\n", wantErr: true},
+		{header: "EHLO client.example.com\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			c, client := pipeProxyConn(t)
+			go func() {
+				client.Write([]byte(tt.header + "QUIT\r\n"))
+			}()
+			buf := make([]byte, 6)
+			_, err := io.ReadFull(c, buf)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("read %q, want header error", buf)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(buf, []byte("QUIT\r\n")) {
+				t.Fatalf("read %q, %v after header", buf, err)
+			}
+			addr := c.RemoteAddr()
+			if isProxyHealthCheck(addr) != tt.healthCheck {
+				t.Errorf("isProxyHealthCheck(%v) = %t, want %t", addr, !tt.healthCheck, tt.healthCheck)
+			}
+			if !tt.healthCheck && addr.String() != tt.wantAddr {
+				t.Errorf("RemoteAddr = %v, want %s", addr, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{spec: "10.0.0.1", want: "[10.0.0.1/32]"},
+		{spec: "10.1.2.3/8", want: "[10.0.0.0/8]"},
+		{spec: " 192.0.2.0/24 , 2001:db8::1 ", want: "[192.0.2.0/24 2001:db8::1/128]"},
+		{spec: "2001:db8::/32", want: "[2001:db8::/32]"},
+		{spec: "::ffff:10.0.0.1", want: "[10.0.0.1/32]"},
+		{spec: "::ffff:10.0.0.0/104", want: "[10.0.0.0/8]"},
+		{spec: "::ffff:0:0/64", wantErr: true},
+		{spec: "", wantErr: true},
+		{spec: " , ", wantErr: true},
+		{spec: "proxy.example.com", wantErr: true},
+		{spec: "10.0.0.0/33", wantErr: true},
+	}
+	for _, tt := range tests {
+		prefixes, err := parseTrustedProxies(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTrustedProxies(%q) error = %v, want error %t", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && fmt.Sprint(prefixes) != tt.want {
+			t.Errorf("parseTrustedProxies(%q) = %v, want %s", tt.spec, prefixes, tt.want)
+		}
+	}
+}
+
+func TestAddrInPrefixes(t *testing.T) {
+	prefixes, err := parseTrustedProxies("10.0.0.0/8,192.0.2.7,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.IPv4(10, 1, 2, 3).To4(), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.8"), Port: 1234}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::25"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db9::25"), Port: 1234}, false},
+		{&net.TCPAddr{IP: net.ParseIP("::a01:203"), Port: 1234}, false}, // IPv4-compatible, not mapped
+		{&net.UnixAddr{Name: "/run/smtpd.sock", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		if got := addrInPrefixes(tt.addr, prefixes); got != tt.want {
+			t.Errorf("addrInPrefixes(%v) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// remoteAddrConn overrides the remote address of a pipe end.
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+// pipeListener accepts the server ends of pipes as connections from addr.
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+func (l *pipeListener) Close() error   { return nil }
+func (l *pipeListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25} }
+
+// acceptFrom accepts a pipe connection from peer on a PROXY protocol
+// listener trusting trusted, and returns the accepted conn and the client
+// end.
+func acceptFrom(t *testing.T, trusted []netip.Prefix, peer string) (net.Conn, net.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	pl := &pipeListener{conns: make(chan net.Conn, 1)}
+	pl.conns <- &remoteAddrConn{Conn: server, remote: net.TCPAddrFromAddrPort(netip.MustParseAddrPort(peer))}
+	l := &proxyListener{Listener: pl, timeout: time.Second, trusted: trusted}
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, client
+}
+
+func TestProxyListenerTrust(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8,192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const v1 = "PROXY TCP4 203.0.113.9 10.0.0.1 4242 25\r\n"
+	const command = "EHLO client.example.com\r\n"
+	v2 := string(proxyV2Header(0x1, 0x11, proxyV2Block(net.IPv4(203, 0, 113, 9).To4(), net.IPv4(10, 0, 0, 1).To4(), 4242, 25)))
+	tests := []struct {
+		name     string
+		trusted  []netip.Prefix
+		peer     string
+		send     string
+		wantAddr string // "" if the connection must be closed
+	}{
+		{"trusted CIDR", trusted, "10.1.2.3:5000", v1 + command, "203.0.113.9:4242"},
+		{"trusted address", trusted, "192.0.2.7:5000", v2 + command, "203.0.113.9:4242"},
+		{"trusted mapped peer", trusted, "[::ffff:10.1.2.3]:5000", v1 + command, "203.0.113.9:4242"},
+		{"trusted without header", trusted, "10.1.2.3:5000", command, ""},
+		{"all trusted", nil, "198.51.100.1:5000", v1 + command, "203.0.113.9:4242"},
+		{"untrusted direct", trusted, "198.51.100.1:5000", command, "198.51.100.1:5000"},
+		{"untrusted mapped peer direct", trusted, "[::ffff:198.51.100.1]:5000", command, "198.51.100.1:5000"},
+		{"untrusted v1", trusted, "198.51.100.1:5000", v1 + command, ""},
+		{"untrusted v2", trusted, "198.51.100.1:5000", v2 + command, ""},
+		{"untrusted mapped peer v1", trusted, "[::ffff:192.0.2.8]:5000", v1 + command, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client := acceptFrom(t, tt.trusted, tt.peer)
+			go client.Write([]byte(tt.send))
+
+			buf := make([]byte, len(command))
+			_, err := io.ReadFull(c, buf)
+			if tt.wantAddr == "" {
+				if err == nil {
+					t.Fatalf("read %q, want the connection closed", buf)
+				}
+				// The client end sees the close.
+				client.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("client read after close = %v, want EOF", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading command: %v", err)
+			}
+			if string(buf) != command {
+				t.Errorf("read %q, want %q", buf, command)
+			}
+			if got := c.RemoteAddr().String(); got != tt.wantAddr {
+				t.Errorf("RemoteAddr = %s, want %s", got, tt.wantAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimit is the rate limit key applying to every key without a
+// limit of its own.
+const DefaultRateLimit = "*"
+
+// rateFlags implements flag.Value for the repeatable -domain-rate-limit and
+// -class-rate-limit flags. Each value has the form "key=RATE", RATE being
+// messages per second. Keys are lowercased.
+type rateFlags map[string]float64
+
+func (f rateFlags) String() string {
+	parts := make([]string, 0, len(f))
+	for key, rate := range f {
+		parts = append(parts, key+"="+strconv.FormatFloat(rate, 'g', -1, 64))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f rateFlags) Set(value string) error {
+	key, rate, ok := strings.Cut(value, "=")
+	key = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(key), "."))
+	r, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+	if !ok || key == "" || err != nil || r <= 0 {
+		return fmt.Errorf("expected \"key=messages-per-second\" with a positive rate, got %q", value)
+	}
+	f[key] = r
+	return nil
+}
+
+// rateBucket is the token bucket of one key. It holds up to max(rate, 1)
+// tokens, one per message.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter paces messages per key, such as a recipient domain. Buckets
+// of keys under the "*" default are created on demand and evicted once
+// refilled, as a full bucket is the same as a new one.
+type rateLimiter struct {
+	rates map[string]float64
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(rates map[string]float64) *rateLimiter {
+	return &rateLimiter{rates: rates, buckets: make(map[string]*rateBucket), lastPrune: time.Now()}
+}
+
+// rate returns the limit for key and the name it is configured under, or 0
+// if the key is not limited.
+func (l *rateLimiter) rate(key string) (float64, string) {
+	if r, ok := l.rates[key]; ok {
+		return r, key
+	}
+	if r, ok := l.rates[DefaultRateLimit]; ok {
+		return r, DefaultRateLimit
+	}
+	return 0, ""
+}
+
+// bucket returns the refilled bucket of key. l.mu must be held.
+func (l *rateLimiter) bucket(key string, rate float64, now time.Time) *rateBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: max(rate, 1), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(max(rate, 1), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	return b
+}
+
+// allow takes a token from the bucket of every key, or from none if one of
+// them is empty, whose configured name is then returned.
+func (l *rateLimiter) allow(keys []string, now time.Time) (bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) >= time.Minute {
+		l.prune(now)
+	}
+
+	var take []*rateBucket
+	for _, key := range keys {
+		rate, name := l.rate(key)
+		if rate == 0 {
+			continue
+		}
+		b := l.bucket(key, rate, now)
+		if b.tokens < 1 {
+			return false, name
+		}
+		take = append(take, b)
+	}
+	for _, b := range take {
+		b.tokens--
+	}
+	return true, ""
+}
+
+// refund gives back the tokens allow took for keys, for a message a later
+// check refused.
+func (l *rateLimiter) refund(keys []string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		rate, _ := l.rate(key)
+		if rate == 0 {
+			continue
+		}
+		b := l.bucket(key, rate, now)
+		b.tokens = min(max(rate, 1), b.tokens+1)
+	}
+}
+
+// prune evicts the buckets that have refilled. l.mu must be held.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		rate, _ := l.rate(key)
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= max(rate, 1) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
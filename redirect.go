@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// OriginalRecipientsHeader preserves the envelope recipients of a message
+// redirected by -redirect-all-to.
+const OriginalRecipientsHeader = "X-Original-Recipients"
+
+var (
+	redirectActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "redirect_active",
+		Help:      "1 when -redirect-all-to sends all mail to a single address",
+	})
+	redirected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "redirected_total",
+		Help:      "Total number of messages redirected by -redirect-all-to",
+	})
+)
+
+// redirectRecipients returns the recipients a message is actually sent to:
+// the -redirect-all-to address if set, otherwise recipients unchanged.
+func (s *Session) redirectRecipients(recipients []string) []string {
+	to := s.backend.redirectAllTo
+	if to == "" {
+		return recipients
+	}
+	redirected.Inc()
+	s.logf("REDIRECT: message from %s for %v redirected to %s", s.from, recipients, to)
+	return []string{to}
+}
+
+// stampOriginalRecipients records the envelope recipients in the message
+// header, replacing any value supplied by the client.
+func (s *Session) stampOriginalRecipients(recipients []string) {
+	s.removeField(OriginalRecipientsHeader)
+	s.prependField(OriginalRecipientsHeader, strings.Join(recipients, ", "))
+}
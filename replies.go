@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var smtpReplies = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "replies_total",
+	Help:      "Total number of replies to EHLO (session setup), AUTH, MAIL, RCPT and DATA, by command and enhanced status code",
+}, []string{"command", "code"})
+
+// replyDefaults are the replies go-smtp gives for a nil error and for an
+// error that is not an *smtp.SMTPError, by command.
+var replyDefaults = map[string]struct{ success, failure smtp.EnhancedCode }{
+	"EHLO": {smtp.EnhancedCode{2, 0, 0}, smtp.EnhancedCode{4, 0, 0}},
+	"AUTH": {smtp.EnhancedCode{2, 0, 0}, smtp.EnhancedCode{4, 7, 0}},
+	"MAIL": {smtp.EnhancedCode{2, 0, 0}, smtp.EnhancedCode{4, 0, 0}},
+	"RCPT": {smtp.EnhancedCode{2, 0, 0}, smtp.EnhancedCode{4, 0, 0}},
+	"DATA": {smtp.EnhancedCode{2, 0, 0}, smtp.EnhancedCode{5, 0, 0}},
+}
+
+// replyCode returns the enhanced status code of the reply go-smtp writes
+// for err, the result of command.
+func replyCode(command string, err error) string {
+	d := replyDefaults[command]
+	code := d.success
+	var smtpErr *smtp.SMTPError
+	switch {
+	case errors.As(err, &smtpErr):
+		code = smtpErr.EnhancedCode
+		if code == smtp.EnhancedCodeNotSet || code == smtp.NoEnhancedCode {
+			// go-smtp derives the class from the reply code.
+			code = smtp.EnhancedCode{smtpErr.Code / 100, 0, 0}
+		}
+	case err != nil:
+		code = d.failure
+	}
+	return fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+}
+
+// observeReply counts the reply to command, given the error returned to
+// go-smtp.
+func observeReply(command string, err error) {
+	smtpReplies.With(prometheus.Labels{"command": command, "code": replyCode(command, err)}).Inc()
+}
+
+// observeReply counts the reply to command, except on PROXY health check
+// connections.
+func (s *Session) observeReply(command string, err error) {
+	if !s.probe {
+		observeReply(command, err)
+	}
+}
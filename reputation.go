@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var reputationPaused = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "smtpd",
+	Name:      "reputation_paused",
+	Help:      "1 while sending is paused by the CloudWatch reputation alarm",
+})
+
+// reputationMonitor pauses sending while a CloudWatch alarm, typically on
+// the SES bounce or complaint rate, is in the ALARM state. A nil monitor
+// never pauses.
+type reputationMonitor struct {
+	client   *cloudwatch.Client
+	alarm    string
+	interval time.Duration
+	paused   atomic.Bool
+}
+
+// alarmState returns the current state of the monitored alarm, which may be
+// a metric or a composite alarm.
+func (m *reputationMonitor) alarmState(ctx context.Context) (types.StateValue, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := m.client.DescribeAlarms(ctx, &cloudwatch.DescribeAlarmsInput{
+		AlarmNames: []string{m.alarm},
+		AlarmTypes: []types.AlarmType{types.AlarmTypeMetricAlarm, types.AlarmTypeCompositeAlarm},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, a := range out.MetricAlarms {
+		return a.StateValue, nil
+	}
+	for _, a := range out.CompositeAlarms {
+		return a.StateValue, nil
+	}
+	return "", fmt.Errorf("alarm %q not found", m.alarm)
+}
+
+// poll updates the pause state. On errors the previous state is kept, so a
+// CloudWatch outage neither pauses nor resumes sending.
+func (m *reputationMonitor) poll(ctx context.Context) {
+	state, err := m.alarmState(ctx)
+	if err != nil {
+		log.Printf("reputation: checking alarm %s failed, keeping paused=%t: %v", m.alarm, m.paused.Load(), err)
+		return
+	}
+	paused := state == types.StateValueAlarm
+	if m.paused.Swap(paused) != paused {
+		if paused {
+			log.Printf("reputation: alarm %s is in ALARM, pausing sending", m.alarm)
+		} else {
+			log.Printf("reputation: alarm %s is %s, resuming sending", m.alarm, state)
+		}
+	}
+	if paused {
+		reputationPaused.Set(1)
+	} else {
+		reputationPaused.Set(0)
+	}
+}
+
+// run polls the alarm every interval until ctx is done.
+func (m *reputationMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.poll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *reputationMonitor) isPaused() bool {
+	return m != nil && m.paused.Load()
+}
+
+// checkReputation fails the transaction while sending is paused.
+func (s *Session) checkReputation() error {
+	if !s.backend.reputation.isPaused() {
+		return nil
+	}
+	emailError.With(prometheus.Labels{"type": "reputation paused", "tenant": s.tenant}).Inc()
+	s.logf("rejecting message from %s, sending is paused by alarm %s", s.from, s.backend.reputation.alarm)
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Sending is temporarily paused. Please try again later",
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var sesRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "ses_retry_total",
+	Help:      "Total number of SES calls retried by the relay",
+}, []string{"reason"})
+
+var sesRetriesDenied = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "ses_retry_budget_denied_total",
+	Help:      "Total number of relay retries skipped because the retry budget was exhausted",
+})
+
+// retryBudget is a token bucket shared by all sessions that caps the rate of
+// relay level retries, so that a degraded SES is not hit by a retry storm.
+// Each retry takes a token; tokens refill at refill per second up to size.
+// A nil budget always allows.
+type retryBudget struct {
+	size   float64
+	refill float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRetryBudget(size int, refill float64) *retryBudget {
+	return &retryBudget{size: float64(size), refill: refill, tokens: float64(size), last: time.Now()}
+}
+
+// allow takes a token, returning false if none is left.
+func (b *retryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.size, b.tokens+now.Sub(b.last).Seconds()*b.refill)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// networkRetrySender retries sends whose request never reached SES, on top
+// of the SDK's own retries. SES errors are returned as is. With ambiguous
+// set, sends that timed out or lost their connection are retried too,
+// although SES may already have taken the message. Once the shared budget is
+// exhausted, failures are returned without retrying.
+type networkRetrySender struct {
+	next      Sender
+	attempts  int
+	backoff   time.Duration
+	budget    *retryBudget
+	ambiguous bool
+}
+
+// SendRaw implements Sender
+func (s *networkRetrySender) SendRaw(ctx context.Context, from string, to []string, data []byte, configSet string) (string, error) {
+	delay := s.backoff
+	for attempt := 1; ; attempt++ {
+		messageID, err := s.next.SendRaw(ctx, from, to, data, configSet)
+		if err == nil || attempt >= s.attempts || !isRetryableSendError(ctx, err, s.ambiguous) {
+			return messageID, err
+		}
+		if !s.budget.allow() {
+			sesRetriesDenied.Inc()
+			return messageID, err
+		}
+		sesRetries.With(prometheus.Labels{"reason": "network-retry"}).Inc()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", err
+		}
+		delay *= 2
+	}
+}
+
+// isRetryableSendError reports whether a send failing with err may be
+// retried while ctx is still live. Only requests that never reached SES are
+// retried, unless ambiguous allows those that may have: network timeouts,
+// reset connections and -ses-attempt-timeout or -ses-operation-timeout
+// expiring.
+func isRetryableSendError(ctx context.Context, err error, ambiguous bool) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if isUnsentRequestError(err) {
+		return true
+	}
+	return ambiguous && (isTransientNetworkError(err) || errors.Is(err, context.DeadlineExceeded))
+}
+
+// isUnsentRequestError reports whether err shows that the request never
+// left: the endpoint's name did not resolve, or the connection to it could
+// not be made.
+func isUnsentRequestError(err error) bool {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	if errors.As(err, &dnsErr) || (errors.As(err, &opErr) && opErr.Op == "dial") || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	// The SDK wraps every failed HTTP exchange in a RequestSendError; one
+	// that timed out or lost its connection may have been read by SES.
+	var sendErr *smithyhttp.RequestSendError
+	var netErr net.Error
+	return errors.As(err, &sendErr) &&
+		!errors.Is(err, context.DeadlineExceeded) &&
+		!(errors.As(err, &netErr) && netErr.Timeout()) &&
+		!errors.Is(err, syscall.ECONNRESET) &&
+		!errors.Is(err, syscall.EPIPE) &&
+		!errors.Is(err, io.EOF) &&
+		!errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isTransientNetworkError reports whether err means the request could not be
+// sent or its response was lost, as opposed to an error returned by SES.
+func isTransientNetworkError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var sendErr *smithyhttp.RequestSendError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	return errors.As(err, &sendErr) ||
+		errors.As(err, &dnsErr) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+func TestIsRetryableSendError(t *testing.T) {
+	sendErr := func(err error) error {
+		return fmt.Errorf("operation error SES: SendRawEmail: %w", &smithyhttp.RequestSendError{Err: err})
+	}
+	tests := []struct {
+		name string
+		err  error
+		// Whether the error is retried by default and with
+		// -network-retry-ambiguous.
+		want, ambiguous bool
+	}{
+		{"connection refused", sendErr(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), true, true},
+		{"dial timeout", sendErr(&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}), true, true},
+		{"dns", sendErr(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}), true, true},
+		{"connection reset", sendErr(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), false, true},
+		{"read timeout", sendErr(&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}), false, true},
+		{"attempt timeout", sendErr(context.DeadlineExceeded), false, true},
+		{"operation timeout", fmt.Errorf("operation error SES: SendRawEmail: %w", context.DeadlineExceeded), false, true},
+		{"ses error", &smithy.GenericAPIError{Code: "MessageRejected"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if got := isRetryableSendError(ctx, tt.err, false); got != tt.want {
+				t.Errorf("isRetryableSendError(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+			if got := isRetryableSendError(ctx, tt.err, true); got != tt.ambiguous {
+				t.Errorf("isRetryableSendError(%v) with ambiguous retries = %t, want %t", tt.err, got, tt.ambiguous)
+			}
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			if isRetryableSendError(ctx, tt.err, true) {
+				t.Errorf("isRetryableSendError(%v) retried once the context is done", tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+// Modes for -ses-source-mode, choosing the SES Source of raw sends.
+const (
+	SourceEnvelope = "envelope" // MAIL FROM
+	SourceHeader   = "header"   // the From header address
+	SourceFixed    = "fixed"    // -return-path
+)
+
+// resolveSourceMode returns the -ses-source-mode in effect. Without a mode
+// -return-path selects fixed and its absence envelope; fixed needs
+// -return-path and the other modes conflict with it.
+func resolveSourceMode(mode, returnPath string) (string, error) {
+	switch mode {
+	case "":
+		if returnPath != "" {
+			return SourceFixed, nil
+		}
+		return SourceEnvelope, nil
+	case SourceFixed:
+		if returnPath == "" {
+			return "", fmt.Errorf("-ses-source-mode=%s takes the Source from -return-path, which is not set", mode)
+		}
+		return mode, nil
+	case SourceEnvelope, SourceHeader:
+		if returnPath != "" {
+			return "", fmt.Errorf("-return-path sets a fixed Source and cannot be combined with -ses-source-mode=%s", mode)
+		}
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown -ses-source-mode %q (want %s, %s or %s)", mode, SourceEnvelope, SourceHeader, SourceFixed)
+}
+
+// validateReturnPath checks that addr is a plain address and that SES has
+// verified either the address itself or its domain.
+func validateReturnPath(ctx context.Context, client *ses.Client, addr string) error {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil || parsed.Name != "" || parsed.Address != addr {
+		return fmt.Errorf("%q is not a plain email address", addr)
+	}
+	verified, err := isVerifiedIdentity(ctx, client, addr)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		_, domain, _ := strings.Cut(addr, "@")
+		return fmt.Errorf("neither %s nor %s is a verified SES identity", addr, domain)
+	}
+	return nil
+}
+
+// isVerifiedIdentity reports whether SES has verified addr or its domain.
+func isVerifiedIdentity(ctx context.Context, client *ses.Client, addr string) (bool, error) {
+	_, domain, _ := strings.Cut(addr, "@")
+	out, err := client.GetIdentityVerificationAttributes(ctx, &ses.GetIdentityVerificationAttributesInput{
+		Identities: []string{addr, domain},
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, identity := range []string{addr, domain} {
+		if attrs, ok := out.VerificationAttributes[identity]; ok && attrs.VerificationStatus == types.VerificationStatusSuccess {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// envelopeFrom returns the SES Source, which becomes the envelope sender
+// receiving bounces, by -ses-source-mode: -return-path in fixed mode, the
+// From header address in header mode, and otherwise MAIL FROM. Header mode
+// falls back to MAIL FROM unless From has exactly one address.
+//
+// A null sender outside fixed mode gets -bounce-source. It never falls back
+// to the From header: a bounce of a bounce would then go back to whoever
+// the first bounce was addressed to.
+func (s *Session) envelopeFrom() string {
+	if s.backend.sourceMode == SourceFixed {
+		return s.backend.returnPath
+	}
+	if s.from == "" {
+		return s.backend.bounceSource
+	}
+	if s.backend.sourceMode == SourceHeader {
+		if addr := headerFromAddress(s.data); addr != "" {
+			return addr
+		}
+	}
+	return s.from
+}
+
+// acceptsNullSender reports whether a null sender has a Source to be sent
+// with, -return-path in fixed mode or -bounce-source.
+func (b *Backend) acceptsNullSender() bool {
+	return b.sourceMode == SourceFixed || b.bounceSource != ""
+}
+
+// headerFromAddress returns the address of the message's From header, or
+// "" if it is missing, unparseable or lists more than one address.
+func headerFromAddress(data []byte) string {
+	fields, _ := splitHeader(data)
+	value, ok := getHeader(fields, "From")
+	if !ok {
+		return ""
+	}
+	parser := mail.AddressParser{WordDecoder: new(mime.WordDecoder)}
+	addrs, err := parser.ParseList(value)
+	if err != nil || len(addrs) != 1 {
+		return ""
+	}
+	return addrs[0].Address
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestEnvelopeFrom(t *testing.T) {
+	// Envelope and header From differ throughout.
+	const msg = "From: \"Billing\" <billing@example.com>\r\nTo: rcpt@example.net\r\n\r\nbody\r\n"
+	tests := []struct {
+		name         string
+		mode         string
+		from         string
+		data         string
+		returnPath   string
+		bounceSource string
+		want         string
+	}{
+		{name: "envelope", mode: SourceEnvelope, from: "app@mailer.example.org", data: msg, want: "app@mailer.example.org"},
+		{name: "header", mode: SourceHeader, from: "app@mailer.example.org", data: msg, want: "billing@example.com"},
+		{name: "header without From", mode: SourceHeader, from: "app@mailer.example.org", data: "To: rcpt@example.net\r\n\r\nbody\r\n", want: "app@mailer.example.org"},
+		{name: "header with two From addresses", mode: SourceHeader, from: "app@mailer.example.org", data: "From: a@example.com, b@example.com\r\n\r\nbody\r\n", want: "app@mailer.example.org"},
+		{name: "header encoded name", mode: SourceHeader, from: "app@mailer.example.org", data: "From: =?utf-8?q?R=C3=A9ception?= <desk@example.com>\r\n\r\nbody\r\n", want: "desk@example.com"},
+		{name: "fixed", mode: SourceFixed, from: "app@mailer.example.org", data: msg, returnPath: "bounces@example.com", want: "bounces@example.com"},
+		{name: "null sender envelope", mode: SourceEnvelope, data: msg, bounceSource: "null@example.com", want: "null@example.com"},
+		{name: "null sender header", mode: SourceHeader, data: msg, bounceSource: "null@example.com", want: "null@example.com"},
+		{name: "null sender fixed", mode: SourceFixed, data: msg, returnPath: "bounces@example.com", want: "bounces@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Backend{sourceMode: tt.mode, returnPath: tt.returnPath, bounceSource: tt.bounceSource}
+			s := newTestSession(t, b, tt.data)
+			s.from = tt.from
+			if got := s.envelopeFrom(); got != tt.want {
+				t.Errorf("envelopeFrom() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSourceMode(t *testing.T) {
+	tests := []struct {
+		mode, returnPath string
+		want             string
+		wantErr          bool
+	}{
+		{"", "", SourceEnvelope, false},
+		{"", "rp@example.com", SourceFixed, false},
+		{SourceHeader, "", SourceHeader, false},
+		{SourceFixed, "rp@example.com", SourceFixed, false},
+		{SourceFixed, "", "", true},
+		{SourceEnvelope, "rp@example.com", "", true},
+		{"bogus", "", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveSourceMode(tt.mode, tt.returnPath)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("resolveSourceMode(%q, %q) = %q, %v, want %q, error %t", tt.mode, tt.returnPath, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+// Values for -sender-routes-fallback.
+const (
+	RouteFallbackDefault = "default"
+	RouteFallbackReject  = "reject"
+)
+
+// senderRoute is the SES account a sender domain is delivered through.
+type senderRoute struct {
+	region  string
+	roleARN string
+}
+
+// loadSenderRoutes reads "domain region [role-arn]" lines mapping sender
+// domains to SES accounts. Blank lines and lines starting with # are ignored.
+func loadSenderRoutes(path string) (map[string]senderRoute, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	routes := make(map[string]senderRoute)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"domain region [role-arn]\"", path, n)
+		}
+		domain := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		if _, dup := routes[domain]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate route for %s", path, n, domain)
+		}
+		route := senderRoute{region: fields[1]}
+		if len(fields) == 3 {
+			route.roleARN = fields[2]
+		}
+		routes[domain] = route
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// buildSenderRoutes creates one SES client per distinct account in routes,
+// so domains sharing an account also share a client. The SES v2 clients
+// returned alongside serve templated sends through the same accounts.
+func buildSenderRoutes(ctx context.Context, opts sesClientOptions, routes map[string]senderRoute) (map[string]Sender, map[string]templateClient, error) {
+	type account struct {
+		sender    Sender
+		templates templateClient
+	}
+	accounts := make(map[senderRoute]account)
+	byDomain := make(map[string]Sender, len(routes))
+	templates := make(map[string]templateClient, len(routes))
+	for domain, route := range routes {
+		a, ok := accounts[route]
+		if !ok {
+			o := opts
+			o.region = route.region
+			o.roleARN = route.roleARN
+			client, cfg, err := makeSesClient(ctx, o)
+			if err != nil {
+				return nil, nil, fmt.Errorf("creating SES client for %s: %w", domain, err)
+			}
+			a = account{sender: &sesSender{client: client}, templates: sesv2.NewFromConfig(cfg)}
+			accounts[route] = a
+		}
+		byDomain[domain] = a.sender
+		templates[domain] = a.templates
+		log.Printf("Sender domain %s routed to region %s (role: %s)", domain, route.region, orDefault(route.roleARN))
+	}
+	return byDomain, templates, nil
+}
+
+// routeSESClients returns the SES client of each distinct account used by
+// routes, which must not be wrapped yet.
+func routeSESClients(routes map[string]Sender) []*ses.Client {
+	var clients []*ses.Client
+	seen := make(map[*ses.Client]bool)
+	for _, sender := range routes {
+		if s, ok := sender.(*sesSender); ok && !seen[s.client] {
+			seen[s.client] = true
+			clients = append(clients, s.client)
+		}
+	}
+	return clients
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "default credentials"
+	}
+	return s
+}
+
+// senderFor returns the Sender for the domain of from. Domains without a
+// route use the default sender unless unrouted senders are rejected.
+func (b *Backend) senderFor(from string) (Sender, bool) {
+	if len(b.routes) > 0 {
+		_, domain, _ := strings.Cut(from, "@")
+		if sender, ok := b.routes[strings.ToLower(domain)]; ok {
+			return sender, true
+		}
+		if b.rejectUnrouted {
+			return nil, false
+		}
+	}
+	return b.sender, true
+}
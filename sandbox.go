@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Sandbox accounts have a fixed quota of 200 messages per day at one per
+// second, which identifies them when GetAccount is not permitted.
+const (
+	sandboxMax24HourSend = 200
+	sandboxMaxSendRate   = 1
+)
+
+// sandboxVerificationTTL is how long a recipient verification result is
+// cached.
+const sandboxVerificationTTL = 5 * time.Minute
+
+var sandboxMode = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "smtpd",
+	Name:      "ses_sandbox",
+	Help:      "1 if the SES account was detected to be in the sandbox at startup",
+})
+
+// detectSandbox reports whether the account is in the SES sandbox, using
+// GetAccount and falling back to the quota heuristic. The second result
+// names the method used.
+func detectSandbox(ctx context.Context, v2 *sesv2.Client, v1 *ses.Client) (bool, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	account, err := v2.GetAccount(ctx, &sesv2.GetAccountInput{})
+	if err == nil {
+		return !account.ProductionAccessEnabled, "GetAccount", nil
+	}
+	log.Printf("Could not read SES account details, guessing sandbox status from the quota: %v", err)
+	quota, err := v1.GetSendQuota(ctx, &ses.GetSendQuotaInput{})
+	if err != nil {
+		return false, "", err
+	}
+	return quota.Max24HourSend == sandboxMax24HourSend && quota.MaxSendRate == sandboxMaxSendRate, "GetSendQuota", nil
+}
+
+// sandboxChecker rejects recipients that are not verified identities, as
+// the SES sandbox would only accept those. Lookup results are cached.
+type sandboxChecker struct {
+	client *ses.Client
+
+	mu    sync.Mutex
+	cache map[string]sandboxEntry
+}
+
+type sandboxEntry struct {
+	verified bool
+	expires  time.Time
+}
+
+func newSandboxChecker(client *ses.Client) *sandboxChecker {
+	return &sandboxChecker{client: client, cache: make(map[string]sandboxEntry)}
+}
+
+// verified reports whether addr or its domain is verified.
+func (c *sandboxChecker) verified(ctx context.Context, addr string) (bool, error) {
+	addr = strings.ToLower(addr)
+	c.mu.Lock()
+	e, ok := c.cache[addr]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.verified, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	verified, err := isVerifiedIdentity(ctx, c.client, addr)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.cache[addr] = sandboxEntry{verified: verified, expires: time.Now().Add(sandboxVerificationTTL)}
+	c.mu.Unlock()
+	return verified, nil
+}
+
+// checkSandboxRecipient rejects an unverified recipient at RCPT TO. Lookup
+// failures accept the recipient and leave the decision to SES.
+func (s *Session) checkSandboxRecipient(to string) error {
+	c := s.backend.sandbox
+	if c == nil {
+		return nil
+	}
+	if t := s.backend.templates; t != nil && strings.EqualFold(to, t.triggerAddress) {
+		return nil
+	}
+	verified, err := c.verified(s.backend.context(), to)
+	if err != nil {
+		s.logf("cannot check sandbox verification of %s, accepting: %v", to, err)
+		return nil
+	}
+	if verified {
+		return nil
+	}
+	emailError.With(prometheus.Labels{"type": "sandbox unverified recipient", "tenant": s.tenant}).Inc()
+	s.logf("rejecting RCPT TO:<%s>, not a verified identity in the SES sandbox", to)
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Recipient address is not verified (SES account is in the sandbox)",
+	}
+}
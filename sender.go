@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+// Sender delivers a raw MIME message. configSet is empty when no
+// configuration set should be used.
+type Sender interface {
+	SendRaw(ctx context.Context, from string, to []string, data []byte, configSet string) (messageID string, err error)
+}
+
+// sesSender implements Sender with SES SendRawEmail.
+type sesSender struct {
+	client *ses.Client
+}
+
+// SendRaw implements Sender
+func (s *sesSender) SendRaw(ctx context.Context, from string, to []string, data []byte, configSet string) (string, error) {
+	input := &ses.SendRawEmailInput{
+		Destinations: to,
+		RawMessage:   &types.RawMessage{Data: data},
+	}
+	// Sessions always pass a Source, see envelopeFrom; without one SES
+	// takes the From header.
+	if from != "" {
+		input.Source = &from
+	}
+	if configSet != "" {
+		input.ConfigurationSetName = &configSet
+	}
+
+	output, err := s.client.SendRawEmail(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.MessageId), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// fakeSender implements Sender, recording the messages it is given and
+// answering with messageID or err.
+type fakeSender struct {
+	messageID string
+	err       error
+
+	mu    sync.Mutex
+	calls []fakeSend
+}
+
+// fakeSend is one SendRaw call.
+type fakeSend struct {
+	from      string
+	to        []string
+	data      []byte
+	configSet string
+}
+
+// SendRaw implements Sender
+func (f *fakeSender) SendRaw(ctx context.Context, from string, to []string, data []byte, configSet string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fakeSend{
+		from:      from,
+		to:        append([]string(nil), to...),
+		data:      append([]byte(nil), data...),
+		configSet: configSet,
+	})
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.messageID, nil
+}
+
+// sent returns the recorded calls.
+func (f *fakeSender) sent() []fakeSend {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeSend(nil), f.calls...)
+}
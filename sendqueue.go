@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Keys for -send-fairness-key.
+const (
+	FairnessTenant = "tenant"
+	FairnessUser   = "user"
+	FairnessIP     = "ip"
+)
+
+var (
+	sendSlotWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "smtpd",
+		Name:      "send_slot_wait_seconds",
+		Help:      "Time messages waited for one of the -max-concurrent-sends slots, by tenant",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"tenant"})
+	sendSlotsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "send_slots_active",
+		Help:      "SES sends currently holding a -max-concurrent-sends slot",
+	})
+	sendSlotsWaiting = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "send_slots_waiting",
+		Help:      "Messages waiting for a -max-concurrent-sends slot",
+	})
+)
+
+// validateFairnessKey rejects unknown -send-fairness-key values.
+func validateFairnessKey(key string) error {
+	switch key {
+	case FairnessTenant, FairnessUser, FairnessIP:
+		return nil
+	}
+	return fmt.Errorf("unknown -send-fairness-key %q (want %s, %s or %s)", key, FairnessTenant, FairnessUser, FairnessIP)
+}
+
+// fairScheduler caps the concurrent SES sends. When all slots are taken,
+// waiters queue by priority level and, within a level, per key (tenant,
+// user or client IP). Freed slots go to the highest level with waiters and
+// to its keys in turn, so that one busy key cannot starve the others.
+type fairScheduler struct {
+	max int
+	key string
+
+	mu      sync.Mutex
+	active  int
+	waiting int
+	// levels holds the waiters by priority, highest first.
+	levels []fairQueue
+}
+
+// fairQueue holds the waiters of one priority level.
+type fairQueue struct {
+	queues map[string][]chan struct{}
+	// order lists the keys with waiters, next to be served first.
+	order []string
+}
+
+func newFairScheduler(max int, key string, levels int) *fairScheduler {
+	f := &fairScheduler{max: max, key: key, levels: make([]fairQueue, levels)}
+	for i := range f.levels {
+		f.levels[i].queues = make(map[string][]chan struct{})
+	}
+	return f
+}
+
+// acquire waits for a slot for key at priority level until ctx is done.
+func (f *fairScheduler) acquire(ctx context.Context, key string, level int) error {
+	f.mu.Lock()
+	if f.active < f.max && f.waiting == 0 {
+		f.active++
+		f.mu.Unlock()
+		sendSlotsActive.Inc()
+		return nil
+	}
+	ready := make(chan struct{})
+	l := &f.levels[level]
+	if len(l.queues[key]) == 0 {
+		l.order = append(l.order, key)
+	}
+	l.queues[key] = append(l.queues[key], ready)
+	f.waiting++
+	f.mu.Unlock()
+	sendSlotsWaiting.Inc()
+	defer sendSlotsWaiting.Dec()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-ready:
+		// Granted meanwhile: hand the slot on.
+		f.releaseLocked()
+		sendSlotsActive.Dec()
+		return ctx.Err()
+	default:
+	}
+	q := l.queues[key]
+	for i, c := range q {
+		if c == ready {
+			l.queues[key] = append(q[:i:i], q[i+1:]...)
+			break
+		}
+	}
+	f.waiting--
+	if len(l.queues[key]) == 0 {
+		l.dropKey(key)
+	}
+	return ctx.Err()
+}
+
+// release frees a slot taken by acquire.
+func (f *fairScheduler) release() {
+	f.mu.Lock()
+	f.releaseLocked()
+	f.mu.Unlock()
+	sendSlotsActive.Dec()
+}
+
+// releaseLocked passes the slot to the first waiter of the next key in the
+// highest level with waiters, which then goes to the back of the order, or
+// frees it.
+func (f *fairScheduler) releaseLocked() {
+	if f.waiting == 0 {
+		f.active--
+		return
+	}
+	for i := range f.levels {
+		l := &f.levels[i]
+		if len(l.order) == 0 {
+			continue
+		}
+		key := l.order[0]
+		q := l.queues[key]
+		close(q[0])
+		sendSlotsActive.Inc()
+		f.waiting--
+		l.order = l.order[1:]
+		if len(q) == 1 {
+			delete(l.queues, key)
+		} else {
+			l.queues[key] = q[1:]
+			l.order = append(l.order, key)
+		}
+		return
+	}
+}
+
+// dropKey removes key, which has no waiters left, from the order.
+func (l *fairQueue) dropKey(key string) {
+	delete(l.queues, key)
+	for i, k := range l.order {
+		if k == key {
+			l.order = append(l.order[:i:i], l.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// fairnessKey returns the value the session's sends are queued under.
+func (s *Session) fairnessKey() string {
+	switch s.backend.sendScheduler.key {
+	case FairnessUser:
+		return s.user
+	case FairnessIP:
+		host, _, err := net.SplitHostPort(s.conn.Conn().RemoteAddr().String())
+		if err != nil {
+			return s.conn.Conn().RemoteAddr().String()
+		}
+		return host
+	}
+	return s.tenant
+}
+
+// acquireSendSlot waits for a -max-concurrent-sends slot and returns the
+// function releasing it. Waiting ends with the transaction: on
+// -transaction-timeout or shutdown it fails like the send would have.
+func (s *Session) acquireSendSlot() (func(), error) {
+	f := s.backend.sendScheduler
+	if f == nil {
+		return func() {}, nil
+	}
+	level, priority := s.sendPriority()
+	start := time.Now()
+	err := f.acquire(s.ctx, s.fairnessKey(), level)
+	wait := time.Since(start).Seconds()
+	sendSlotWait.With(prometheus.Labels{"tenant": s.tenant}).Observe(wait)
+	if priority != "" {
+		sendPriorityWait.With(prometheus.Labels{"priority": priority}).Observe(wait)
+	}
+	if err != nil {
+		if s.transactionExpired() {
+			return nil, s.transactionTimedOut("send_wait")
+		}
+		return nil, errShuttingDown
+	}
+	return f.release, nil
+}
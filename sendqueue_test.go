@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// queueWaiter starts a send waiting on f for key at level, and returns once
+// it is queued. Once granted the slot, the waiter sends name on granted and
+// releases the slot.
+func queueWaiter(t *testing.T, ctx context.Context, f *fairScheduler, name, key string, level int, granted chan<- string) {
+	t.Helper()
+	f.mu.Lock()
+	want := f.waiting + 1
+	f.mu.Unlock()
+	go func() {
+		if err := f.acquire(ctx, key, level); err != nil {
+			granted <- name + ":" + err.Error()
+			return
+		}
+		granted <- name
+		f.release()
+	}()
+	waitFor(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.waiting == want
+	})
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+	}
+}
+
+// served collects n names from granted.
+func served(t *testing.T, granted <-chan string, n int) string {
+	t.Helper()
+	var order []string
+	for i := 0; i < n; i++ {
+		select {
+		case name := <-granted:
+			order = append(order, name)
+		case <-time.After(time.Second):
+			t.Fatalf("only %v served", order)
+		}
+	}
+	return strings.Join(order, " ")
+}
+
+func TestFairSchedulerOrder(t *testing.T) {
+	ctx := context.Background()
+	f := newFairScheduler(1, FairnessTenant, 3)
+	if err := f.acquire(ctx, "hold", 0); err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan string, 10)
+	// Tenant a queues three normal sends before b and c queue one each,
+	// then low and high sends arrive.
+	queueWaiter(t, ctx, f, "a1", "a", 1, granted)
+	queueWaiter(t, ctx, f, "a2", "a", 1, granted)
+	queueWaiter(t, ctx, f, "a3", "a", 1, granted)
+	queueWaiter(t, ctx, f, "b1", "b", 1, granted)
+	queueWaiter(t, ctx, f, "low", "c", 2, granted)
+	queueWaiter(t, ctx, f, "c1", "c", 1, granted)
+	queueWaiter(t, ctx, f, "high", "a", 0, granted)
+
+	f.release()
+	// The highest level first; within a level the keys take turns.
+	if got, want := served(t, granted, 7), "high a1 b1 c1 a2 a3 low"; got != want {
+		t.Errorf("served %s, want %s", got, want)
+	}
+	// The last waiter releases its slot after reporting.
+	waitFor(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.active == 0 && f.waiting == 0
+	})
+}
+
+func TestFairSchedulerCancel(t *testing.T) {
+	ctx := context.Background()
+	f := newFairScheduler(1, FairnessTenant, 1)
+	if err := f.acquire(ctx, "hold", 0); err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan string, 10)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	queueWaiter(t, ctx, f, "a1", "a", 0, granted)
+	queueWaiter(t, cancelCtx, f, "b1", "b", 0, granted)
+	queueWaiter(t, ctx, f, "a2", "a", 0, granted)
+
+	cancel()
+	if got := served(t, granted, 1); got != "b1:"+context.Canceled.Error() {
+		t.Fatalf("cancelled waiter returned %s, want the context error", got)
+	}
+	f.mu.Lock()
+	if f.waiting != 2 || len(f.levels[0].queues["b"]) != 0 || strings.Join(f.levels[0].order, ",") != "a" {
+		t.Errorf("after cancelling b1: %d waiting, order %v, want 2 waiting and only a queued", f.waiting, f.levels[0].order)
+	}
+	f.mu.Unlock()
+
+	f.release()
+	if got, want := served(t, granted, 2), "a1 a2"; got != want {
+		t.Errorf("served %s, want %s", got, want)
+	}
+}
+
+func TestFairSchedulerLimit(t *testing.T) {
+	ctx := context.Background()
+	f := newFairScheduler(2, FairnessTenant, 1)
+	for i := 0; i < 2; i++ {
+		if err := f.acquire(ctx, "a", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	granted := make(chan string, 10)
+	queueWaiter(t, ctx, f, "third", "b", 0, granted)
+	select {
+	case name := <-granted:
+		t.Fatalf("%s served with both slots taken", name)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	f.release()
+	if got := served(t, granted, 1); got != "third" {
+		t.Fatalf("served %s, want third", got)
+	}
+	// third released its slot again: one is still held, one is free.
+	waitFor(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.active == 1
+	})
+	if err := f.acquire(ctx, "c", 0); err != nil {
+		t.Fatal(err)
+	}
+	f.release()
+	f.release()
+	if f.active != 0 {
+		t.Errorf("%d slots active after all were released, want 0", f.active)
+	}
+}
+
+// TestFairSchedulerGrantedWhileCancelled covers a waiter granted a slot just
+// as its context ends: whichever way it returns, the slot is neither lost
+// nor given twice.
+func TestFairSchedulerGrantedWhileCancelled(t *testing.T) {
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		f := newFairScheduler(1, FairnessTenant, 1)
+		if err := f.acquire(ctx, "hold", 0); err != nil {
+			t.Fatal(err)
+		}
+		granted := make(chan string, 10)
+		cancelCtx, cancel := context.WithCancel(ctx)
+		queueWaiter(t, cancelCtx, f, "a", "a", 0, granted)
+		queueWaiter(t, ctx, f, "b", "b", 0, granted)
+
+		// Grant a and cancel its context before it can run.
+		f.mu.Lock()
+		f.releaseLocked()
+		sendSlotsActive.Dec()
+		cancel()
+		f.mu.Unlock()
+
+		// A cancelled a hands the slot on to b and may report after it.
+		switch got := served(t, granted, 2); got {
+		case "a b", "a:context canceled b", "b a:context canceled":
+		default:
+			t.Fatalf("served %s, want a and b each once", got)
+		}
+		waitFor(t, func() bool {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			return f.active == 0 && f.waiting == 0
+		})
+	}
+}
+
+func TestAcquireSendSlot(t *testing.T) {
+	b := newTestBackend(t, &fakeSender{})
+	s := newTestSession(t, b, testMessage)
+	release, err := s.acquireSendSlot()
+	if err != nil {
+		t.Fatalf("acquireSendSlot without a limit: %v", err)
+	}
+	release()
+
+	b.sendScheduler = newFairScheduler(1, FairnessTenant, 1)
+	s.ctx = context.Background()
+	release, err = s.acquireSendSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// Waiting ends with the transaction.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s.ctx = ctx
+	var smtpErr *smtp.SMTPError
+	if _, err := s.acquireSendSlot(); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("acquireSendSlot past -transaction-timeout: %v, want 451", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	s.ctx = ctx
+	if _, err := s.acquireSendSlot(); err != errShuttingDown {
+		t.Errorf("acquireSendSlot on shutdown: %v, want %v", err, errShuttingDown)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultShadowRecipient is the SES mailbox simulator address that accepts
+// every message without delivering it.
+const DefaultShadowRecipient = "success@simulator.amazonses.com"
+
+// shadowTimeout bounds a shadow send, which runs after the SMTP reply.
+const shadowTimeout = time.Minute
+
+var shadowSends = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "shadow_send_total",
+	Help:      "Total number of shadow sends by primary and shadow result (ok or error)",
+}, []string{"primary", "shadow"})
+
+// shadowSender mirrors raw sends to a second SES account for comparison.
+// Messages go only to recipient, never to the real recipients, and the
+// outcome never affects the SMTP reply.
+type shadowSender struct {
+	sender    Sender
+	recipient string
+	configSet string
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// shadowSend sends a copy of the current message through the shadow account
+// in the background and records how its result compares with primaryErr.
+func (s *Session) shadowSend(primaryErr error) {
+	sh := s.backend.shadow
+	if sh == nil {
+		return
+	}
+	from, data := s.envelopeFrom(), s.data
+	// The session moves on to the next message; log with this one's IDs.
+	ls := &Session{connID: s.connID, trackingID: s.trackingID}
+	base := s.backend.context()
+	go func() {
+		ctx, cancel := context.WithTimeout(base, shadowTimeout)
+		defer cancel()
+		start := time.Now()
+		messageID, err := sh.sender.SendRaw(ctx, from, []string{sh.recipient}, data, sh.configSet)
+		shadowSends.With(prometheus.Labels{"primary": resultLabel(primaryErr), "shadow": resultLabel(err)}).Inc()
+		if err != nil {
+			ls.logf("shadow send failed after %s (primary: %s): %v", time.Since(start).Round(time.Millisecond), resultLabel(primaryErr), err)
+			return
+		}
+		ls.logf("shadow send ok after %s (primary: %s): message id %s", time.Since(start).Round(time.Millisecond), resultLabel(primaryErr), messageID)
+	}()
+}
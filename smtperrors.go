@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/smithy-go"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Kinds of SES throttling, which -ses-rate-limit-reply and -ses-quota-reply
+// answer differently: a rate limit clears within seconds, an exhausted
+// quota only as the 24-hour window moves on.
+const (
+	throttleRate  = "rate"
+	throttleQuota = "quota"
+)
+
+var sesThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "ses_throttled_total",
+	Help:      "Total number of sends refused by SES throttling, by reason: rate or quota",
+}, []string{"reason"})
+
+// sesThrottleKind returns throttleRate or throttleQuota if err is SES
+// throttling, and "" otherwise.
+func sesThrottleKind(err error) string {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return ""
+	}
+	switch apiErr.ErrorCode() {
+	case "Throttling", "TooManyRequestsException", "LimitExceeded", "LimitExceededException":
+		if strings.Contains(strings.ToLower(apiErr.ErrorMessage()), "quota") {
+			return throttleQuota
+		}
+		return throttleRate
+	}
+	return ""
+}
+
+// parseReply parses a configured reply, "CODE X.Y.Z message", as in
+// "452 4.3.1 Daily quota reached, try again in a few hours". Only
+// temporary (4xx) and permanent (5xx) replies are accepted, with an
+// enhanced code of the same class.
+func parseReply(value string) (*smtp.SMTPError, error) {
+	fields := strings.SplitN(strings.TrimSpace(value), " ", 3)
+	if len(fields) < 3 || strings.TrimSpace(fields[2]) == "" {
+		return nil, fmt.Errorf("reply %q: want \"CODE X.Y.Z message\"", value)
+	}
+	code, err := strconv.Atoi(fields[0])
+	if err != nil || code < 400 || code > 599 {
+		return nil, fmt.Errorf("reply %q: code must be 4xx or 5xx", value)
+	}
+	var enhanced smtp.EnhancedCode
+	parts := strings.Split(fields[1], ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("reply %q: invalid enhanced status code %q", value, fields[1])
+	}
+	for i, p := range parts {
+		if enhanced[i], err = strconv.Atoi(p); err != nil || enhanced[i] < 0 || enhanced[i] > 999 {
+			return nil, fmt.Errorf("reply %q: invalid enhanced status code %q", value, fields[1])
+		}
+	}
+	if enhanced[0] != code/100 {
+		return nil, fmt.Errorf("reply %q: enhanced status code class does not match %d", value, code)
+	}
+	return &smtp.SMTPError{Code: code, EnhancedCode: enhanced, Message: strings.TrimSpace(fields[2])}, nil
+}
+
+// sesReply returns the SMTP reply to a failed SES call: sesSendError's,
+// or the configured reply for SES throttling or a paused account.
+func (s *Session) sesReply(err error) *smtp.SMTPError {
+	if isAccountPaused(err) {
+		return s.accountPausedReply()
+	}
+	kind := sesThrottleKind(err)
+	if kind == "" {
+		return sesSendError(err)
+	}
+	sesThrottled.With(prometheus.Labels{"reason": kind}).Inc()
+	if reply := s.backend.throttleReplies[kind]; reply != nil {
+		return reply
+	}
+	return sesSendError(err)
+}
+
+// sesSendError maps a failed SES call to the SMTP reply, so that clients
+// can tell from the enhanced status code whether and when to retry:
+//
+//	451 4.4.1  SES could not be reached or timed out
+//	451 4.4.5  sending rate exceeded
+//	451 4.3.1  sending quota exceeded
+//	451 4.3.2  sending paused for the account or configuration set
+//	451 4.3.5  relay misconfigured (missing configuration set or template)
+//	550 5.7.1  sender (or, in the sandbox, recipient) not verified
+//	553 5.1.3  address rejected as illegal
+//	554 5.6.0  invalid templated send request
+//	554 5.7.1  message rejected by SES
+//	451 4.3.0  any other error
+func sesSendError(err error) *smtp.SMTPError {
+	reply := func(code int, enhanced smtp.EnhancedCode, msg string) *smtp.SMTPError {
+		return &smtp.SMTPError{Code: code, EnhancedCode: enhanced, Message: msg}
+	}
+
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		if errors.Is(err, context.DeadlineExceeded) || isTransientNetworkError(err) {
+			return reply(451, smtp.EnhancedCode{4, 4, 1}, "SES could not be reached. Please try again later")
+		}
+		return reply(451, smtp.EnhancedCode{4, 3, 0}, "Temporary server error. Please try again later")
+	}
+
+	switch sesThrottleKind(err) {
+	case throttleQuota:
+		return reply(451, smtp.EnhancedCode{4, 3, 1}, "SES sending quota exceeded. Please try again later")
+	case throttleRate:
+		return reply(451, smtp.EnhancedCode{4, 4, 5}, "SES sending rate exceeded. Please try again later")
+	}
+
+	msg := strings.ToLower(apiErr.ErrorMessage())
+	switch apiErr.ErrorCode() {
+	case "AccountSendingPausedException", "ConfigurationSetSendingPausedException", "SendingPausedException", "AccountSuspendedException":
+		return reply(451, smtp.EnhancedCode{4, 3, 2}, "SES sending is paused. Please try again later")
+	case "ConfigurationSetDoesNotExist", "TemplateDoesNotExist", "NotFoundException":
+		return reply(451, smtp.EnhancedCode{4, 3, 5}, "Relay configuration error. Please try again later")
+	case "MailFromDomainNotVerifiedException", "FromEmailAddressNotVerified":
+		return reply(550, smtp.EnhancedCode{5, 7, 1}, "Sender address is not verified with SES")
+	case "BadRequestException", "InvalidRenderingParameter", "MissingRenderingAttribute":
+		return reply(554, smtp.EnhancedCode{5, 6, 0}, "Error: SES rejected the templated send request")
+	case "MessageRejected":
+		switch {
+		case strings.Contains(msg, "not verified"):
+			// In the sandbox this also covers unverified recipients.
+			return reply(550, smtp.EnhancedCode{5, 7, 1}, "Address is not verified with SES")
+		case strings.Contains(msg, "illegal address"):
+			return reply(553, smtp.EnhancedCode{5, 1, 3}, "Error: SES rejected an address as illegal")
+		}
+		return reply(554, smtp.EnhancedCode{5, 7, 1}, "Error: message rejected by SES")
+	}
+	return reply(451, smtp.EnhancedCode{4, 3, 0}, "Temporary server error. Please try again later")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/emersion/go-smtp"
+)
+
+func TestSESSendError(t *testing.T) {
+	apiErr := func(code, msg string) error {
+		// As the SDK returns them: wrapped in an operation error.
+		return &smithy.OperationError{
+			ServiceID:     "SES",
+			OperationName: "SendRawEmail",
+			Err:           &smithy.GenericAPIError{Code: code, Message: msg},
+		}
+	}
+	tests := []struct {
+		name     string
+		err      error
+		code     int
+		enhanced smtp.EnhancedCode
+	}{
+		{"deadline", context.DeadlineExceeded, 451, smtp.EnhancedCode{4, 4, 1}},
+		{"request send", &smithyhttp.RequestSendError{Err: syscall.ECONNREFUSED}, 451, smtp.EnhancedCode{4, 4, 1}},
+		{"dns", &net.DNSError{Err: "no such host", Name: "email.us-east-1.amazonaws.com"}, 451, smtp.EnhancedCode{4, 4, 1}},
+		{"connection reset", fmt.Errorf("send: %w", syscall.ECONNRESET), 451, smtp.EnhancedCode{4, 4, 1}},
+		{"canceled", context.Canceled, 451, smtp.EnhancedCode{4, 3, 0}},
+		{"not an API error", errors.New("unexpected"), 451, smtp.EnhancedCode{4, 3, 0}},
+
+		{"Throttling rate", apiErr("Throttling", "Maximum sending rate exceeded."), 451, smtp.EnhancedCode{4, 4, 5}},
+		{"Throttling quota", apiErr("Throttling", "Daily message quota exceeded."), 451, smtp.EnhancedCode{4, 3, 1}},
+		{"TooManyRequestsException", apiErr("TooManyRequestsException", "Too many requests."), 451, smtp.EnhancedCode{4, 4, 5}},
+		{"LimitExceeded", apiErr("LimitExceeded", "Sending quota exceeded."), 451, smtp.EnhancedCode{4, 3, 1}},
+		{"LimitExceededException", apiErr("LimitExceededException", "Rate exceeded."), 451, smtp.EnhancedCode{4, 4, 5}},
+
+		{"AccountSendingPausedException", apiErr("AccountSendingPausedException", "Sending paused."), 451, smtp.EnhancedCode{4, 3, 2}},
+		{"ConfigurationSetSendingPausedException", apiErr("ConfigurationSetSendingPausedException", "Sending paused."), 451, smtp.EnhancedCode{4, 3, 2}},
+		{"SendingPausedException", apiErr("SendingPausedException", "Sending paused."), 451, smtp.EnhancedCode{4, 3, 2}},
+		{"AccountSuspendedException", apiErr("AccountSuspendedException", "Account suspended."), 451, smtp.EnhancedCode{4, 3, 2}},
+
+		{"ConfigurationSetDoesNotExist", apiErr("ConfigurationSetDoesNotExist", "Configuration set does not exist."), 451, smtp.EnhancedCode{4, 3, 5}},
+		{"TemplateDoesNotExist", apiErr("TemplateDoesNotExist", "Template does not exist."), 451, smtp.EnhancedCode{4, 3, 5}},
+		{"NotFoundException", apiErr("NotFoundException", "Not found."), 451, smtp.EnhancedCode{4, 3, 5}},
+
+		{"MailFromDomainNotVerifiedException", apiErr("MailFromDomainNotVerifiedException", "MAIL FROM domain not verified."), 550, smtp.EnhancedCode{5, 7, 1}},
+		{"FromEmailAddressNotVerified", apiErr("FromEmailAddressNotVerified", "From address not verified."), 550, smtp.EnhancedCode{5, 7, 1}},
+
+		{"BadRequestException", apiErr("BadRequestException", "Bad request."), 554, smtp.EnhancedCode{5, 6, 0}},
+		{"InvalidRenderingParameter", apiErr("InvalidRenderingParameter", "Invalid parameter."), 554, smtp.EnhancedCode{5, 6, 0}},
+		{"MissingRenderingAttribute", apiErr("MissingRenderingAttribute", "Missing attribute."), 554, smtp.EnhancedCode{5, 6, 0}},
+
+		{"MessageRejected unverified", apiErr("MessageRejected", "Email address is not verified. The following identities failed the check: a@example.com"), 550, smtp.EnhancedCode{5, 7, 1}},
+		{"MessageRejected illegal address", apiErr("MessageRejected", "Illegal address"), 553, smtp.EnhancedCode{5, 1, 3}},
+		{"MessageRejected", apiErr("MessageRejected", "Email address is on the suppression list."), 554, smtp.EnhancedCode{5, 7, 1}},
+
+		{"other API error", apiErr("InternalFailure", "Internal failure."), 451, smtp.EnhancedCode{4, 3, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sesSendError(tt.err)
+			if got.Code != tt.code || got.EnhancedCode != tt.enhanced {
+				t.Errorf("sesSendError(%v) = %d %v, want %d %v", tt.err, got.Code, got.EnhancedCode, tt.code, tt.enhanced)
+			}
+			if got.EnhancedCode[0] != got.Code/100 {
+				t.Errorf("sesSendError(%v): enhanced code class %d does not match %d", tt.err, got.EnhancedCode[0], got.Code)
+			}
+		})
+	}
+}
+
+func TestSESReplyThrottleOverrides(t *testing.T) {
+	quota := &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 3, 1}, Message: "Daily quota reached"}
+	s := &Session{backend: &Backend{throttleReplies: map[string]*smtp.SMTPError{throttleQuota: quota}}}
+
+	if got := s.sesReply(&smithy.GenericAPIError{Code: "Throttling", Message: "Daily message quota exceeded."}); got != quota {
+		t.Errorf("sesReply for quota = %v, want the -ses-quota-reply", got)
+	}
+	if got := s.sesReply(&smithy.GenericAPIError{Code: "Throttling", Message: "Maximum sending rate exceeded."}); got.EnhancedCode != (smtp.EnhancedCode{4, 4, 5}) {
+		t.Errorf("sesReply for rate = %v, want the default 4.4.5", got)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// loadSSMSettings sets flags from the SSM parameters directly below prefix:
+// "<prefix>/configuration-set-name" sets -configuration-set-name. Flags given
+// on the command line take precedence. Each line of a parameter value is
+// passed to the flag separately, so repeatable flags such as -listen can
+// take several values. The names of the applied settings are returned.
+func loadSSMSettings(ctx context.Context, client *ssm.Client, prefix string, fs *flag.FlagSet) ([]string, error) {
+	prefix = "/" + strings.Trim(prefix, "/") + "/"
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var applied []string
+	pages := ssm.NewGetParametersByPathPaginator(client, &ssm.GetParametersByPathInput{
+		Path:           aws.String(prefix),
+		WithDecryption: aws.Bool(true),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("reading parameters under %s: %w", prefix, err)
+		}
+		for _, p := range page.Parameters {
+			name := strings.TrimPrefix(aws.ToString(p.Name), prefix)
+			f := fs.Lookup(name)
+			if f == nil || name == "ssm-prefix" {
+				return nil, fmt.Errorf("parameter %s does not name a setting", aws.ToString(p.Name))
+			}
+			if explicit[name] {
+				continue
+			}
+			for _, value := range strings.Split(strings.TrimSpace(aws.ToString(p.Value)), "\n") {
+				if err := f.Value.Set(strings.TrimSpace(value)); err != nil {
+					return nil, fmt.Errorf("parameter %s: %w", aws.ToString(p.Name), err)
+				}
+			}
+			applied = append(applied, name)
+		}
+	}
+	return applied, nil
+}
@@ -0,0 +1,59 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/syslog"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// setupSyslog redirects the standard logger to syslog. address is empty for
+// the local daemon or "[network://]host:port" (network defaults to udp).
+func setupSyslog(address, facility string) error {
+	prio, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return fmt.Errorf("unknown syslog facility %q", facility)
+	}
+
+	network := ""
+	if address != "" {
+		network = "udp"
+		if n, a, found := strings.Cut(address, "://"); found {
+			network, address = n, a
+		}
+	}
+
+	w, err := syslog.Dial(network, address, prio|syslog.LOG_INFO, "ses-smtpd-relay")
+	if err != nil {
+		return err
+	}
+
+	log.SetOutput(w)
+	log.SetFlags(0) // syslog adds its own timestamp
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+func setupSyslog(address, facility string) error {
+	return errors.New("syslog is not supported on this platform")
+}
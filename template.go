@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/aws/smithy-go"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	TemplateHeader     = "X-SES-Template"
+	TemplateDataHeader = "X-SES-Template-Data"
+)
+
+// SES template names are limited to alphanumerics, underscores and dashes.
+var templateNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// sesBulkMaxEntries is the most destinations SES accepts in one
+// SendBulkEmail call.
+const sesBulkMaxEntries = 50
+
+// templateClient is the part of the SES v2 client templated sends use.
+type templateClient interface {
+	SendBulkEmail(ctx context.Context, in *sesv2.SendBulkEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendBulkEmailOutput, error)
+}
+
+// templateSender sends SES templated emails for messages that are addressed
+// to the configured trigger address.
+type templateSender struct {
+	client         templateClient
+	triggerAddress string
+	// routes holds the client of each routed sender domain, as
+	// Backend.routes does for raw sends.
+	routes map[string]templateClient
+}
+
+// clientFor returns the client for the domain of from. Unrouted senders
+// are refused at MAIL FROM when -sender-routes-fallback=reject.
+func (t *templateSender) clientFor(from string) templateClient {
+	_, domain, _ := strings.Cut(from, "@")
+	if client, ok := t.routes[strings.ToLower(domain)]; ok {
+		return client
+	}
+	return t.client
+}
+
+// splitRecipients separates the trigger address from the real recipients.
+func (t *templateSender) splitRecipients(recipients []string) (triggered bool, rest []string) {
+	for _, r := range recipients {
+		if strings.EqualFold(r, t.triggerAddress) {
+			triggered = true
+			continue
+		}
+		rest = append(rest, r)
+	}
+	return triggered, rest
+}
+
+// parseTemplateRequest extracts and validates the template name and data from
+// the message headers.
+func parseTemplateRequest(data []byte) (name, templateData string, err error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", "", &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Error: unable to parse message headers",
+		}
+	}
+
+	name = strings.TrimSpace(msg.Header.Get(TemplateHeader))
+	if name == "" {
+		return "", "", &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Error: " + TemplateHeader + " header is required for templated sending",
+		}
+	}
+	if !templateNameRe.MatchString(name) {
+		return "", "", &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Error: invalid template name",
+		}
+	}
+
+	templateData = strings.TrimSpace(msg.Header.Get(TemplateDataHeader))
+	if templateData == "" {
+		templateData = "{}"
+	}
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(templateData), &obj); err != nil {
+		return "", "", &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Error: " + TemplateDataHeader + " must be a JSON object",
+		}
+	}
+
+	return name, templateData, nil
+}
+
+// bulkFailure is a recipient SES did not accept a templated send to.
+type bulkFailure struct {
+	recipient string
+	err       error
+}
+
+// send calls SES v2 SendBulkEmail with template content, one entry per
+// recipient so that recipients do not see each other, in calls of up to
+// sesBulkMaxEntries. The message IDs are returned separated by spaces.
+// Recipients SES did not accept are returned in failed; err is only set when
+// none was accepted.
+func (t *templateSender) send(ctx context.Context, from, envelope string, to []string, name, templateData string, configSetName *string) (messageID string, failed []bulkFailure, err error) {
+	client := t.clientFor(from)
+	var ids []string
+	for start := 0; start < len(to); start += sesBulkMaxEntries {
+		batch := to[start:min(start+sesBulkMaxEntries, len(to))]
+		input := &sesv2.SendBulkEmailInput{
+			ConfigurationSetName: configSetName,
+			FromEmailAddress:     &from,
+			DefaultContent: &types.BulkEmailContent{
+				Template: &types.Template{
+					TemplateName: &name,
+					TemplateData: &templateData,
+				},
+			},
+		}
+		if envelope != "" {
+			input.FeedbackForwardingEmailAddress = &envelope
+		}
+		for _, rcpt := range batch {
+			input.BulkEmailEntries = append(input.BulkEmailEntries, types.BulkEmailEntry{
+				Destination: &types.Destination{ToAddresses: []string{rcpt}},
+			})
+		}
+		out, err := client.SendBulkEmail(ctx, input)
+		if err != nil {
+			for _, rcpt := range batch {
+				failed = append(failed, bulkFailure{recipient: rcpt, err: err})
+			}
+			continue
+		}
+		for i, rcpt := range batch {
+			if i >= len(out.BulkEmailEntryResults) {
+				failed = append(failed, bulkFailure{recipient: rcpt, err: errors.New("no result from SES")})
+				continue
+			}
+			result := out.BulkEmailEntryResults[i]
+			if result.Status != types.BulkEmailStatusSuccess {
+				failed = append(failed, bulkFailure{recipient: rcpt, err: bulkEntryError(result)})
+				continue
+			}
+			if id := aws.ToString(result.MessageId); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(failed) == len(to) && len(to) > 0 {
+		return "", nil, failed[0].err
+	}
+	return strings.Join(ids, " "), failed, nil
+}
+
+// bulkEntryError turns a failed SendBulkEmail entry into the API error
+// SendEmail reports for the same cause, so that sesReply maps both alike.
+func bulkEntryError(result types.BulkEmailEntryResult) error {
+	msg := aws.ToString(result.Error)
+	code := string(result.Status)
+	switch result.Status {
+	case types.BulkEmailStatusMessageRejected:
+		code = "MessageRejected"
+	case types.BulkEmailStatusMailFromDomainNotVerified:
+		code = "MailFromDomainNotVerifiedException"
+	case types.BulkEmailStatusConfigurationSetNotFound, types.BulkEmailStatusTemplateNotFound:
+		code = "NotFoundException"
+	case types.BulkEmailStatusAccountSuspended:
+		code = "AccountSuspendedException"
+	case types.BulkEmailStatusAccountSendingPaused:
+		code = "AccountSendingPausedException"
+	case types.BulkEmailStatusConfigurationSetSendingPaused:
+		code = "ConfigurationSetSendingPausedException"
+	case types.BulkEmailStatusAccountThrottled:
+		code = "TooManyRequestsException"
+	case types.BulkEmailStatusAccountDailyQuotaExceeded:
+		code = "LimitExceededException"
+		msg = "daily sending quota exceeded: " + msg
+	case types.BulkEmailStatusInvalidParameter, types.BulkEmailStatusInvalidSendingPoolName:
+		code = "BadRequestException"
+	}
+	return &smithy.GenericAPIError{Code: code, Message: msg}
+}
+
+// sendTemplated handles a message addressed to the template trigger address.
+func (s *Session) sendTemplated(recipients []string) error {
+	if len(recipients) == 0 {
+		emailError.With(prometheus.Labels{"type": "no valid recipients", "tenant": s.tenant}).Inc()
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "Error: no valid recipients",
+		}
+	}
+
+	if err := s.checkNullSender(); err != nil {
+		return err
+	}
+
+	recipients = s.redirectRecipients(recipients)
+
+	name, templateData, err := parseTemplateRequest(s.data)
+	if err != nil {
+		emailError.With(prometheus.Labels{"type": "invalid template request", "tenant": s.tenant}).Inc()
+		return err
+	}
+
+	done, err := s.startSend(recipients)
+	if err != nil {
+		return err
+	}
+	messageID, failed, err := s.backend.templates.send(s.ctx, s.from, s.envelopeFrom(), recipients, name, templateData, s.configSet())
+	done(err)
+	if len(failed) > 0 {
+		// SES took the message for the others: resending everything would
+		// duplicate it, so the failures are only logged.
+		notSent := make(map[string]bool, len(failed))
+		for _, f := range failed {
+			notSent[f.recipient] = true
+			s.logf("ERROR: ses: templated message %q to %s not sent: %v", name, f.recipient, f.err)
+		}
+		recipients = slices.DeleteFunc(slices.Clone(recipients), func(r string) bool { return notSent[r] })
+	}
+	return s.finishSend(recipients, messageID, name, err)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/emersion/go-smtp"
+)
+
+// fakeTemplateClient records SendBulkEmail calls and answers each entry
+// with success, or with the status in reject for its recipient.
+type fakeTemplateClient struct {
+	reject map[string]types.BulkEmailStatus
+	err    error
+
+	mu    sync.Mutex
+	calls []*sesv2.SendBulkEmailInput
+}
+
+func (f *fakeTemplateClient) SendBulkEmail(ctx context.Context, in *sesv2.SendBulkEmailInput, _ ...func(*sesv2.Options)) (*sesv2.SendBulkEmailOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, in)
+	if f.err != nil {
+		return nil, f.err
+	}
+	out := &sesv2.SendBulkEmailOutput{}
+	for _, e := range in.BulkEmailEntries {
+		rcpt := e.Destination.ToAddresses[0]
+		if status, ok := f.reject[rcpt]; ok {
+			out.BulkEmailEntryResults = append(out.BulkEmailEntryResults, types.BulkEmailEntryResult{Status: status, Error: aws.String("rejected")})
+			continue
+		}
+		out.BulkEmailEntryResults = append(out.BulkEmailEntryResults, types.BulkEmailEntryResult{
+			Status:    types.BulkEmailStatusSuccess,
+			MessageId: aws.String("id-" + rcpt),
+		})
+	}
+	return out, nil
+}
+
+const templateMessage = "From: sender@example.com\r\n" +
+	TemplateHeader + ": welcome\r\n" +
+	TemplateDataHeader + ": {\"name\":\"Ann\"}\r\n" +
+	"\r\n"
+
+func TestTemplateSendBulk(t *testing.T) {
+	client := &fakeTemplateClient{}
+	b := newTestBackend(t, &fakeSender{})
+	b.templates = &templateSender{client: client, triggerAddress: "template@relay.invalid"}
+	s := newTestSession(t, b, templateMessage)
+
+	var recipients []string
+	for i := 0; i < 2*sesBulkMaxEntries+10; i++ {
+		recipients = append(recipients, fmt.Sprintf("r%d@example.net", i))
+	}
+	if err := s.sendTemplated(recipients); err != nil {
+		t.Fatalf("sendTemplated: %v", err)
+	}
+
+	if len(client.calls) != 3 {
+		t.Fatalf("%d SendBulkEmail calls, want 3", len(client.calls))
+	}
+	var sent []string
+	for _, in := range client.calls {
+		if len(in.BulkEmailEntries) > sesBulkMaxEntries {
+			t.Errorf("call with %d entries, limit is %d", len(in.BulkEmailEntries), sesBulkMaxEntries)
+		}
+		if aws.ToString(in.DefaultContent.Template.TemplateName) != "welcome" {
+			t.Errorf("template = %q, want welcome", aws.ToString(in.DefaultContent.Template.TemplateName))
+		}
+		if aws.ToString(in.FeedbackForwardingEmailAddress) != "sender@example.com" {
+			t.Errorf("feedback address = %q, want the envelope sender", aws.ToString(in.FeedbackForwardingEmailAddress))
+		}
+		for _, e := range in.BulkEmailEntries {
+			if n := len(e.Destination.ToAddresses) + len(e.Destination.CcAddresses) + len(e.Destination.BccAddresses); n != 1 {
+				t.Errorf("entry with %d destinations, want 1", n)
+			}
+			sent = append(sent, e.Destination.ToAddresses...)
+		}
+	}
+	if strings.Join(sent, ",") != strings.Join(recipients, ",") {
+		t.Errorf("sent to %v, want %v", sent, recipients)
+	}
+}
+
+func TestTemplateSendFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   *fakeTemplateClient
+		wantCode int // 0 for success
+	}{
+		{
+			name:   "one rejected",
+			client: &fakeTemplateClient{reject: map[string]types.BulkEmailStatus{"a@example.net": types.BulkEmailStatusMessageRejected}},
+		},
+		{
+			name: "all rejected",
+			client: &fakeTemplateClient{reject: map[string]types.BulkEmailStatus{
+				"a@example.net": types.BulkEmailStatusMessageRejected,
+				"b@example.net": types.BulkEmailStatusMessageRejected,
+			}},
+			wantCode: 554,
+		},
+		{
+			name: "quota",
+			client: &fakeTemplateClient{reject: map[string]types.BulkEmailStatus{
+				"a@example.net": types.BulkEmailStatusAccountDailyQuotaExceeded,
+				"b@example.net": types.BulkEmailStatusAccountDailyQuotaExceeded,
+			}},
+			wantCode: 451,
+		},
+		{
+			name:     "call failed",
+			client:   &fakeTemplateClient{err: errors.New("connection refused")},
+			wantCode: 451,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBackend(t, &fakeSender{})
+			b.templates = &templateSender{client: tt.client, triggerAddress: "template@relay.invalid"}
+			s := newTestSession(t, b, templateMessage)
+			s.ctx = context.Background()
+
+			err := s.sendTemplated([]string{"a@example.net", "b@example.net"})
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("sendTemplated: %v", err)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+				t.Fatalf("sendTemplated = %v, want %d", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestTemplateSendRouted(t *testing.T) {
+	def, routed := &fakeTemplateClient{}, &fakeTemplateClient{}
+	b := newTestBackend(t, &fakeSender{})
+	b.templates = &templateSender{
+		client:         def,
+		triggerAddress: "template@relay.invalid",
+		routes:         map[string]templateClient{"example.com": routed},
+	}
+	s := newTestSession(t, b, templateMessage)
+
+	if err := s.sendTemplated([]string{"a@example.net"}); err != nil {
+		t.Fatalf("sendTemplated: %v", err)
+	}
+	if len(routed.calls) != 1 || len(def.calls) != 0 {
+		t.Errorf("routed client called %d times, default %d times; want 1 and 0", len(routed.calls), len(def.calls))
+	}
+}
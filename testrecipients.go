@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/mail"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// TestRecipientsHeader replaces the envelope recipients of a message when
+// -enable-test-recipients is set.
+const TestRecipientsHeader = "X-Test-Recipients"
+
+var (
+	testRecipientsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "test_recipients_active",
+		Help:      "1 when -enable-test-recipients lets the " + TestRecipientsHeader + " header override the recipients",
+	})
+	testRecipientsUsed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtpd",
+		Name:      "test_recipients_total",
+		Help:      "Total number of messages sent to the recipients of their " + TestRecipientsHeader + " header",
+	})
+)
+
+// testRecipients returns the recipients listed in the message's
+// X-Test-Recipients header instead of the envelope recipients, when
+// -enable-test-recipients is set. The header is removed before sending.
+// Messages without it keep their envelope recipients.
+func (s *Session) testRecipients(recipients []string) ([]string, error) {
+	if !s.backend.testRecipients {
+		return recipients, nil
+	}
+	fields, _ := splitHeader(s.data)
+	value, ok := getHeader(fields, TestRecipientsHeader)
+	if !ok {
+		return recipients, nil
+	}
+	s.removeField(TestRecipientsHeader)
+	list, err := mail.ParseAddressList(value)
+	if err != nil || len(list) == 0 {
+		emailError.With(prometheus.Labels{"type": "invalid test recipients", "tenant": s.tenant}).Inc()
+		s.logf("invalid %s header: %q", TestRecipientsHeader, value)
+		return nil, &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Error: invalid " + TestRecipientsHeader + " header",
+		}
+	}
+	override := make([]string, 0, len(list))
+	for _, a := range list {
+		override = append(override, a.Address)
+	}
+	testRecipientsUsed.Inc()
+	s.logf("TEST: message from %s for %v sent to %d recipients from %s", s.from, recipients, len(override), TestRecipientsHeader)
+	return override, nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var connectionTLS = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "connection_tls_total",
+	Help:      "Total number of closed SMTP connections by TLS use, version and cipher suite",
+}, []string{"encrypted", "version", "cipher"})
+
+// TLS policy presets following the Mozilla server side TLS guidelines
+// (https://wiki.mozilla.org/Security/Server_Side_TLS).
+const (
+	TLSPolicyModern       = "modern"
+	TLSPolicyIntermediate = "intermediate"
+)
+
+// intermediateCipherSuites are the Mozilla "intermediate" TLS 1.2 suites
+// supported by crypto/tls. TLS 1.3 suites are not configurable in Go.
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+var defaultCurves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+
+var curvesByName = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var tlsVersionsByName = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsOptions holds the TLS related command line settings.
+type tlsOptions struct {
+	certFile     string
+	keyFile      string
+	policy       string
+	minVersion   string
+	cipherSuites string
+	curves       string
+	sniCerts     sniCertFlags
+}
+
+// sniCert is a certificate served for a specific SNI hostname.
+type sniCert struct {
+	hostname string
+	certFile string
+	keyFile  string
+}
+
+// sniCertFlags implements flag.Value for the repeatable -tls-sni-cert flag.
+// Each value has the form "hostname=certfile,keyfile".
+type sniCertFlags []sniCert
+
+func (f *sniCertFlags) String() string {
+	parts := make([]string, 0, len(*f))
+	for _, c := range *f {
+		parts = append(parts, c.hostname+"="+c.certFile+","+c.keyFile)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f *sniCertFlags) Set(value string) error {
+	host, files, ok := strings.Cut(value, "=")
+	certFile, keyFile, ok2 := strings.Cut(files, ",")
+	if !ok || !ok2 || host == "" || certFile == "" || keyFile == "" {
+		return fmt.Errorf("expected hostname=certfile,keyfile, got %q", value)
+	}
+	*f = append(*f, sniCert{hostname: strings.ToLower(host), certFile: certFile, keyFile: keyFile})
+	return nil
+}
+
+// certStore selects the certificate for a handshake by SNI hostname,
+// falling back to the default certificate.
+type certStore struct {
+	def    *tls.Certificate
+	byName map[string]*tls.Certificate
+}
+
+// loadCertStore loads and validates the default and SNI certificates.
+func loadCertStore(o tlsOptions) (*certStore, error) {
+	def, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	store := &certStore{def: &def, byName: make(map[string]*tls.Certificate)}
+
+	for _, sc := range o.sniCerts {
+		cert, err := tls.LoadX509KeyPair(sc.certFile, sc.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate for %s: %w", sc.hostname, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate for %s: %w", sc.hostname, err)
+		}
+		check := sc.hostname
+		if domain, ok := strings.CutPrefix(check, "*."); ok {
+			// Any name under the domain must be covered by the certificate.
+			check = "sni-check." + domain
+		}
+		if err := leaf.VerifyHostname(check); err != nil {
+			return nil, fmt.Errorf("certificate for %s: %w", sc.hostname, err)
+		}
+		cert.Leaf = leaf
+		if _, dup := store.byName[sc.hostname]; dup {
+			return nil, fmt.Errorf("duplicate SNI certificate for %s", sc.hostname)
+		}
+		store.byName[sc.hostname] = &cert
+	}
+	return store, nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. Exact hostnames take
+// precedence over "*.domain" wildcard entries.
+func (c *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := c.byName[name]; ok {
+			return cert, nil
+		}
+		if _, domain, ok := strings.Cut(name, "."); ok {
+			if cert, ok := c.byName["*."+domain]; ok {
+				return cert, nil
+			}
+		}
+	}
+	return c.def, nil
+}
+
+// certReloader holds the current certStore of a TLS configuration so that
+// certificates can be replaced without restarting. All reloaders are kept in
+// certReloaders for reloadCertificates.
+type certReloader struct {
+	opts  tlsOptions
+	store atomic.Pointer[certStore]
+}
+
+var certReloaders struct {
+	sync.Mutex
+	list []*certReloader
+}
+
+func newCertReloader(o tlsOptions) (*certReloader, error) {
+	store, err := loadCertStore(o)
+	if err != nil {
+		return nil, err
+	}
+	r := &certReloader{opts: o}
+	r.store.Store(store)
+	certReloaders.Lock()
+	certReloaders.list = append(certReloaders.list, r)
+	certReloaders.Unlock()
+	return r, nil
+}
+
+// reload re-reads the certificate files and swaps them in if they are valid
+// and the default certificate has not expired. Otherwise the current
+// certificates stay in use.
+func (r *certReloader) reload() error {
+	store, err := loadCertStore(r.opts)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(store.def.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing certificate: %w", err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("certificate %s expired on %s", r.opts.certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	r.store.Store(store)
+	log.Printf("Reloaded TLS certificate %s (subject: %s, expires: %s, SNI certificates: %d)",
+		r.opts.certFile, leaf.Subject, leaf.NotAfter.Format(time.RFC3339), len(store.byName))
+	return nil
+}
+
+func (r *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.store.Load().getCertificate(hello)
+}
+
+// reloadCertificates reloads every TLS configuration, logging failures.
+// New handshakes use the new certificates; established connections are
+// not affected.
+func reloadCertificates() {
+	certReloaders.Lock()
+	defer certReloaders.Unlock()
+	for _, r := range certReloaders.list {
+		if err := r.reload(); err != nil {
+			log.Printf("ERROR: reloading TLS certificate %s, keeping the current one: %v", r.opts.certFile, err)
+		}
+	}
+}
+
+// buildTLSConfig returns the server TLS configuration, or nil when no
+// certificate is configured. Invalid policy combinations are rejected.
+func buildTLSConfig(o tlsOptions) (*tls.Config, error) {
+	if o.certFile == "" && o.keyFile == "" {
+		if len(o.sniCerts) > 0 {
+			return nil, fmt.Errorf("-tls-sni-cert requires a default -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if o.certFile == "" || o.keyFile == "" {
+		return nil, fmt.Errorf("both -tls-cert and -tls-key are required")
+	}
+
+	r, err := newCertReloader(o)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		GetCertificate:   r.getCertificate,
+		CurvePreferences: defaultCurves,
+	}
+	if err := applyTLSPolicy(cfg, o); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyTLSPolicy sets the protocol versions, cipher suites and curves on cfg.
+func applyTLSPolicy(cfg *tls.Config, o tlsOptions) error {
+	switch o.policy {
+	case TLSPolicyModern:
+		cfg.MinVersion = tls.VersionTLS13
+	case TLSPolicyIntermediate, "":
+		cfg.MinVersion = tls.VersionTLS12
+		cfg.CipherSuites = intermediateCipherSuites
+	default:
+		return fmt.Errorf("unknown TLS policy %q (want %s or %s)", o.policy, TLSPolicyModern, TLSPolicyIntermediate)
+	}
+
+	if o.minVersion != "" {
+		v, ok := tlsVersionsByName[o.minVersion]
+		if !ok {
+			return fmt.Errorf("unsupported TLS minimum version %q (want 1.2 or 1.3)", o.minVersion)
+		}
+		if o.policy == TLSPolicyModern && v < tls.VersionTLS13 {
+			return fmt.Errorf("TLS policy %s requires TLS 1.3", TLSPolicyModern)
+		}
+		cfg.MinVersion = v
+	}
+
+	if o.cipherSuites != "" {
+		if cfg.MinVersion >= tls.VersionTLS13 {
+			return fmt.Errorf("cipher suites cannot be configured when only TLS 1.3 is allowed")
+		}
+		suites, err := parseCipherSuites(o.cipherSuites)
+		if err != nil {
+			return err
+		}
+		cfg.CipherSuites = suites
+	}
+
+	if o.curves != "" {
+		curves, err := parseCurves(o.curves)
+		if err != nil {
+			return err
+		}
+		cfg.CurvePreferences = curves
+	}
+
+	return nil
+}
+
+// parseCipherSuites maps a comma separated list of Go cipher suite names to
+// IDs. Only suites crypto/tls considers secure and usable with TLS 1.2 are
+// accepted.
+func parseCipherSuites(list string) ([]uint16, error) {
+	known := make(map[string]*tls.CipherSuite)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		cs, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		usable := false
+		for _, v := range cs.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				usable = true
+			}
+		}
+		if !usable {
+			return nil, fmt.Errorf("cipher suite %q is not configurable for TLS 1.2", name)
+		}
+		ids = append(ids, cs.ID)
+	}
+	return ids, nil
+}
+
+// parseCurves maps a comma separated list of curve names to IDs.
+func parseCurves(list string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		c, ok := curvesByName[strings.ToUpper(strings.ReplaceAll(name, "-", ""))]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q (want X25519, P256, P384 or P521)", name)
+		}
+		curves = append(curves, c)
+	}
+	return curves, nil
+}
+
+// observeConnectionTLS counts a closed connection by its final TLS state.
+// Cipher suites crypto/tls does not consider secure share the "insecure"
+// label to bound the cardinality.
+func observeConnectionTLS(state tls.ConnectionState, encrypted bool) {
+	if !encrypted {
+		connectionTLS.With(prometheus.Labels{"encrypted": "false", "version": "none", "cipher": "none"}).Inc()
+		return
+	}
+	cipher := "insecure"
+	for _, cs := range tls.CipherSuites() {
+		if cs.ID == state.CipherSuite {
+			cipher = cs.Name
+		}
+	}
+	connectionTLS.With(prometheus.Labels{
+		"encrypted": "true",
+		"version":   tls.VersionName(state.Version),
+		"cipher":    cipher,
+	}).Inc()
+}
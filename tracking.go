@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultTrackingHeader carries the relay generated message ID.
+const DefaultTrackingHeader = "X-Relay-Message-ID"
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// newConnID returns a short random ID identifying a connection in logs.
+func newConnID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%x", b)
+}
+
+// applyTrackingID assigns the transaction's tracking ID and stamps it into
+// the message header. An ID already present in the header is adopted unless
+// overwriting is enabled.
+func (s *Session) applyTrackingID() {
+	s.trackingID = newUUID()
+
+	name := s.backend.trackingHeader
+	if name == "" {
+		return
+	}
+
+	fields, _ := splitHeader(s.data)
+	if existing, ok := getHeader(fields, name); ok {
+		if !s.backend.trackingOverwrite && existing != "" {
+			s.trackingID = existing
+			return
+		}
+		s.removeField(name)
+	}
+	s.prependField(name, s.trackingID)
+}
+
+// observePhase records the duration of a transaction phase. With
+// -metrics-exemplars the tracking ID is attached, linking latency outliers
+// to the matching log lines.
+func (s *Session) observePhase(phase string, d time.Duration) {
+	o := phaseDuration.With(prometheus.Labels{"phase": phase})
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && s.backend.exemplars && s.trackingID != "" {
+		eo.ObserveWithExemplar(d.Seconds(), prometheus.Labels{"relay_id": s.trackingID})
+		return
+	}
+	o.Observe(d.Seconds())
+}
+
+// logf logs a message tagged with the connection ID and the transaction's
+// tracking ID.
+func (s *Session) logf(format string, v ...any) {
+	if s.trackingID != "" {
+		format = "relay_id=" + s.trackingID + " " + format
+	}
+	if s.connID != "" {
+		format = "conn=" + s.connID + " " + format
+	}
+	log.Printf(format, v...)
+}
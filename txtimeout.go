@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var transactionTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "smtpd",
+	Name:      "transaction_timeout_total",
+	Help:      "Total number of DATA transactions that exceeded -transaction-timeout, by phase",
+}, []string{"phase"})
+
+// startTransaction sets s.ctx for the DATA transaction and returns the
+// function ending it. The context derives from the backend's, so that
+// in-flight SES calls are cancelled on shutdown. With -transaction-timeout
+// it also expires after the timeout, which interrupts a message still being
+// read and drops the connection once the reply is written: the client may
+// still be sending the rest of the message.
+func (s *Session) startTransaction() func() {
+	d := s.backend.transactionTimeout
+	if d <= 0 {
+		ctx, cancel := context.WithCancel(s.backend.context())
+		s.ctx = ctx
+		return cancel
+	}
+	ctx, cancel := context.WithTimeout(s.backend.context(), d)
+	s.ctx = ctx
+	conn := s.conn.Conn()
+	stop := context.AfterFunc(ctx, func() {
+		if ct := trackedConn(conn); ct != nil {
+			ct.drop()
+		}
+		conn.SetReadDeadline(time.Now())
+	})
+	return func() {
+		stop()
+		cancel()
+	}
+}
+
+// errShuttingDown fails a send cancelled because the relay is shutting
+// down; the client retries elsewhere or later.
+var errShuttingDown = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Service shutting down. Please try again later",
+}
+
+// context returns the context cancelled when the relay shuts down.
+func (b *Backend) context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+// transactionExpired reports whether the -transaction-timeout has passed.
+func (s *Session) transactionExpired() bool {
+	return errors.Is(s.ctx.Err(), context.DeadlineExceeded)
+}
+
+// transactionTimedOut fails the transaction that exceeded the timeout in
+// phase.
+func (s *Session) transactionTimedOut(phase string) error {
+	transactionTimeouts.With(prometheus.Labels{"phase": phase}).Inc()
+	emailError.With(prometheus.Labels{"type": "transaction timeout", "tenant": s.tenant}).Inc()
+	s.logf("transaction from %s exceeded %s during %s", s.from, s.backend.transactionTimeout, phase)
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 7},
+		Message:      "Transaction time limit exceeded. Please try again later",
+	}
+}